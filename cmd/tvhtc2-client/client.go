@@ -4,73 +4,278 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"net"
+	"io/ioutil"
 	"os"
+	"text/tabwriter"
 
+	"github.com/Xiol/tvhtc2/internal/pkg/api"
 	"github.com/Xiol/tvhtc2/internal/pkg/config"
 	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/Xiol/tvhtc2/internal/pkg/notify"
+	"github.com/Xiol/tvhtc2/internal/pkg/reconcile"
+	"github.com/Xiol/tvhtc2/internal/pkg/remote"
+	"github.com/Xiol/tvhtc2/internal/pkg/spool"
+	"github.com/Xiol/tvhtc2/internal/pkg/state"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 )
 
 func main() {
 	log.SetLevel(log.FatalLevel)
 	log.Warning("TVHTC2 client initialising...")
 
-	if err := config.InitConfig(); err != nil {
-		log.Fatal(err.Error())
-	}
-
 	var path = flag.String("path", "", "path to file")
 	var channel = flag.String("channel", "", "channel")
 	var title = flag.String("title", "", "programme title")
 	var status = flag.String("status", "", "status of recording")
 	var description = flag.String("description", "", "description of programme")
+	var priority = flag.Int("priority", 0, "job priority, higher runs first (default: decided by scheduling rules)")
+	var list = flag.Bool("list", false, "list queued jobs and exit")
+	var runNow = flag.String("run-now", "", "run the job with this ID now, ignoring transcode windows, or 'all' for every queued job")
+	var preview = flag.String("preview", "", "render the notification template for an outcome (success, skipped, failed, quarantined) or digest against sample recordings and exit")
+	var backend = flag.String("backend", "default", "notification backend whose templates -preview should use")
+	var reconcileNow = flag.Bool("reconcile", false, "remove temporary files left by transcodes that never finished, list recordings that were never processed and exit")
+	var enqueue = flag.Bool("enqueue", false, "with -reconcile, queue the recordings that were never processed")
+	var fromStdin = flag.Bool("stdin", false, "read the recording's details from stdin as JSON, either as tvhtc2 details or a TVHeadend DVR entry")
+	flag.Usage = usage
 	flag.Parse()
 
-	if *path == "" {
-		log.Fatal("missing path")
+	// A recording is spooled rather than lost if the configuration can't be
+	// used, everything else needs it
+	_, cfgErr := config.InitClient()
+	if cfgErr != nil && (*preview != "" || *list || *runNow != "" || *reconcileNow) {
+		log.Fatal(cfgErr.Error())
+	}
+
+	if *preview != "" {
+		previewTemplate(*backend, notify.Outcome(*preview))
+		os.Exit(0)
 	}
 
-	if *channel == "" {
-		log.Fatal("missing channel")
+	if *list {
+		listJobs()
+		os.Exit(0)
 	}
 
-	if *title == "" {
-		log.Fatal("missing title")
+	if *runNow != "" {
+		forceJobs(*runNow)
+		os.Exit(0)
 	}
 
-	if *status == "" {
-		log.Fatal("missing status")
+	if *reconcileNow {
+		reconcileRecordings(*enqueue)
+		os.Exit(0)
 	}
 
-	if *description == "" {
-		log.Fatal("missing description")
+	var details media.Details
+	var err error
+	if *fromStdin {
+		var data []byte
+		if data, err = ioutil.ReadAll(os.Stdin); err != nil {
+			log.Fatalf("failed to read stdin: %s", err)
+		}
+		details, err = api.DetailsFromJSON(data)
+	} else {
+		details, err = api.DetailsFromArgs(flag.Args())
 	}
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	// Flags take precedence over anything else
+	for _, f := range []struct {
+		value *string
+		field *string
+	}{
+		{path, &details.Path},
+		{channel, &details.Channel},
+		{title, &details.Title},
+		{status, &details.Status},
+		{description, &details.Description},
+	} {
+		if *f.value != "" {
+			*f.field = *f.value
+		}
+	}
+
+	if err := api.Complete(&details); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	req := api.Request{
+		Command: api.CommandSubmit,
+		Details: &details,
+	}
+
+	// Only send a priority if one was given, so the daemon's rules apply otherwise
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "priority" {
+			req.Priority = priority
+		}
+	})
+
+	submit(req, cfgErr)
+	os.Exit(0)
+}
 
-	details := media.Details{
-		Path:        *path,
-		Channel:     *channel,
-		Title:       *title,
-		Status:      *status,
-		Description: *description,
+// submit sends req to the daemon, or spools it for the daemon to pick up
+// when it is next running if no response was received, so that no recording
+// is lost while it is restarting. A recording the daemon did queue before
+// going away is ignored when the spool is ingested. If cfgErr says the
+// configuration couldn't be used, req is spooled without trying the daemon.
+func submit(req api.Request, cfgErr error) {
+	if cfgErr != nil {
+		spoolRequest(req, fmt.Sprintf("unable to use the configuration (%s)", cfgErr))
+		return
 	}
 
-	payload, err := json.Marshal(details)
+	resp, err := sendRequest(req)
 	if err != nil {
-		log.Fatalf("failed to marshal programme details: %s", err)
+		spoolRequest(req, fmt.Sprintf("no response from the daemon (%s)", err))
+		return
+	}
+	if !resp.OK {
+		log.Fatalf("daemon rejected request: %s", resp.Error)
 	}
+	fmt.Printf("ok\n")
+}
 
-	c, err := net.Dial("unix", viper.GetString("socket_path"))
+// spoolRequest spools req, explaining why it wasn't sent.
+func spoolRequest(req api.Request, why string) {
+	path, err := spool.Write(config.Current().Spool.Path, req)
 	if err != nil {
-		log.Fatalf("failed to dial TVHTC2 socket: %s", err)
+		log.Fatalf("%s, and failed to spool the request: %s", why, err)
 	}
+	fmt.Printf("ok, %s, spooled to %s\n", why, path)
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [key=value ...]\n\n", os.Args[0])
+	fmt.Fprintf(out, "Queues a recording. Its details can be given as flags, key=value arguments or\n")
+	fmt.Fprintf(out, "JSON on stdin. Only the path is required. The TVHeadend post-processor command\n")
+	fmt.Fprintf(out, "can pass everything it knows as:\n\n  %s", os.Args[0])
+	for _, k := range api.ArgKeys {
+		fmt.Fprintf(out, " \"%s=%s\"", k.Key, k.Format)
+	}
+	fmt.Fprintf(out, "\n\nFlags:\n")
+	flag.PrintDefaults()
+}
 
-	i, err := c.Write(payload)
+// sendRequest sends req to the daemon, over HTTPS if a remote daemon is
+// configured and the unix socket otherwise.
+func sendRequest(req api.Request) (api.Response, error) {
+	cfg := config.Current()
+	if cfg.RemoteClient.URL == "" {
+		return api.Send(cfg.SocketPath, req)
+	}
+
+	c, err := remote.NewClient(cfg.RemoteClient)
 	if err != nil {
-		log.Fatalf("failed to write payload to socket after %d bytes: %s", i, err)
+		return api.Response{}, err
 	}
+	return c.Send(req)
+}
 
-	fmt.Printf("ok\n")
-	os.Exit(0)
+func send(req api.Request) api.Response {
+	resp, err := sendRequest(req)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if !resp.OK {
+		log.Fatalf("daemon rejected request: %s", resp.Error)
+	}
+	return resp
+}
+
+func listJobs() {
+	resp := send(api.Request{Command: api.CommandList})
+
+	var jobs []state.JobStatus
+	if err := json.Unmarshal(resp.Data, &jobs); err != nil {
+		log.Fatalf("failed to unmarshal job list: %s", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tPRIORITY\tSTATUS\tADDED\tTITLE\n")
+	for _, job := range jobs {
+		status := "queued"
+		switch {
+		case job.Running && job.Worker != "":
+			status = fmt.Sprintf("running on %s (%.0f%%)", job.Worker, job.Progress*100)
+		case job.Running:
+			status = "running"
+		case job.Quarantined && !job.Force:
+			status = "quarantined"
+		case job.Held:
+			status = "failed"
+		case job.Force:
+			status = "forced"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", job.ID, job.Priority, status,
+			job.Added.Format("2006-01-02 15:04"), job.Details.Title)
+	}
+	w.Flush()
+}
+
+func forceJobs(id string) {
+	if id == "all" {
+		id = ""
+	}
+
+	resp := send(api.Request{Command: api.CommandRunNow, JobID: id})
+
+	var result struct {
+		Count int `json:"count"`
+	}
+	if err := json.Unmarshal(resp.Data, &result); err != nil {
+		log.Fatalf("failed to unmarshal response: %s", err)
+	}
+	fmt.Printf("ok, %d job(s) will run now\n", result.Count)
+}
+
+func reconcileRecordings(enqueue bool) {
+	resp := send(api.Request{Command: api.CommandReconcile, Enqueue: enqueue})
+
+	var result reconcile.Result
+	if err := json.Unmarshal(resp.Data, &result); err != nil {
+		log.Fatalf("failed to unmarshal response: %s", err)
+	}
+
+	for _, path := range result.Removed {
+		fmt.Printf("removed: %s\n", path)
+	}
+	for _, details := range result.Unprocessed {
+		fmt.Printf("unprocessed: %s\n", details.Path)
+	}
+	fmt.Printf("ok, removed %d temporary file(s), found %d unprocessed recording(s), queued %d\n",
+		len(result.Removed), len(result.Unprocessed), result.Queued)
+	if !enqueue && len(result.Unprocessed) > 0 {
+		fmt.Printf("run again with -enqueue to queue them\n")
+	}
+}
+
+func previewTemplate(backend string, outcome notify.Outcome) {
+	if outcome == "digest" {
+		subject, body, err := config.Current().Notify.RenderDigest(backend, notify.SampleDigest())
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		fmt.Printf("Subject: %s\n\n%s\n", subject, body)
+		return
+	}
+
+	known := false
+	for _, o := range notify.Outcomes {
+		known = known || o == outcome
+	}
+	if !known {
+		log.Fatalf("unknown outcome '%s', expected one of %v", outcome, notify.Outcomes)
+	}
+
+	subject, body, err := config.Current().Notify.Render(backend, outcome, notify.SampleEntity(outcome))
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	fmt.Printf("Subject: %s\n\n%s\n", subject, body)
 }
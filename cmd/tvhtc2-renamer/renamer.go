@@ -32,7 +32,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	r := renamer.NewRenamer()
+	r := renamer.NewRenamer(config.Current().Media.Renamer)
 	newPath := r.Rename(*path)
 
 	if *path == newPath {
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/config"
+)
+
+// checkConfig validates the configuration at path, or the usual one if path
+// is empty, printing every problem found. It returns the exit status.
+func checkConfig(path string) int {
+	file, report, err := config.Check(path)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	for _, w := range report.Warnings {
+		fmt.Printf("warning: %s\n", w)
+	}
+	for _, e := range report.Errors {
+		fmt.Printf("error: %s\n", e)
+	}
+
+	if len(report.Errors) > 0 {
+		fmt.Printf("%s: %d errors, %d warnings\n", file, len(report.Errors), len(report.Warnings))
+		return 1
+	}
+	fmt.Printf("%s: ok, %d warnings\n", file, len(report.Warnings))
+	return 0
+}
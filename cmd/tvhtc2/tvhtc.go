@@ -1,14 +1,29 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
+
 	"github.com/Xiol/tvhtc2/internal/pkg/config"
+	"github.com/Xiol/tvhtc2/internal/pkg/history"
 	"github.com/Xiol/tvhtc2/internal/pkg/notify"
+	"github.com/Xiol/tvhtc2/internal/pkg/remote"
 	"github.com/Xiol/tvhtc2/internal/pkg/transcoder"
+	"github.com/Xiol/tvhtc2/internal/pkg/watcher"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 )
 
 func main() {
+	// tvhtc2 check-config [path] validates the configuration and exits
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		log.SetLevel(log.ErrorLevel)
+		var path string
+		if len(os.Args) > 2 {
+			path = os.Args[2]
+		}
+		os.Exit(checkConfig(path))
+	}
+
 	log.SetLevel(log.DebugLevel)
 	fmt := log.TextFormatter{
 		DisableTimestamp: true,
@@ -20,13 +35,61 @@ func main() {
 		log.Fatal(err.Error())
 	}
 
-	notificationHandler := notify.NewHandler(viper.GetString("pushover.app_token"))
-	t, err := transcoder.New(notificationHandler)
+	// tvhtc2 worker transcodes jobs leased from a coordinator
+	if len(os.Args) > 1 && os.Args[1] == "worker" {
+		runWorker()
+		return
+	}
+
+	hist, err := history.Load(config.Current().History)
+	if err != nil {
+		log.Fatalf("error loading history: %s", err)
+	}
+	config.OnReload(func(c *config.Config) {
+		hist.Update(c.History)
+	})
+
+	notificationHandler, err := notify.NewHandler(config.Current().Notify, notify.WithHistory(hist))
+	if err != nil {
+		log.Fatalf("error initialising notifications: %s", err)
+	}
+	config.OnReload(func(c *config.Config) {
+		if err := notificationHandler.Update(c.Notify); err != nil {
+			log.WithError(err).Error("error updating notification settings")
+		}
+	})
+	notificationHandler.Start()
+	defer notificationHandler.Close()
+
+	t, err := transcoder.New(notificationHandler, transcoder.History(hist))
 	if err != nil {
 		log.Fatalf("error initialising transcoder: %s", err)
 	}
 
 	defer t.Close()
+
+	// Directories are only watched from startup, changes need a restart
+	if watch := config.Current().Watch; watch.Enabled {
+		mark := filepath.Join(filepath.Dir(config.Current().StatePath), "watch.mark")
+		w := watcher.New(watch, t.Submit, watcher.Known(t.Known), watcher.Mark(mark))
+		if err := w.Start(); err != nil {
+			log.Fatalf("error starting watcher: %s", err)
+		}
+		defer w.Close()
+	}
+
+	// As are changes to the listener
+	if listen := config.Current().Remote; listen.Enabled {
+		srv := remote.NewServer(listen, t.Handle)
+		if config.Current().Cluster.Enabled {
+			t.Coordinate(srv)
+		}
+		if err := srv.Start(); err != nil {
+			log.Fatalf("error starting remote listener: %s", err)
+		}
+		defer srv.Close()
+	}
+
 	if err := t.Do(); err != nil {
 		log.WithError(err).Error("error during transcoder startup")
 	}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/cluster"
+	"github.com/Xiol/tvhtc2/internal/pkg/config"
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/Xiol/tvhtc2/internal/pkg/remote"
+	log "github.com/sirupsen/logrus"
+)
+
+// runWorker leases jobs from the coordinator at remote.client.url and
+// transcodes them here, until interrupted.
+func runWorker() {
+	cfg := config.Current()
+	if cfg.RemoteClient.URL == "" {
+		log.Fatal("remote.client.url must be set to the coordinator to run as a worker")
+	}
+
+	client, err := remote.NewClient(cfg.RemoteClient)
+	if err != nil {
+		log.Fatalf("error creating coordinator client: %s", err)
+	}
+
+	w := cluster.NewWorker(cfg.Worker, client, func() media.Config {
+		return config.Current().Media
+	})
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		log.Warning("stopping once the current job, if any, has finished")
+		w.Close()
+	}()
+
+	w.Run()
+}
@@ -4,5 +4,19 @@
 # tvheadend to access the tvhtc2-client binary (along with the socket).
 cp /usr/bin/tvhtc2-client /srv/tvhtc2/tvhtc2-client
 
+# Any setting can be overridden with a TVHTC2_* environment variable, such
+# as TVHTC2_PUSHOVER_APP_TOKEN. Docker secrets named after a setting, such as
+# pushover_app_token, are read from their files so that tokens never need to
+# be in the image or the config. Per recipient secrets can use key_file in
+# the config to name a file under /run/secrets.
+if [ -d /run/secrets ]; then
+    export CREDENTIALS_DIRECTORY="${CREDENTIALS_DIRECTORY:-/run/secrets}"
+    for secret in /run/secrets/*; do
+        [ -f "$secret" ] || continue
+        name=$(basename "$secret" | tr 'a-z.-' 'A-Z__')
+        export "TVHTC2_${name}_FILE=$secret"
+    done
+fi
+
 # Start the server
-/usr/bin/tvhtc2
\ No newline at end of file
+exec /usr/bin/tvhtc2
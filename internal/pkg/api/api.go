@@ -0,0 +1,82 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+)
+
+// Command identifies what a client is asking the daemon to do.
+type Command string
+
+const (
+	// CommandSubmit queues a new recording for processing.
+	CommandSubmit Command = "submit"
+	// CommandList returns the jobs in the queue.
+	CommandList Command = "list"
+	// CommandRunNow runs a job immediately, ignoring transcode windows. If no
+	// job ID is given every queued job is run.
+	CommandRunNow Command = "run_now"
+	// CommandReconcile removes orphaned temporary files and reports the
+	// recordings that were never processed, queueing them if Enqueue is set.
+	CommandReconcile Command = "reconcile"
+)
+
+// A Request is the payload sent by tvhtc2-client over the daemon socket.
+type Request struct {
+	Command  Command        `json:"command"`
+	Details  *media.Details `json:"details,omitempty"`
+	Priority *int           `json:"priority,omitempty"`
+	JobID    string         `json:"job_id,omitempty"`
+	Enqueue  bool           `json:"enqueue,omitempty"`
+}
+
+// A Response is written back to the client once the request has been handled.
+type Response struct {
+	OK    bool            `json:"ok"`
+	Error string          `json:"error,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// Decode parses a request. Older clients sent a bare media.Details object,
+// these are treated as a submit request.
+func Decode(data []byte) (Request, error) {
+	var req Request
+	if err := json.Unmarshal(data, &req); err != nil {
+		return req, fmt.Errorf("api: failed to unmarshal request: %s", err)
+	}
+
+	if req.Command == "" && req.Details == nil {
+		var details media.Details
+		if err := json.Unmarshal(data, &details); err != nil {
+			return req, fmt.Errorf("api: failed to unmarshal media details: %s", err)
+		}
+		req.Command = CommandSubmit
+		req.Details = &details
+	}
+
+	if req.Command == CommandSubmit && (req.Details == nil || req.Details.Path == "") {
+		return req, fmt.Errorf("api: submit request is missing a path")
+	}
+
+	return req, nil
+}
+
+// Ok returns a successful response carrying data, which may be nil.
+func Ok(data interface{}) Response {
+	if data == nil {
+		return Response{OK: true}
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Fail(fmt.Errorf("api: failed to marshal response: %s", err))
+	}
+	return Response{OK: true, Data: raw}
+}
+
+// Fail returns an unsuccessful response carrying err.
+func Fail(err error) Response {
+	return Response{Error: err.Error()}
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+// Send writes req to the daemon listening on the unix socket at path and
+// waits for its response. Any error means the daemon's response wasn't
+// received, so it may or may not have seen the request.
+func Send(path string, req Request) (Response, error) {
+	var resp Response
+
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return resp, fmt.Errorf("api: failed to marshal request: %s", err)
+	}
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		return resp, unavailableError{fmt.Errorf("api: failed to dial TVHTC2 socket: %s", err)}
+	}
+	defer c.Close()
+
+	if i, err := c.Write(payload); err != nil {
+		return resp, fmt.Errorf("api: failed to write payload to socket after %d bytes: %s", i, err)
+	}
+
+	// The daemon reads until EOF, so close our side to let it know we're done.
+	if err := c.(*net.UnixConn).CloseWrite(); err != nil {
+		return resp, fmt.Errorf("api: failed to close socket for writing: %s", err)
+	}
+
+	data, err := ioutil.ReadAll(c)
+	if err != nil {
+		return resp, fmt.Errorf("api: failed to read response: %s", err)
+	}
+
+	// A daemon killed while handling the request closes the connection
+	// without replying, as did daemons predating responses, so there is no
+	// telling whether it was handled.
+	if len(data) == 0 {
+		return resp, fmt.Errorf("api: daemon closed the connection without responding")
+	}
+
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return resp, fmt.Errorf("api: failed to unmarshal response: %s", err)
+	}
+
+	return resp, nil
+}
+
+// unavailableError is returned by Send when the daemon couldn't be reached,
+// so the request was never seen.
+type unavailableError struct {
+	error
+}
+
+// Unavailable marks err as meaning the daemon couldn't be reached.
+func Unavailable(err error) error {
+	return unavailableError{err}
+}
+
+// IsUnavailable reports whether err means the daemon couldn't be reached,
+// such as when it isn't running.
+func IsUnavailable(err error) bool {
+	_, ok := err.(unavailableError)
+	return ok
+}
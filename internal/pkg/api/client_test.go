@@ -0,0 +1,44 @@
+package api
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDaemon reads one request from a socket in a temporary directory and
+// replies with reply, returning the socket's path.
+func fakeDaemon(t *testing.T, reply string) string {
+	path := filepath.Join(t.TempDir(), "tvhtc2.socket")
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		ioutil.ReadAll(conn)
+		conn.Write([]byte(reply))
+	}()
+	return path
+}
+
+func TestSend(t *testing.T) {
+	resp, err := Send(fakeDaemon(t, `{"ok":true}`), Request{Command: CommandList})
+	require.NoError(t, err)
+	assert.True(t, resp.OK)
+
+	_, err = Send(fakeDaemon(t, ""), Request{Command: CommandList})
+	assert.Error(t, err, "a daemon that dies mid-request doesn't reply")
+	assert.False(t, IsUnavailable(err))
+
+	_, err = Send(filepath.Join(t.TempDir(), "missing.socket"), Request{Command: CommandList})
+	assert.True(t, IsUnavailable(err))
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/Xiol/tvhtc2/internal/pkg/tvheadend"
+)
+
+// StatusOK is the status TVHeadend gives (as %e) to recordings that
+// completed without error.
+const StatusOK = "OK"
+
+// ArgKeys are the keys accepted by DetailsFromArgs, with the TVHeadend
+// post-processor format string that supplies each.
+var ArgKeys = []struct {
+	Key, Format string
+}{
+	{"path", "%f"},
+	{"status", "%e"},
+	{"title", "%t"},
+	{"subtitle", "%s"},
+	{"channel", "%c"},
+	{"description", "%d"},
+	{"episode", "%p"},
+	{"start", "%S"},
+	{"stop", "%E"},
+}
+
+// DetailsFromArgs builds details from key=value arguments, so TVHeadend's
+// post-processor command can be written as
+//
+//	tvhtc2-client "path=%f" "status=%e" "title=%t" "channel=%c" "description=%d"
+//
+// with the arguments in any order and any of them empty or left out, other
+// than the path. See ArgKeys for the keys.
+func DetailsFromArgs(args []string) (media.Details, error) {
+	var d media.Details
+	for _, arg := range args {
+		i := strings.Index(arg, "=")
+		if i < 0 {
+			return d, fmt.Errorf("api: argument '%s' is not key=value", arg)
+		}
+		key, value := arg[:i], strings.TrimSpace(arg[i+1:])
+
+		var err error
+		switch key {
+		case "path":
+			d.Path = value
+		case "status":
+			d.Status = value
+		case "title":
+			d.Title = value
+		case "subtitle":
+			d.Subtitle = value
+		case "channel":
+			d.Channel = value
+		case "description":
+			d.Description = value
+		case "episode":
+			d.Season, d.Episode = tvheadend.Entry{Episode: value}.SeasonEpisode()
+		case "start":
+			d.Start, err = parseUnix(value)
+		case "stop":
+			d.Stop, err = parseUnix(value)
+		default:
+			return d, fmt.Errorf("api: unknown argument '%s'", key)
+		}
+		if err != nil {
+			return d, fmt.Errorf("api: invalid %s '%s': %s", key, value, err)
+		}
+	}
+	return d, nil
+}
+
+// parseUnix parses a time in seconds since the epoch, as TVHeadend passes
+// scheduled times. Empty values are the zero time.
+func parseUnix(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	secs, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(secs, 0), nil
+}
+
+// DetailsFromJSON builds details from a JSON object, which is either
+// media.Details or a DVR entry as returned by TVHeadend's
+// /api/dvr/entry/grid, so all of an entry's metadata can be passed through.
+func DetailsFromJSON(data []byte) (media.Details, error) {
+	var d media.Details
+
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return d, fmt.Errorf("api: failed to unmarshal details: %s", err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if _, ok := keys["filename"]; !ok {
+		if err := dec.Decode(&d); err != nil {
+			return d, fmt.Errorf("api: failed to unmarshal details: %s", err)
+		}
+		return d, nil
+	}
+
+	var entry tvheadend.Entry
+	if err := dec.Decode(&entry); err != nil {
+		return d, fmt.Errorf("api: failed to unmarshal DVR entry: %s", err)
+	}
+	d = entry.Merge(media.Details{Path: entry.Filename})
+	// TVHeadend describes the outcome in words, such as "Completed OK"
+	if entry.Status != "" && !strings.HasSuffix(entry.Status, StatusOK) {
+		d.Status = entry.Status
+	}
+	return d, nil
+}
+
+// Complete checks that d has a path and fills in what is missing. Without a
+// status the recording is assumed to be fine, and without a title it is
+// taken from the filename.
+func Complete(d *media.Details) error {
+	if d.Path == "" {
+		return fmt.Errorf("api: missing path")
+	}
+	if d.Status == "" {
+		d.Status = StatusOK
+	}
+	if strings.TrimSpace(d.Title) == "" {
+		d.Title = media.DetailsFromPath(filepath.Dir(d.Path), d.Path).Title
+	}
+	d.Clean()
+	return nil
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetailsFromArgs(t *testing.T) {
+	d, err := DetailsFromArgs([]string{
+		"title=Vera",
+		"path=/recordings/Vera/Vera2020-01-0121-00.ts",
+		"status=OK",
+		"channel=ITV HD",
+		"description=",
+		"subtitle=Blood Will Tell",
+		"episode=Season 10.Episode 2",
+		"start=1577912400",
+		"stop=",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, media.Details{
+		Path:     "/recordings/Vera/Vera2020-01-0121-00.ts",
+		Channel:  "ITV HD",
+		Title:    "Vera",
+		Status:   "OK",
+		Subtitle: "Blood Will Tell",
+		Season:   10,
+		Episode:  2,
+		Start:    time.Unix(1577912400, 0),
+	}, d)
+
+	_, err = DetailsFromArgs([]string{"/recordings/Vera.ts"})
+	assert.Error(t, err)
+	_, err = DetailsFromArgs([]string{"colour=blue"})
+	assert.Error(t, err)
+	_, err = DetailsFromArgs([]string{"start=yesterday"})
+	assert.Error(t, err)
+}
+
+func TestDetailsFromJSON(t *testing.T) {
+	d, err := DetailsFromJSON([]byte(`{"path":"/recordings/Vera.ts","title":"Vera","status":"OK"}`))
+	require.NoError(t, err)
+	assert.Equal(t, media.Details{Path: "/recordings/Vera.ts", Title: "Vera", Status: "OK"}, d)
+
+	d, err = DetailsFromJSON([]byte(`{
+		"uuid": "abc",
+		"filename": "/recordings/Vera/Vera.ts",
+		"disp_title": "Vera",
+		"disp_subtitle": "Blood Will Tell",
+		"episode_disp": "S10E02",
+		"channelname": "ITV HD",
+		"genre": [16],
+		"status": "Completed OK"
+	}`))
+	require.NoError(t, err)
+	assert.Equal(t, "/recordings/Vera/Vera.ts", d.Path)
+	assert.Equal(t, "Vera", d.Title)
+	assert.Equal(t, "Blood Will Tell", d.Subtitle)
+	assert.Equal(t, 10, d.Season)
+	assert.Equal(t, "", d.Status, "completed entries are left for Complete to mark as OK")
+	assert.Equal(t, []string{"Movie / Drama"}, d.Genre)
+
+	d, err = DetailsFromJSON([]byte(`{"filename":"/recordings/Vera.ts","status":"File missing"}`))
+	require.NoError(t, err)
+	assert.Equal(t, "File missing", d.Status)
+
+	_, err = DetailsFromJSON([]byte(`not json`))
+	assert.Error(t, err)
+}
+
+func TestComplete(t *testing.T) {
+	d := media.Details{Path: "/recordings/Vera_2020-01-01_21-00.ts"}
+	require.NoError(t, Complete(&d))
+	assert.Equal(t, "OK", d.Status)
+	assert.Equal(t, "Vera", d.Title)
+	assert.Equal(t, "", d.Description, "description is optional")
+
+	d = media.Details{Title: "Vera"}
+	assert.Error(t, Complete(&d))
+}
@@ -0,0 +1,92 @@
+package cluster
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/Xiol/tvhtc2/internal/pkg/remote"
+	"github.com/Xiol/tvhtc2/internal/pkg/state"
+)
+
+// The coordinator's endpoints for workers, served alongside the daemon's
+// remote listener and authenticated the same way.
+const (
+	LeasePath     = "/api/v1/lease"
+	HeartbeatPath = "/api/v1/heartbeat"
+	ResultPath    = "/api/v1/result"
+)
+
+const (
+	DefaultLeaseTTL          = 2 * time.Minute
+	DefaultPollInterval      = 30 * time.Second
+	DefaultHeartbeatInterval = 30 * time.Second
+)
+
+// CoordinatorConfig controls handing jobs to remote workers.
+type CoordinatorConfig struct {
+	Enabled bool
+	// LeaseTTL is how long a worker may go without a heartbeat before its
+	// job is returned to the queue.
+	LeaseTTL time.Duration
+	// RemoteOnly leaves every job to the workers, rather than transcoding
+	// on the coordinator as well.
+	RemoteOnly bool
+}
+
+// TTL returns the lease TTL, or the default if it isn't set.
+func (c CoordinatorConfig) TTL() time.Duration {
+	if c.LeaseTTL <= 0 {
+		return DefaultLeaseTTL
+	}
+	return c.LeaseTTL
+}
+
+// WorkerConfig controls a worker. It reaches the coordinator with the
+// remote client settings.
+type WorkerConfig struct {
+	// Name identifies the worker to the coordinator, the hostname by default.
+	Name string
+	// PollInterval is how often to ask for a job while the queue is empty.
+	PollInterval time.Duration
+	// HeartbeatInterval is how often to renew the lease while transcoding.
+	// It must be well within the coordinator's lease TTL.
+	HeartbeatInterval time.Duration
+	// PathMap translates the coordinator's paths to the worker's.
+	PathMap []remote.PathMapping
+}
+
+// Validate checks that the configuration is usable.
+func (c WorkerConfig) Validate() error {
+	if err := (remote.ServerConfig{PathMap: c.PathMap}).Validate(); err != nil {
+		return fmt.Errorf("cluster: worker %s", err)
+	}
+	return nil
+}
+
+// LeaseRequest asks the coordinator for a job.
+type LeaseRequest struct {
+	Worker string `json:"worker"`
+}
+
+// LeaseResponse hands a job to a worker. It is the data of the api.Response,
+// which has no data if there is no job to run.
+type LeaseResponse struct {
+	Lease state.Lease `json:"lease"`
+	Job   state.Job   `json:"job"`
+	// TTL is how long the lease lasts without a heartbeat, so a worker that
+	// can't reach the coordinator knows when the job is no longer its own.
+	TTL time.Duration `json:"ttl"`
+}
+
+// HeartbeatRequest renews a lease.
+type HeartbeatRequest struct {
+	Lease    string  `json:"lease"`
+	Progress float64 `json:"progress"`
+}
+
+// ResultRequest reports what became of a leased job and ends the lease.
+type ResultRequest struct {
+	Lease  string       `json:"lease"`
+	Result media.Result `json:"result"`
+}
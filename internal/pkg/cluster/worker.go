@@ -0,0 +1,226 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/api"
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/Xiol/tvhtc2/internal/pkg/remote"
+	log "github.com/sirupsen/logrus"
+)
+
+// A Poster sends requests to the coordinator, as remote.Client does.
+type Poster interface {
+	Post(path string, in, out interface{}) (int, error)
+}
+
+// TranscodeFunc transcodes the recording described by details, reporting
+// its progress, and stops early if cancel is closed.
+type TranscodeFunc func(details media.Details, progress func(float64), cancel <-chan struct{}) media.Result
+
+// Worker leases jobs from a coordinator and transcodes them.
+type Worker struct {
+	cfg       WorkerConfig
+	client    Poster
+	transcode TranscodeFunc
+	closeCh   chan struct{}
+}
+
+// NewWorker returns a Worker that asks for jobs with client and transcodes
+// them with the media configuration returned by config, which is called
+// for every job so configuration changes apply to the next one.
+func NewWorker(cfg WorkerConfig, client Poster, config func() media.Config) *Worker {
+	return &Worker{
+		cfg:       cfg,
+		client:    client,
+		transcode: Transcoder(config),
+		closeCh:   make(chan struct{}),
+	}
+}
+
+// Transcoder returns a TranscodeFunc that transcodes locally.
+func Transcoder(config func() media.Config) TranscodeFunc {
+	return func(details media.Details, progress func(float64), cancel <-chan struct{}) media.Result {
+		e, err := media.NewEntity(details, config())
+		if err != nil {
+			return media.Result{DestPath: details.Path, Error: err.Error()}
+		}
+		e.OnProgress(progress)
+		e.CancelOn(cancel)
+
+		if err := e.Transcode(); err != nil {
+			e.SetError(fmt.Errorf("cluster: error during transcode: %s", err))
+		}
+		return e.Result()
+	}
+}
+
+// Run leases and transcodes jobs one at a time until Close is called.
+func (w *Worker) Run() {
+	interval := w.cfg.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+
+	log.WithField("worker", w.cfg.Name).Info("cluster: worker ready for jobs")
+	for {
+		// Ask again straight away after a job in case there are more
+		if w.poll() {
+			continue
+		}
+		select {
+		case <-w.closeCh:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Close stops the worker once the job it is running, if any, has finished.
+func (w *Worker) Close() {
+	close(w.closeCh)
+}
+
+// poll leases a job and runs it, and reports whether there was one.
+func (w *Worker) poll() bool {
+	select {
+	case <-w.closeCh:
+		return false
+	default:
+	}
+
+	leased := time.Now()
+	var resp api.Response
+	status, err := w.client.Post(LeasePath, LeaseRequest{Worker: w.cfg.Name}, &resp)
+	if err == nil && !resp.OK {
+		err = fmt.Errorf("cluster: coordinator refused lease with status code %d: %s", status, resp.Error)
+	}
+	if err != nil {
+		log.WithError(err).Error("cluster: error asking for a job")
+		return false
+	}
+	if len(resp.Data) == 0 {
+		return false
+	}
+
+	var lease LeaseResponse
+	if err := json.Unmarshal(resp.Data, &lease); err != nil {
+		log.WithError(err).Error("cluster: failed to unmarshal lease")
+		return false
+	}
+	w.run(lease, leased)
+	return true
+}
+
+// run transcodes the leased job, renewing the lease until it is done, and
+// reports the result. The lease was requested at leased.
+func (w *Worker) run(lease LeaseResponse, leased time.Time) {
+	// The coordinator is trusted, so unmapped paths are used as they are
+	details := *lease.Job.Details
+	var err error
+	if details.Path, err = remote.MapPath(w.cfg.PathMap, details.Path); err != nil && err != remote.ErrUnmapped {
+		log.WithError(err).WithField("id", lease.Job.ID).Error("cluster: unable to map the path of the leased job")
+		w.report(lease.Lease.ID, media.Result{Error: err.Error()}, log.Fields{"id": lease.Job.ID})
+		return
+	}
+	fields := log.Fields{
+		"id":    lease.Job.ID,
+		"path":  details.Path,
+		"title": details.Title,
+	}
+	log.WithFields(fields).Info("cluster: running leased job")
+
+	cancel := make(chan struct{})
+	done := make(chan struct{})
+	var mu sync.Mutex
+	var progress float64
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w.heartbeat(lease.Lease.ID, lease.TTL, leased, func() float64 {
+			mu.Lock()
+			defer mu.Unlock()
+			return progress
+		}, cancel, done)
+	}()
+
+	result := w.transcode(details, func(p float64) {
+		mu.Lock()
+		progress = p
+		mu.Unlock()
+	}, cancel)
+	close(done)
+	wg.Wait()
+
+	if result.DestPath != "" {
+		if dest, err := remote.MapPath(remote.Reverse(w.cfg.PathMap), result.DestPath); err == nil || err == remote.ErrUnmapped {
+			result.DestPath = dest
+		}
+	}
+	w.report(lease.Lease.ID, result, fields)
+}
+
+// report sends the result of the leased job to the coordinator.
+func (w *Worker) report(lease string, result media.Result, fields log.Fields) {
+	var resp api.Response
+	status, err := w.client.Post(ResultPath, ResultRequest{Lease: lease, Result: result}, &resp)
+	if err == nil && !resp.OK {
+		err = fmt.Errorf("cluster: coordinator refused result with status code %d: %s", status, resp.Error)
+	}
+	if err != nil {
+		log.WithError(err).WithFields(fields).Error("cluster: failed to report result, the job will run again once the lease expires")
+		return
+	}
+	log.WithFields(fields).WithField("error", result.Error).Info("cluster: reported result")
+}
+
+// heartbeat renews the lease, last renewed at renewed, until done is closed.
+// If the coordinator says the lease is gone, or it can't be renewed within
+// ttl, the job will be given to another worker, so cancel is closed to stop
+// transcoding it here.
+func (w *Worker) heartbeat(lease string, ttl time.Duration, renewed time.Time, progress func() float64, cancel, done chan struct{}) {
+	interval := w.cfg.HeartbeatInterval
+	if interval <= 0 {
+		interval = DefaultHeartbeatInterval
+	}
+	if ttl <= 0 {
+		ttl = DefaultLeaseTTL
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		sent := time.Now()
+		var resp api.Response
+		_, err := w.client.Post(HeartbeatPath, HeartbeatRequest{Lease: lease, Progress: progress()}, &resp)
+		if err != nil {
+			// Give up before the next heartbeat would be too late, so the job
+			// is never running here and on the worker it goes to next
+			if time.Since(renewed)+interval >= ttl {
+				log.WithError(err).WithField("ttl", ttl).Error("cluster: unable to renew lease before it expired, cancelling job")
+				close(cancel)
+				return
+			}
+			// The lease may still be renewed in time if the coordinator comes back
+			log.WithError(err).Warning("cluster: heartbeat failed")
+			continue
+		}
+		if !resp.OK {
+			log.WithField("error", resp.Error).Error("cluster: lease lost, cancelling job")
+			close(cancel)
+			return
+		}
+		renewed = sent
+	}
+}
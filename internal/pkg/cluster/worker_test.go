@@ -0,0 +1,127 @@
+package cluster
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/api"
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/Xiol/tvhtc2/internal/pkg/remote"
+	"github.com/Xiol/tvhtc2/internal/pkg/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCoordinator hands out a single job and records what workers send.
+type fakeCoordinator struct {
+	mu         sync.Mutex
+	job        *state.Job
+	heartbeats []HeartbeatRequest
+	results    []ResultRequest
+	leaseGone  bool
+	down       bool
+	ttl        time.Duration
+}
+
+func (f *fakeCoordinator) Post(path string, in, out interface{}) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	resp := api.Ok(nil)
+	switch path {
+	case LeasePath:
+		if f.job != nil {
+			resp = api.Ok(LeaseResponse{Lease: state.Lease{ID: "lease1", JobID: f.job.ID}, Job: *f.job, TTL: f.ttl})
+			f.job = nil
+		}
+	case HeartbeatPath:
+		if f.down {
+			return 0, assert.AnError
+		}
+		f.heartbeats = append(f.heartbeats, in.(HeartbeatRequest))
+		if f.leaseGone {
+			resp = api.Fail(assert.AnError)
+		}
+	case ResultPath:
+		f.results = append(f.results, in.(ResultRequest))
+	}
+
+	data, _ := json.Marshal(resp)
+	return 200, json.Unmarshal(data, out)
+}
+
+func TestWorker_run(t *testing.T) {
+	coord := &fakeCoordinator{job: &state.Job{ID: "1", Details: &media.Details{Path: "/recordings/Vera.ts", Title: "Vera"}}}
+	w := NewWorker(WorkerConfig{
+		Name:              "worker1",
+		HeartbeatInterval: 10 * time.Millisecond,
+		PathMap:           []remote.PathMapping{{From: "/recordings", To: "/mnt/tv"}},
+	}, coord, nil)
+
+	var transcoded media.Details
+	w.transcode = func(details media.Details, progress func(float64), cancel <-chan struct{}) media.Result {
+		transcoded = details
+		progress(0.5)
+		time.Sleep(50 * time.Millisecond)
+		return media.Result{DestPath: "/mnt/tv/Vera.mkv", TranscodeSuccess: true}
+	}
+
+	assert.True(t, w.poll())
+	assert.False(t, w.poll(), "no more jobs")
+
+	assert.Equal(t, "/mnt/tv/Vera.ts", transcoded.Path, "paths are mapped to the worker's")
+	require.Len(t, coord.results, 1)
+	assert.Equal(t, "lease1", coord.results[0].Lease)
+	assert.Equal(t, "/recordings/Vera.mkv", coord.results[0].Result.DestPath, "and back again")
+	require.NotEmpty(t, coord.heartbeats)
+	assert.Equal(t, 0.5, coord.heartbeats[0].Progress)
+}
+
+func TestWorker_cancelsWhenLeaseLost(t *testing.T) {
+	coord := &fakeCoordinator{
+		job:       &state.Job{ID: "1", Details: &media.Details{Path: "/recordings/Vera.ts"}},
+		leaseGone: true,
+	}
+	w := NewWorker(WorkerConfig{HeartbeatInterval: 10 * time.Millisecond}, coord, nil)
+
+	w.transcode = func(details media.Details, progress func(float64), cancel <-chan struct{}) media.Result {
+		select {
+		case <-cancel:
+			return media.Result{Error: "cancelled"}
+		case <-time.After(5 * time.Second):
+			return media.Result{TranscodeSuccess: true}
+		}
+	}
+
+	start := time.Now()
+	assert.True(t, w.poll())
+	assert.Less(t, time.Since(start), 5*time.Second)
+	require.Len(t, coord.results, 1)
+	assert.Equal(t, "cancelled", coord.results[0].Result.Error)
+}
+
+func TestWorker_cancelsWhenLeaseExpires(t *testing.T) {
+	coord := &fakeCoordinator{
+		job:  &state.Job{ID: "1", Details: &media.Details{Path: "/recordings/Vera.ts"}},
+		down: true,
+		ttl:  50 * time.Millisecond,
+	}
+	w := NewWorker(WorkerConfig{HeartbeatInterval: 10 * time.Millisecond}, coord, nil)
+
+	w.transcode = func(details media.Details, progress func(float64), cancel <-chan struct{}) media.Result {
+		select {
+		case <-cancel:
+			return media.Result{Error: "cancelled"}
+		case <-time.After(5 * time.Second):
+			return media.Result{TranscodeSuccess: true}
+		}
+	}
+
+	start := time.Now()
+	assert.True(t, w.poll())
+	assert.Less(t, time.Since(start), 5*time.Second, "cancelled once the lease would have expired")
+	require.Len(t, coord.results, 1)
+	assert.Equal(t, "cancelled", coord.results[0].Result.Error)
+}
@@ -2,59 +2,135 @@ package config
 
 import (
 	"fmt"
-	"regexp"
+	"io/ioutil"
+	"sync"
 
-	"github.com/Xiol/tvhtc2/internal/pkg/notify"
 	"github.com/fsnotify/fsnotify"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
-func InitConfig() error {
-	viper.SetConfigName("tvhtc2")
+// loadMu serialises reloads of the configuration file.
+var loadMu sync.Mutex
+
+// load reads the configuration at path, or tvhtc2.yml from /etc/tvhtc2/ or
+// the working directory if path is empty. Settings can be overridden by the
+// environment, see EnvPrefix.
+func load(path string) error {
+	bindEnv(viper.GetViper())
 	viper.SetConfigType("yaml")
-	viper.AddConfigPath("/etc/tvhtc2/")
-	viper.AddConfigPath(".")
+	if path != "" {
+		viper.SetConfigFile(path)
+	} else {
+		viper.SetConfigName("tvhtc2")
+		viper.AddConfigPath("/etc/tvhtc2/")
+		viper.AddConfigPath(".")
+	}
 
 	if err := viper.ReadInConfig(); err != nil {
 		return fmt.Errorf("config: error reading config: %s", err)
 	}
 
-	if err := validateRegexps(); err != nil {
-		log.Fatalf(err.Error())
+	// Reread the file so any secrets can be read from their files
+	data, err := ioutil.ReadFile(viper.ConfigFileUsed())
+	if err != nil {
+		return fmt.Errorf("config: error reading config: %s", err)
+	}
+	return readConfig(viper.GetViper(), data)
+}
+
+func InitConfig() error {
+	if err := load(""); err != nil {
+		return err
+	}
+
+	cfg, report := validate(viper.GetViper())
+	report.log()
+	if err := report.Err(); err != nil {
+		return err
 	}
+	publish(cfg)
 
-	viper.WatchConfig()
-	viper.OnConfigChange(func(e fsnotify.Event) {
+	// The file is watched with a viper of its own, as viper reads the changed
+	// file into the instance it is watching before telling us, and settings
+	// must only reach the global instance once they have been validated.
+	path := viper.ConfigFileUsed()
+	watch := viper.New()
+	watch.SetConfigFile(path)
+	watch.SetConfigType("yaml")
+	watch.OnConfigChange(func(e fsnotify.Event) {
 		log.Infof("config: file at '%s' changed", e.Name)
-		if err := validateRegexps(); err != nil {
-			log.Fatalf(err.Error())
-		}
-		log.Info("config: reloaded configuration")
+		reload(path)
 	})
+	watch.WatchConfig()
 
 	return nil
 }
 
-func validateRegexps() error {
-	log.Debug("config: validating regexps...")
+// InitClient reads the configuration for the client. Only the settings the
+// client uses are checked, as it runs as the user TVHeadend runs as, who
+// can't necessarily read everything the daemon can. The Config returned is
+// usable even with an error, so a recording can still be spooled.
+func InitClient() (*Config, error) {
+	return loadClient("")
+}
+
+func loadClient(path string) (*Config, error) {
+	err := load(path)
 
-	var nconf []notify.Config
-	if err := viper.UnmarshalKey("notifications.pushover", &nconf); err != nil {
-		return fmt.Errorf("config: error unmarshalling Pushover notification config: %s", err)
+	// The problems build finds are with settings only the daemon uses
+	cfg, _ := build(viper.GetViper())
+	current.Store(cfg)
+	if err != nil {
+		return cfg, err
 	}
 
-	count := 0
-	for _, conf := range nconf {
-		for _, rgx := range conf.Notify {
-			_, err := regexp.Compile(rgx)
-			if err != nil {
-				return fmt.Errorf("config: regex '%s' for user '%s' did not compile, please check config: %s", rgx, conf.Name, err)
-			}
-			count++
-		}
+	var r Report
+	validateClient(&r, viper.GetViper(), cfg)
+	return cfg, r.Err()
+}
+
+// Check reads the configuration at path, or from the usual locations if path
+// is empty, and validates it. It returns the file that was checked.
+func Check(path string) (string, Report, error) {
+	if err := load(path); err != nil {
+		return path, Report{}, err
 	}
+	return viper.ConfigFileUsed(), Validate(), nil
+}
 
-	log.Debugf("config: regex validation ok, count %d", count)
-	return nil
+// reload validates the configuration at path and uses it if it is valid.
+// It is read into a viper of its own to be validated, so nothing ever sees
+// the settings of a configuration that is rejected, and a mistake in the
+// file never takes down a running daemon.
+func reload(path string) {
+	loadMu.Lock()
+	defer loadMu.Unlock()
+
+	candidate := viper.New()
+	bindEnv(candidate)
+	candidate.SetConfigType("yaml")
+
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = readConfig(candidate, data)
+	}
+	if err != nil {
+		log.WithError(err).Error("config: unable to read changed config, keeping the last good configuration")
+		return
+	}
+
+	cfg, report := validate(candidate)
+	report.log()
+	if err := report.Err(); err != nil {
+		log.WithError(err).Error("config: changed config is invalid, keeping the last good configuration")
+		return
+	}
+
+	if err := readConfig(viper.GetViper(), data); err != nil {
+		log.WithError(err).Error("config: unable to use changed config, keeping the last good configuration")
+		return
+	}
+	publish(cfg)
+	log.Info("config: reloaded configuration")
 }
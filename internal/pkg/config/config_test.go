@@ -0,0 +1,191 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/scheduler"
+	"github.com/Xiol/tvhtc2/internal/pkg/spool"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, path, dir, extra string) {
+	cfg := fmt.Sprintf(`state_path: %[1]s/state.json
+socket_path: %[1]s/tvhtc2.socket
+transcoding:
+  audio_config: -c:a libmp3lame -q:a 3
+  video_config: -vf yadif=1 -c:v libx264 -crf 21
+notifications:
+  pushover:
+    - name: foo
+      default: true
+      key: userkey
+pushover:
+  app_token: apptoken
+%s`, dir, extra)
+	require.NoError(t, ioutil.WriteFile(path, []byte(cfg), 0644))
+}
+
+func TestCheck(t *testing.T) {
+	defer viper.Reset()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tvhtc2.yml")
+
+	writeConfig(t, path, dir, "")
+	_, report, err := Check(path)
+	require.NoError(t, err)
+	assert.Empty(t, report.Errors)
+	assert.Empty(t, report.Warnings)
+
+	writeConfig(t, path, dir, `colour: blue
+rename:
+  rules:
+    - old: "("
+      new: x
+scheduling:
+  policy: random
+  windows: ["25:00-26:00"]
+`)
+	_, report, err = Check(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"config: unknown setting 'colour' will be ignored"}, report.Warnings)
+	assert.Len(t, report.Errors, 3)
+	assert.Error(t, report.Err())
+}
+
+func TestCheck_errors(t *testing.T) {
+	defer viper.Reset()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tvhtc2.yml")
+
+	tests := map[string]string{
+		"duration":     "transcoding:\n  timeout:\n    stall: 5\n",
+		"int":          "transcoding:\n  max_attempts: lots\n",
+		"ffmpeg":       "transcoding:\n  video_config: -i foo  -c:v libx264\n",
+		"resources":    "transcoding:\n  resources:\n    ionice_class: 9\n",
+		"recipient":    "notifications:\n  ntfy:\n    - name: foo\n",
+		"template":     "notifications:\n  templates:\n    default:\n      success:\n        subject: \"{{ .Nope\"\n",
+		"quiet":        "notifications:\n  gotify:\n    - name: foo\n      server: http://gotify\n      token: t\n      quiet_hours: always\n",
+		"directory":    "history:\n  path: /nonexistent/history.json\n",
+		"recording":    "scheduling:\n  pause_while_recording:\n    enabled: true\n",
+		"two defaults": "notifications:\n  ntfy:\n    - {name: a, topic: a, default: true}\n    - {name: b, topic: b, default: true}\n",
+	}
+	for name, extra := range tests {
+		t.Run(name, func(t *testing.T) {
+			viper.Reset()
+			// Later keys replace earlier ones, so merge rather than repeat sections
+			writeConfig(t, path, dir, "")
+			err := load(path)
+			require.NoError(t, err)
+			require.NoError(t, viper.MergeConfig(strings.NewReader(extra)))
+
+			report := Validate()
+			assert.NotEmpty(t, report.Errors, "%s", extra)
+		})
+	}
+}
+
+func TestReload_keepsLastGood(t *testing.T) {
+	defer viper.Reset()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tvhtc2.yml")
+
+	writeConfig(t, path, dir, "scheduling:\n  policy: fifo\n")
+	err := load(path)
+	require.NoError(t, err)
+
+	writeConfig(t, path, dir, "scheduling:\n  policy: random\n")
+	reload(path)
+	assert.Equal(t, "fifo", viper.GetString("scheduling.policy"), "invalid config is rejected")
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("state_path: [unclosed"), 0644))
+	reload(path)
+	assert.Equal(t, "fifo", viper.GetString("scheduling.policy"), "unparseable config is rejected")
+
+	writeConfig(t, path, dir, "scheduling:\n  policy: shortest\n")
+	reload(path)
+	assert.Equal(t, "shortest", viper.GetString("scheduling.policy"), "valid config is used")
+	assert.Equal(t, scheduler.PolicyShortest, Current().Scheduling.Policy)
+}
+
+func TestReload_publishesSnapshot(t *testing.T) {
+	defer viper.Reset()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tvhtc2.yml")
+
+	var reloaded *Config
+	OnReload(func(c *Config) { reloaded = c })
+
+	writeConfig(t, path, dir, "rename:\n  enabled: false\n")
+	err := load(path)
+	require.NoError(t, err)
+	before := Current()
+
+	writeConfig(t, path, dir, "rename:\n  enabled: true\n  rules:\n    - old: foo\n      new: bar\n")
+	reload(path)
+	require.NotNil(t, reloaded)
+	assert.Same(t, reloaded, Current())
+
+	c := Current()
+	assert.True(t, c.Media.Rename)
+	require.Len(t, c.Media.Renamer.Rules, 1)
+	assert.Equal(t, "bar", c.Media.Renamer.Rules[0].New)
+	assert.Equal(t, "-vf yadif=1 -c:v libx264 -crf 21", c.Media.VideoArgs)
+	assert.Equal(t, c.Media.FFmpeg, c.Notify.FFmpeg)
+	assert.Equal(t, filepath.Join(dir, "outbox.json"), c.Notify.Outbox.Path)
+	assert.Equal(t, filepath.Join(dir, "history.json"), c.History.Path)
+	assert.Equal(t, "apptoken", c.Notify.Backends["pushover"]["app_token"])
+	require.Len(t, c.Notify.Recipients["pushover"], 1)
+	assert.Equal(t, "userkey", c.Notify.Recipients["pushover"][0].Key)
+
+	// Snapshots taken earlier are unaffected
+	assert.False(t, before.Media.Rename)
+}
+
+func TestCheck_sample(t *testing.T) {
+	defer viper.Reset()
+
+	_, report, err := Check("../../../tvhtc2.yml")
+	require.NoError(t, err)
+	assert.Empty(t, report.Warnings)
+	for _, e := range report.Errors {
+		// The sample's paths don't exist here
+		assert.Contains(t, e, "does not exist")
+	}
+}
+
+func TestLoadClient(t *testing.T) {
+	defer viper.Reset()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tvhtc2.yml")
+
+	// The daemon's files needn't exist, or be readable, for the client
+	writeConfig(t, path, dir, `history:
+  path: /nonexistent/history.json
+remote:
+  listen:
+    enabled: true
+    address: ":8443"
+    cert_file: /nonexistent/cert.pem
+    key_file: /nonexistent/key.pem
+    token: secret
+`)
+	c, err := loadClient(path)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "spool"), c.Spool.Path)
+	assert.NotEmpty(t, Validate().Errors, "the daemon would refuse it")
+
+	writeConfig(t, path, dir, "remote:\n  client:\n    url: http://tvhtc2.example.com\n")
+	_, err = loadClient(path)
+	assert.Error(t, err)
+
+	viper.Reset()
+	c, err = loadClient(filepath.Join(dir, "missing.yml"))
+	assert.Error(t, err)
+	assert.Equal(t, spool.DefaultPath, c.Spool.Path, "there is always somewhere to spool")
+}
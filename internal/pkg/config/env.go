@@ -0,0 +1,192 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix prefixes the environment variables that override settings. The
+// variable for a setting is its key in upper case with dots replaced by
+// underscores, so pushover.app_token is TVHTC2_PUSHOVER_APP_TOKEN.
+const EnvPrefix = "TVHTC2"
+
+// fileSuffix marks a secret whose value is read from a file, such as
+// key_file in place of key. Only the keys in secrets can be read this way.
+const fileSuffix = "_file"
+
+// bindEnv lets environment variables override any setting in the schema.
+func bindEnv(v *viper.Viper) {
+	v.SetEnvPrefix(EnvPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+
+	// Binding every key makes overrides of settings that aren't in the file
+	// visible to AllKeys and UnmarshalKey, not just Get.
+	for _, key := range envKeys() {
+		v.BindEnv(key)
+	}
+}
+
+// envKeys returns the keys in the schema that can be set from the
+// environment, which is every key without a wildcard.
+func envKeys() []string {
+	var keys []string
+	for key := range schema {
+		if !strings.Contains(key, "*") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// envName returns the environment variable that overrides key.
+func envName(key string) string {
+	return EnvPrefix + "_" + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+// readConfig loads data into v once any secrets have been read from their
+// files.
+func readConfig(v *viper.Viper, data []byte) error {
+	data, err := expandSecrets(data)
+	if err != nil {
+		return err
+	}
+	if err := v.ReadConfig(bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("config: error parsing config: %s", err)
+	}
+	return nil
+}
+
+// expandSecrets replaces every <key>_file setting in the YAML in data, where
+// <key> is one of the secrets, with <key> set to the contents of the file, so
+// secrets such as the Pushover app token and user keys can be kept out of the
+// configuration. A secret can also be read from the file named by the
+// environment variable for the key with _FILE appended, as used with Docker
+// secrets.
+func expandSecrets(data []byte) ([]byte, error) {
+	var m map[string]interface{}
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("config: error parsing config: %s", err)
+	}
+	if m == nil {
+		m = make(map[string]interface{})
+	}
+
+	changed := false
+	for _, key := range envKeys() {
+		if !isSecret(key) {
+			continue
+		}
+		path, ok := os.LookupEnv(envName(key) + "_FILE")
+		if !ok || path == "" {
+			continue
+		}
+		secret, err := readSecret(path)
+		if err != nil {
+			return nil, fmt.Errorf("config: %s_FILE: %s", envName(key), err)
+		}
+		setPath(m, strings.Split(key, "."), secret)
+		changed = true
+	}
+
+	expanded, err := expandFiles(m, "", "")
+	if err != nil {
+		return nil, err
+	}
+	if !changed && !expanded {
+		return data, nil
+	}
+	return yaml.Marshal(m)
+}
+
+// expandFiles replaces the <key>_file settings of secrets within v, which is
+// below prefix, and reports whether there were any. pattern is prefix with
+// list indexes replaced by *, to match against the secrets. Empty paths are
+// dropped, so the sample configuration can list them unset.
+func expandFiles(v interface{}, prefix, pattern string) (bool, error) {
+	expanded := false
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			name := strings.TrimPrefix(prefix+"."+key, ".")
+			target := strings.TrimSuffix(key, fileSuffix)
+			if !strings.HasSuffix(key, fileSuffix) || !isSecret(strings.TrimPrefix(pattern+"."+target, ".")) {
+				ok, err := expandFiles(v[key], name, strings.TrimPrefix(pattern+"."+key, "."))
+				if err != nil {
+					return false, err
+				}
+				expanded = expanded || ok
+				continue
+			}
+
+			path, ok := v[key].(string)
+			if !ok && v[key] != nil {
+				return false, fmt.Errorf("config: %s must be the path to a file", name)
+			}
+			delete(v, key)
+			expanded = true
+			if path == "" {
+				continue
+			}
+			if _, ok := v[target]; ok {
+				return false, fmt.Errorf("config: only one of %s and %s may be set", strings.TrimSuffix(name, fileSuffix), name)
+			}
+			secret, err := readSecret(path)
+			if err != nil {
+				return false, fmt.Errorf("config: %s: %s", name, err)
+			}
+			v[target] = secret
+		}
+	case []interface{}:
+		for i := range v {
+			ok, err := expandFiles(v[i], fmt.Sprintf("%s[%d]", prefix, i), pattern+".*")
+			if err != nil {
+				return false, err
+			}
+			expanded = expanded || ok
+		}
+	}
+	return expanded, nil
+}
+
+// readSecret returns the contents of the file at path without the trailing
+// newline. Relative paths are relative to $CREDENTIALS_DIRECTORY if set, so
+// systemd credentials can be referred to by name.
+func readSecret(path string) (string, error) {
+	if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading secret: %s", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// setPath sets the value at the nested keys in m, creating maps as needed.
+func setPath(m map[string]interface{}, keys []string, value interface{}) {
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := m[key].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			m[key] = next
+		}
+		m = next
+	}
+	m[keys[len(keys)-1]] = value
+}
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestLoad_environment(t *testing.T) {
+	defer viper.Reset()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tvhtc2.yml")
+	writeConfig(t, path, dir, "")
+
+	t.Setenv("TVHTC2_PUSHOVER_APP_TOKEN", "envtoken")
+	t.Setenv("TVHTC2_TRANSCODING_MAX_ATTEMPTS", "7")
+
+	err := load(path)
+	require.NoError(t, err)
+
+	c, err := build(viper.GetViper())
+	require.NoError(t, err)
+	assert.Equal(t, "envtoken", c.Notify.Backends["pushover"]["app_token"])
+	assert.Equal(t, 7, c.MaxAttempts)
+	assert.Empty(t, Validate().Errors)
+}
+
+func TestLoad_secretFiles(t *testing.T) {
+	defer viper.Reset()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tvhtc2.yml")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "userkey"), []byte("filekey\n"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "token"), []byte("filetoken\n"), 0600))
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`state_path: `+dir+`/state.json
+socket_path: `+dir+`/tvhtc2.socket
+notifications:
+  pushover:
+    - name: foo
+      default: true
+      key_file: userkey
+`), 0644))
+	t.Setenv("CREDENTIALS_DIRECTORY", dir)
+	t.Setenv("TVHTC2_PUSHOVER_APP_TOKEN_FILE", filepath.Join(dir, "token"))
+
+	err := load(path)
+	require.NoError(t, err)
+
+	c, err := build(viper.GetViper())
+	require.NoError(t, err)
+	require.Len(t, c.Notify.Recipients["pushover"], 1)
+	assert.Equal(t, "filekey", c.Notify.Recipients["pushover"][0].Key)
+	assert.Equal(t, "filetoken", c.Notify.Backends["pushover"]["app_token"])
+	assert.Empty(t, Validate().Warnings, "key_file isn't left behind as an unknown setting")
+}
+
+func TestExpandSecrets_errors(t *testing.T) {
+	tests := map[string]string{
+		"missing": "pushover:\n  app_token_file: /nonexistent/token\n",
+		"both":    "pushover:\n  app_token: a\n  app_token_file: /dev/null\n",
+		"type":    "pushover:\n  app_token_file: [a, b]\n",
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := expandSecrets([]byte(data))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestExpandSecrets_onlySecrets(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "token"), []byte("filetoken\n"), 0600))
+
+	data, err := expandSecrets([]byte(`remote:
+  listen:
+    cert_file: /etc/tvhtc2/server.crt
+    token_file: ` + dir + `/token
+  client:
+    ca_file: ""
+    token_file: ""
+tvheadend:
+  password_file: ""
+`))
+	require.NoError(t, err)
+
+	var m map[string]interface{}
+	require.NoError(t, yaml.Unmarshal(data, &m))
+	listen := m["remote"].(map[string]interface{})["listen"].(map[string]interface{})
+	assert.Equal(t, "/etc/tvhtc2/server.crt", listen["cert_file"], "paths aren't secrets")
+	assert.Equal(t, "filetoken", listen["token"])
+
+	client := m["remote"].(map[string]interface{})["client"].(map[string]interface{})
+	assert.Equal(t, "", client["ca_file"])
+	assert.NotContains(t, client, "token", "empty secret files are skipped")
+	assert.NotContains(t, client, "token_file")
+	assert.NotContains(t, m["tvheadend"], "password")
+}
@@ -0,0 +1,369 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/cluster"
+	"github.com/Xiol/tvhtc2/internal/pkg/ffmpeg"
+	"github.com/Xiol/tvhtc2/internal/pkg/history"
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/Xiol/tvhtc2/internal/pkg/notify"
+	"github.com/Xiol/tvhtc2/internal/pkg/reconcile"
+	"github.com/Xiol/tvhtc2/internal/pkg/remote"
+	"github.com/Xiol/tvhtc2/internal/pkg/renamer"
+	"github.com/Xiol/tvhtc2/internal/pkg/scheduler"
+	"github.com/Xiol/tvhtc2/internal/pkg/spool"
+	"github.com/Xiol/tvhtc2/internal/pkg/tvheadend"
+	"github.com/Xiol/tvhtc2/internal/pkg/watcher"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Config is a snapshot of the configuration. It is never modified once
+// built, a reload builds a new one, so a job can take a snapshot when it
+// starts and behave consistently until it finishes.
+type Config struct {
+	StatePath  string
+	SocketPath string
+	// MaxAttempts is how many times a job is tried before it is quarantined.
+	MaxAttempts int
+
+	Media      media.Config
+	Scheduling scheduler.Config
+	History    history.Config
+	Notify     notify.Settings
+	Watch      watcher.Config
+	Reconcile  reconcile.Config
+	TVHeadend  tvheadend.Config
+	Spool      spool.Config
+	// Remote is the daemon's TCP listener, RemoteClient is how the client
+	// reaches a daemon on another machine.
+	Remote       remote.ServerConfig
+	RemoteClient remote.ClientConfig
+	// Cluster hands jobs to remote workers, Worker is how this machine
+	// runs as one.
+	Cluster cluster.CoordinatorConfig
+	Worker  cluster.WorkerConfig
+}
+
+var (
+	current atomic.Value
+
+	reloadMu    sync.Mutex
+	reloadFuncs []func(*Config)
+)
+
+// Current returns the last configuration that validated. If none has been
+// loaded yet, one is built from whatever settings are present.
+func Current() *Config {
+	if c, ok := current.Load().(*Config); ok {
+		return c
+	}
+
+	c, err := build(viper.GetViper())
+	if err != nil {
+		log.WithError(err).Error("config: unable to build configuration")
+	}
+	return c
+}
+
+// OnReload registers fn to be called with the new configuration whenever a
+// changed configuration file has been validated and taken into use.
+func OnReload(fn func(*Config)) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	reloadFuncs = append(reloadFuncs, fn)
+}
+
+// publish makes c the current configuration and tells everyone interested.
+func publish(c *Config) {
+	current.Store(c)
+
+	reloadMu.Lock()
+	funcs := append(([]func(*Config))(nil), reloadFuncs...)
+	reloadMu.Unlock()
+
+	for _, fn := range funcs {
+		fn(c)
+	}
+}
+
+// build creates a Config from the settings loaded into v. It always
+// returns a usable Config, the error lists the settings that couldn't be
+// read and were left empty.
+func build(v *viper.Viper) (*Config, error) {
+	c := &Config{
+		StatePath:   v.GetString("state_path"),
+		SocketPath:  v.GetString("socket_path"),
+		MaxAttempts: v.GetInt("transcoding.max_attempts"),
+	}
+
+	var err error
+	opts := ffmpegOptions(v)
+
+	c.Media = media.Config{
+		KeepOriginals: v.GetBool("transcoding.keep_originals"),
+		OnlySD:        v.GetBool("transcoding.only_sd"),
+		VideoArgs:     v.GetString("transcoding.video_config"),
+		AudioArgs:     v.GetString("transcoding.audio_config"),
+		Rename:        v.GetBool("rename.enabled"),
+		Renamer: renamer.Config{
+			FixTimestamps: v.GetBool("rename.fix_timestamps"),
+			FixSpacing:    v.GetBool("rename.fix_spacing"),
+			RemoveNew:     v.GetBool("rename.remove_new"),
+		},
+		FFmpeg: opts,
+		Timeouts: ffmpeg.Timeouts{
+			VideoFactor: v.GetFloat64("transcoding.timeout.video_factor"),
+			AudioFactor: v.GetFloat64("transcoding.timeout.audio_factor"),
+			Minimum:     v.GetDuration("transcoding.timeout.minimum"),
+		},
+		RateControl: ffmpeg.RateControl{
+			Mode:            v.GetString("transcoding.rate_control.mode"),
+			VideoBitrate:    v.GetString("transcoding.rate_control.video_bitrate"),
+			TargetSize:      v.GetString("transcoding.rate_control.target_size"),
+			AudioBitrate:    v.GetString("transcoding.rate_control.audio_bitrate"),
+			MinVideoBitrate: v.GetString("transcoding.rate_control.min_video_bitrate"),
+		},
+		Decisions: media.Decisions{
+			Enabled:           v.GetBool("transcoding.decisions.enabled"),
+			Deinterlace:       v.GetString("transcoding.decisions.deinterlace"),
+			DeinterlaceFilter: v.GetString("transcoding.decisions.deinterlace_filter"),
+			MaxHeight:         v.GetInt("transcoding.decisions.max_height"),
+			MaxFrameRate:      v.GetFloat64("transcoding.decisions.max_frame_rate"),
+			SkipCodecs:        v.GetStringSlice("transcoding.decisions.skip_codecs"),
+			SkipBelowBitrate:  v.GetString("transcoding.decisions.skip_below_bitrate"),
+		},
+	}
+	if uerr := v.UnmarshalKey("rename.rules", &c.Media.Renamer.Rules); uerr != nil {
+		err = fmt.Errorf("config: rename.rules: %s", uerr)
+	}
+
+	c.Scheduling = scheduler.Config{
+		Policy:  scheduler.Policy(strings.ToLower(v.GetString("scheduling.policy"))),
+		Windows: v.GetStringSlice("scheduling.windows"),
+		PauseWhileRecording: scheduler.RecordingConfig{
+			Enabled:  v.GetBool("scheduling.pause_while_recording.enabled"),
+			URL:      v.GetString("scheduling.pause_while_recording.url"),
+			Interval: v.GetDuration("scheduling.pause_while_recording.interval"),
+			Username: v.GetString("scheduling.pause_while_recording.username"),
+			Password: v.GetString("scheduling.pause_while_recording.password"),
+		},
+	}
+	if uerr := v.UnmarshalKey("scheduling.rules", &c.Scheduling.Rules); uerr != nil && err == nil {
+		err = fmt.Errorf("config: scheduling.rules: %s", uerr)
+	}
+
+	c.History = history.Config{
+		Path:      v.GetString("history.path"),
+		Retention: v.GetDuration("history.retention"),
+	}
+	if c.History.Path == "" {
+		c.History.Path = filepath.Join(filepath.Dir(c.StatePath), "history.json")
+	}
+
+	c.Watch = watcher.Config{
+		Enabled:     v.GetBool("watch.enabled"),
+		Directories: v.GetStringSlice("watch.directories"),
+		Recursive:   v.GetBool("watch.recursive"),
+		Include:     v.GetStringSlice("watch.include"),
+		Exclude:     v.GetStringSlice("watch.exclude"),
+		StableFor:   v.GetDuration("watch.stable_for"),
+		Interval:    v.GetDuration("watch.interval"),
+	}
+
+	// Reconcile the watched directories, with the same globs, unless told otherwise
+	c.Reconcile = reconcile.Config{
+		OnStartup:     v.GetBool("reconcile.on_startup"),
+		Directories:   v.GetStringSlice("reconcile.directories"),
+		Include:       v.GetStringSlice("reconcile.include"),
+		Exclude:       v.GetStringSlice("reconcile.exclude"),
+		Enqueue:       v.GetBool("reconcile.enqueue"),
+		TmpfileMinAge: v.GetDuration("reconcile.tmpfile_min_age"),
+	}
+	if len(c.Reconcile.Directories) == 0 {
+		c.Reconcile.Directories = c.Watch.Directories
+	}
+	if !v.IsSet("reconcile.include") && !v.IsSet("reconcile.exclude") {
+		c.Reconcile.Include, c.Reconcile.Exclude = c.Watch.Include, c.Watch.Exclude
+	}
+
+	c.Spool = spool.Config{
+		Path:     v.GetString("spool.path"),
+		Interval: v.GetDuration("spool.interval"),
+	}
+	if c.Spool.Path == "" && c.StatePath != "" {
+		c.Spool.Path = filepath.Join(filepath.Dir(c.StatePath), "spool")
+	}
+	if c.Spool.Path == "" {
+		c.Spool.Path = spool.DefaultPath
+	}
+
+	c.Remote = remote.ServerConfig{
+		Enabled:      v.GetBool("remote.listen.enabled"),
+		Address:      v.GetString("remote.listen.address"),
+		CertFile:     v.GetString("remote.listen.cert_file"),
+		KeyFile:      v.GetString("remote.listen.key_file"),
+		ClientCAFile: v.GetString("remote.listen.client_ca_file"),
+		Token:        v.GetString("remote.listen.token"),
+	}
+	if uerr := v.UnmarshalKey("remote.listen.path_map", &c.Remote.PathMap); uerr != nil && err == nil {
+		err = fmt.Errorf("config: remote.listen.path_map: %s", uerr)
+	}
+	c.RemoteClient = remote.ClientConfig{
+		URL:      v.GetString("remote.client.url"),
+		Token:    v.GetString("remote.client.token"),
+		CAFile:   v.GetString("remote.client.ca_file"),
+		CertFile: v.GetString("remote.client.cert_file"),
+		KeyFile:  v.GetString("remote.client.key_file"),
+		Timeout:  v.GetDuration("remote.client.timeout"),
+	}
+
+	c.Cluster = cluster.CoordinatorConfig{
+		Enabled:    v.GetBool("cluster.coordinator.enabled"),
+		LeaseTTL:   v.GetDuration("cluster.coordinator.lease_ttl"),
+		RemoteOnly: v.GetBool("cluster.coordinator.remote_only"),
+	}
+	c.Worker = cluster.WorkerConfig{
+		Name:              v.GetString("cluster.worker.name"),
+		PollInterval:      v.GetDuration("cluster.worker.poll_interval"),
+		HeartbeatInterval: v.GetDuration("cluster.worker.heartbeat_interval"),
+	}
+	if c.Worker.Name == "" {
+		c.Worker.Name, _ = os.Hostname()
+	}
+	if uerr := v.UnmarshalKey("cluster.worker.path_map", &c.Worker.PathMap); uerr != nil && err == nil {
+		err = fmt.Errorf("config: cluster.worker.path_map: %s", uerr)
+	}
+
+	c.TVHeadend = tvheadend.Config{
+		Enabled:  v.GetBool("tvheadend.enabled"),
+		URL:      v.GetString("tvheadend.url"),
+		Username: v.GetString("tvheadend.username"),
+		Password: v.GetString("tvheadend.password"),
+		Timeout:  v.GetDuration("tvheadend.timeout"),
+	}
+
+	var nerr error
+	c.Notify, nerr = notifySettings(v, c.StatePath, opts)
+	if err == nil {
+		err = nerr
+	}
+	return c, err
+}
+
+// ffmpegOptions reads the resource options from transcoding.resources and
+// the stall timeout from transcoding.timeout. The overall timeout depends on
+// the media, see ffmpeg.Timeouts.
+func ffmpegOptions(v *viper.Viper) ffmpeg.Options {
+	return ffmpeg.Options{
+		Nice:    v.GetInt("transcoding.resources.nice"),
+		IOClass: v.GetInt("transcoding.resources.ionice_class"),
+		IOLevel: v.GetInt("transcoding.resources.ionice_level"),
+		Threads: v.GetInt("transcoding.resources.threads"),
+
+		StallTimeout: v.GetDuration("transcoding.timeout.stall"),
+		Cgroup: ffmpeg.CgroupOptions{
+			Parent:      v.GetString("transcoding.resources.cgroup.parent"),
+			CPULimit:    v.GetFloat64("transcoding.resources.cgroup.cpu_limit"),
+			MemoryLimit: v.GetString("transcoding.resources.cgroup.memory_limit"),
+		},
+		LoadPause: ffmpeg.LoadPauseOptions{
+			Above:       v.GetFloat64("transcoding.resources.load_pause.above"),
+			ResumeBelow: v.GetFloat64("transcoding.resources.load_pause.resume_below"),
+			Interval:    v.GetDuration("transcoding.resources.load_pause.interval"),
+		},
+	}
+}
+
+// notificationSettings are the keys under notifications that aren't
+// recipients of a backend.
+var notificationSettings = []string{"outbox", "digest", "http", "templates"}
+
+func notifySettings(v *viper.Viper, statePath string, opts ffmpeg.Options) (notify.Settings, error) {
+	s := notify.Settings{
+		Recipients: make(map[string][]notify.Config),
+		Backends:   make(map[string]map[string]interface{}),
+		Templates:  make(map[string]map[notify.Outcome]notify.Template),
+		Outbox: notify.OutboxSettings{
+			Path:           v.GetString("notifications.outbox.path"),
+			RetryInterval:  v.GetDuration("notifications.outbox.retry_interval"),
+			InitialBackoff: v.GetDuration("notifications.outbox.initial_backoff"),
+			MaxBackoff:     v.GetDuration("notifications.outbox.max_backoff"),
+			MaxAge:         v.GetDuration("notifications.outbox.max_age"),
+			DedupWindow:    v.GetDuration("notifications.outbox.dedup_window"),
+		},
+		Digest: notify.DigestSettings{
+			Time:     v.GetString("notifications.digest.time"),
+			Day:      v.GetString("notifications.digest.day"),
+			Interval: v.GetDuration("notifications.digest.interval"),
+		},
+		FFmpeg: opts,
+	}
+	s.HTTP.Timeout = v.GetDuration("notifications.http.timeout")
+	s.HTTP.Proxy = v.GetString("notifications.http.proxy")
+
+	if s.Outbox.Path == "" {
+		s.Outbox.Path = filepath.Join(filepath.Dir(statePath), "outbox.json")
+	}
+
+	var err error
+	backends := notify.Backends()
+	for key := range v.GetStringMap("notifications") {
+		if contains(notificationSettings, key) {
+			continue
+		}
+		var nconf []notify.Config
+		if uerr := v.UnmarshalKey("notifications."+key, &nconf); uerr != nil && err == nil {
+			err = fmt.Errorf("config: error reading %s notification config: %s", key, uerr)
+		}
+		s.Recipients[key] = nconf
+		if !contains(backends, key) {
+			backends = append(backends, key)
+		}
+	}
+
+	for _, backend := range backends {
+		shared := make(map[string]interface{})
+		for key, val := range v.GetStringMap(backend) {
+			shared[key] = val
+		}
+		// GetStringMap only sees the file, Get sees environment overrides
+		for _, key := range notify.BackendOptions(backend) {
+			if val := v.Get(backend + "." + key); val != nil {
+				shared[key] = val
+			}
+		}
+		if len(shared) > 0 {
+			s.Backends[backend] = shared
+		}
+	}
+
+	for scope := range v.GetStringMap("notifications.templates") {
+		templates := make(map[notify.Outcome]notify.Template)
+		for outcome := range v.GetStringMap("notifications.templates." + scope) {
+			key := fmt.Sprintf("notifications.templates.%s.%s.", scope, outcome)
+			templates[notify.Outcome(outcome)] = notify.Template{
+				Subject: v.GetString(key + "subject"),
+				Body:    v.GetString(key + "body"),
+			}
+		}
+		s.Templates[scope] = templates
+	}
+
+	return s, err
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
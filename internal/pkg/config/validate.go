@@ -0,0 +1,523 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/ffmpeg"
+	"github.com/Xiol/tvhtc2/internal/pkg/notify"
+	"github.com/Xiol/tvhtc2/internal/pkg/scheduler"
+	"github.com/Xiol/tvhtc2/internal/pkg/timewindow"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// A Report lists the problems found in the configuration. Errors make the
+// configuration unusable, warnings are worth fixing but harmless.
+type Report struct {
+	Errors   []string
+	Warnings []string
+}
+
+func (r *Report) errorf(format string, args ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+func (r *Report) warnf(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Err returns an error summarising the errors in the report, or nil if
+// there are none.
+func (r Report) Err() error {
+	if len(r.Errors) == 0 {
+		return nil
+	}
+	return fmt.Errorf("config: %d problems found, please check config: %s", len(r.Errors), strings.Join(r.Errors, "; "))
+}
+
+func (r Report) log() {
+	for _, w := range r.Warnings {
+		log.Warning(w)
+	}
+	for _, e := range r.Errors {
+		log.Error(e)
+	}
+}
+
+type kind int
+
+const (
+	kindAny kind = iota
+	kindString
+	kindBool
+	kindInt
+	kindFloat
+	kindDuration
+	kindList
+)
+
+// schema maps every known key to the kind of value it holds. A * matches
+// any single key segment.
+var schema = map[string]kind{
+	"state_path":  kindString,
+	"socket_path": kindString,
+
+	"history.path":      kindString,
+	"history.retention": kindDuration,
+
+	"transcoding.keep_originals":                    kindBool,
+	"transcoding.only_sd":                           kindBool,
+	"transcoding.trim_path":                         kindString,
+	"transcoding.audio_config":                      kindString,
+	"transcoding.video_config":                      kindString,
+	"transcoding.skip_rename":                       kindBool,
+	"transcoding.max_attempts":                      kindInt,
+	"transcoding.timeout.video_factor":              kindFloat,
+	"transcoding.timeout.audio_factor":              kindFloat,
+	"transcoding.timeout.minimum":                   kindDuration,
+	"transcoding.timeout.stall":                     kindDuration,
+	"transcoding.rate_control.mode":                 kindString,
+	"transcoding.rate_control.video_bitrate":        kindString,
+	"transcoding.rate_control.target_size":          kindString,
+	"transcoding.rate_control.audio_bitrate":        kindString,
+	"transcoding.rate_control.min_video_bitrate":    kindString,
+	"transcoding.decisions.enabled":                 kindBool,
+	"transcoding.decisions.deinterlace":             kindString,
+	"transcoding.decisions.deinterlace_filter":      kindString,
+	"transcoding.decisions.max_height":              kindInt,
+	"transcoding.decisions.max_frame_rate":          kindFloat,
+	"transcoding.decisions.skip_codecs":             kindList,
+	"transcoding.decisions.skip_below_bitrate":      kindString,
+	"transcoding.resources.nice":                    kindInt,
+	"transcoding.resources.ionice_class":            kindInt,
+	"transcoding.resources.ionice_level":            kindInt,
+	"transcoding.resources.threads":                 kindInt,
+	"transcoding.resources.cgroup.parent":           kindString,
+	"transcoding.resources.cgroup.cpu_limit":        kindFloat,
+	"transcoding.resources.cgroup.memory_limit":     kindString,
+	"transcoding.resources.load_pause.above":        kindFloat,
+	"transcoding.resources.load_pause.resume_below": kindFloat,
+	"transcoding.resources.load_pause.interval":     kindDuration,
+	"scheduling.policy":                             kindString,
+	"scheduling.rules":                              kindList,
+	"scheduling.windows":                            kindList,
+	"scheduling.pause_while_recording.enabled":      kindBool,
+	"scheduling.pause_while_recording.url":          kindString,
+	"scheduling.pause_while_recording.interval":     kindDuration,
+	"scheduling.pause_while_recording.username":     kindString,
+	"scheduling.pause_while_recording.password":     kindString,
+	"notifications.outbox.path":                     kindString,
+	"notifications.outbox.retry_interval":           kindDuration,
+	"notifications.outbox.initial_backoff":          kindDuration,
+	"notifications.outbox.max_backoff":              kindDuration,
+	"notifications.outbox.max_age":                  kindDuration,
+	"notifications.outbox.dedup_window":             kindDuration,
+	"notifications.digest.time":                     kindString,
+	"notifications.digest.day":                      kindString,
+	"notifications.digest.interval":                 kindDuration,
+	"notifications.http.timeout":                    kindDuration,
+	"notifications.http.proxy":                      kindString,
+	"notifications.templates.*.*.subject":           kindString,
+	"notifications.templates.*.*.body":              kindString,
+	"watch.enabled":                                 kindBool,
+	"watch.directories":                             kindList,
+	"watch.recursive":                               kindBool,
+	"watch.include":                                 kindList,
+	"watch.exclude":                                 kindList,
+	"watch.stable_for":                              kindDuration,
+	"watch.interval":                                kindDuration,
+	"reconcile.on_startup":                          kindBool,
+	"reconcile.directories":                         kindList,
+	"reconcile.include":                             kindList,
+	"reconcile.exclude":                             kindList,
+	"reconcile.enqueue":                             kindBool,
+	"reconcile.tmpfile_min_age":                     kindDuration,
+	"spool.path":                                    kindString,
+	"spool.interval":                                kindDuration,
+	"remote.listen.enabled":                         kindBool,
+	"remote.listen.address":                         kindString,
+	"remote.listen.cert_file":                       kindString,
+	"remote.listen.key_file":                        kindString,
+	"remote.listen.client_ca_file":                  kindString,
+	"remote.listen.token":                           kindString,
+	"remote.listen.path_map":                        kindList,
+	"remote.client.url":                             kindString,
+	"remote.client.token":                           kindString,
+	"remote.client.ca_file":                         kindString,
+	"remote.client.cert_file":                       kindString,
+	"remote.client.key_file":                        kindString,
+	"remote.client.timeout":                         kindDuration,
+	"cluster.coordinator.enabled":                   kindBool,
+	"cluster.coordinator.lease_ttl":                 kindDuration,
+	"cluster.coordinator.remote_only":               kindBool,
+	"cluster.worker.name":                           kindString,
+	"cluster.worker.poll_interval":                  kindDuration,
+	"cluster.worker.heartbeat_interval":             kindDuration,
+	"cluster.worker.path_map":                       kindList,
+	"tvheadend.enabled":                             kindBool,
+	"tvheadend.url":                                 kindString,
+	"tvheadend.username":                            kindString,
+	"tvheadend.password":                            kindString,
+	"tvheadend.timeout":                             kindDuration,
+	"rename.enabled":                                kindBool,
+	"rename.remove_new":                             kindBool,
+	"rename.fix_spacing":                            kindBool,
+	"rename.fix_timestamps":                         kindBool,
+	"rename.rules":                                  kindList,
+	"webhook.headers.*":                             kindString,
+}
+
+// secrets are the keys that can be read from a file named by <key>_file
+// instead, as a * matches any list index or key segment. Other settings
+// ending in _file, such as remote.listen.cert_file, are ordinary paths.
+var secrets = map[string]bool{
+	"scheduling.pause_while_recording.password": true,
+	"remote.listen.token":                       true,
+	"remote.client.token":                       true,
+	"tvheadend.password":                        true,
+	"notifications.pushover.*.key":              true,
+}
+
+// secretOptions are the backend settings that are secrets, whether they are
+// set for a recipient or the whole backend.
+var secretOptions = map[string]bool{
+	"app_token":    true,
+	"password":     true,
+	"token":        true,
+	"bot_token":    true,
+	"access_token": true,
+}
+
+// isSecret reports whether key is one of the secrets.
+func isSecret(key string) bool {
+	if secrets[key] {
+		return true
+	}
+	for pattern := range secrets {
+		if matchKey(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// backendKinds are the kinds of the backend settings that aren't strings.
+var backendKinds = map[string]kind{
+	"timeout":          kindDuration,
+	"retry":            kindDuration,
+	"expire":           kindDuration,
+	"receipt_interval": kindDuration,
+	"thumbnail_width":  kindInt,
+	"html":             kindBool,
+	"thumbnail":        kindBool,
+	"port":             kindInt,
+}
+
+func init() {
+	// Recipients live under notifications, and settings shared by all of a
+	// backend's recipients under a top level key of the same name.
+	for _, backend := range notify.Backends() {
+		schema["notifications."+backend] = kindList
+		for _, key := range notify.BackendOptions(backend) {
+			k, ok := backendKinds[key]
+			if !ok {
+				k = kindString
+			}
+			schema[backend+"."+key] = k
+			if secretOptions[key] {
+				secrets[backend+"."+key] = true
+				secrets["notifications."+backend+".*."+key] = true
+			}
+		}
+	}
+}
+
+// lookupSchema returns the kind of key and whether it is known.
+func lookupSchema(key string) (kind, bool) {
+	if k, ok := schema[key]; ok {
+		return k, true
+	}
+	for pattern, k := range schema {
+		if matchKey(pattern, key) {
+			return k, true
+		}
+	}
+	return kindAny, false
+}
+
+// matchKey reports whether key matches pattern, in which a * matches any
+// single key segment.
+func matchKey(pattern, key string) bool {
+	psegments := strings.Split(pattern, ".")
+	segments := strings.Split(key, ".")
+	if len(psegments) != len(segments) {
+		return false
+	}
+	for i := range psegments {
+		if psegments[i] != "*" && psegments[i] != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func checkKind(k kind, v interface{}) error {
+	if v == nil {
+		return nil
+	}
+
+	s := fmt.Sprint(v)
+	var err error
+	switch k {
+	case kindString:
+		switch v.(type) {
+		case []interface{}, map[string]interface{}:
+			err = fmt.Errorf("expected a single value")
+		}
+	case kindBool:
+		_, err = strconv.ParseBool(s)
+	case kindInt:
+		_, err = strconv.Atoi(s)
+	case kindFloat:
+		_, err = strconv.ParseFloat(s, 64)
+	case kindDuration:
+		_, err = time.ParseDuration(s)
+	case kindList:
+		if _, ok := v.([]interface{}); !ok {
+			err = fmt.Errorf("expected a list")
+		}
+	}
+	return err
+}
+
+// Validate checks the whole of the loaded configuration.
+func Validate() Report {
+	_, r := validate(viper.GetViper())
+	return r
+}
+
+// validate builds a Config from the configuration loaded into v and checks it.
+func validate(v *viper.Viper) (*Config, Report) {
+	var r Report
+
+	cfg, err := build(v)
+	if err != nil {
+		r.errorf("%s", err)
+	}
+
+	validateKeys(&r, v)
+	validatePaths(&r, v)
+	validateTranscoding(&r, v, cfg)
+	validateScheduling(&r, cfg)
+	validateRename(&r, cfg)
+	validateWatch(&r, cfg)
+	validateRemote(&r, cfg)
+	validateCluster(&r, cfg)
+	validateTVHeadend(&r, cfg)
+	validateNotifications(&r, cfg)
+
+	return cfg, r
+}
+
+// clientKeys are the settings the client uses.
+var clientKeys = []string{"socket_path", "spool.path", "remote.client"}
+
+// validateClient checks only the settings the client uses.
+func validateClient(r *Report, v *viper.Viper, cfg *Config) {
+	for _, key := range v.AllKeys() {
+		used := false
+		for _, prefix := range clientKeys {
+			used = used || key == prefix || strings.HasPrefix(key, prefix+".")
+		}
+		if k, ok := lookupSchema(key); ok && used {
+			if err := checkKind(k, v.Get(key)); err != nil {
+				r.errorf("config: invalid value '%v' for %s: %s", v.Get(key), key, err)
+			}
+		}
+	}
+
+	if cfg.RemoteClient.URL == "" && cfg.SocketPath == "" {
+		r.errorf("config: socket_path must be set")
+	}
+	if u := cfg.RemoteClient.URL; u != "" && !strings.HasPrefix(u, "https://") {
+		r.errorf("config: remote.client.url must be an https:// URL, not '%s'", u)
+	}
+}
+
+func validateKeys(r *Report, v *viper.Viper) {
+	keys := v.AllKeys()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		k, ok := lookupSchema(key)
+		if !ok {
+			r.warnf("config: unknown setting '%s' will be ignored", key)
+			continue
+		}
+		if err := checkKind(k, v.Get(key)); err != nil {
+			r.errorf("config: invalid value '%v' for %s: %s", v.Get(key), key, err)
+		}
+	}
+}
+
+func validatePaths(r *Report, v *viper.Viper) {
+	for _, key := range []string{"state_path", "socket_path"} {
+		if v.GetString(key) == "" {
+			r.errorf("config: %s must be set", key)
+		}
+	}
+
+	for _, key := range []string{"state_path", "socket_path", "history.path", "notifications.outbox.path", "spool.path"} {
+		path := v.GetString(key)
+		if path == "" {
+			continue
+		}
+		dir := filepath.Dir(path)
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			r.errorf("config: directory %s for %s does not exist", dir, key)
+		}
+	}
+
+	if parent := v.GetString("transcoding.resources.cgroup.parent"); parent != "" {
+		if fi, err := os.Stat(parent); err != nil || !fi.IsDir() {
+			r.warnf("config: cgroup %s does not exist, ffmpeg will run without cgroup limits", parent)
+		}
+	}
+}
+
+func validateTranscoding(r *Report, v *viper.Viper, cfg *Config) {
+	for _, key := range []string{"transcoding.video_config", "transcoding.audio_config"} {
+		if err := ffmpeg.ValidateArgs(v.GetString(key)); err != nil {
+			r.errorf("config: %s: %s", key, err)
+		}
+	}
+
+	if err := cfg.Media.FFmpeg.Validate(); err != nil {
+		r.errorf("config: transcoding.resources: %s", err)
+	}
+
+	if err := cfg.Media.RateControl.Validate(); err != nil {
+		r.errorf("config: transcoding.rate_control: %s", err)
+	}
+
+	if d := cfg.Media.Decisions; d.Enabled {
+		if err := d.Validate(); err != nil {
+			r.errorf("config: transcoding.decisions: %s", err)
+		}
+		if cfg.Media.OnlySD {
+			r.warnf("config: transcoding.only_sd is ignored when transcoding.decisions are enabled, use skip_codecs instead")
+		}
+		for _, f := range strings.Split(cfg.Media.VideoArgs, " ") {
+			if f == "-vf" || f == "-filter:v" {
+				r.warnf("config: the video filters in transcoding.video_config are replaced by those chosen by transcoding.decisions")
+				break
+			}
+		}
+	}
+
+	if cfg.MaxAttempts < 0 {
+		r.errorf("config: transcoding.max_attempts must not be negative")
+	}
+	if cfg.Media.Timeouts.VideoFactor < 0 {
+		r.errorf("config: transcoding.timeout.video_factor must not be negative")
+	}
+	if cfg.Media.Timeouts.AudioFactor < 0 {
+		r.errorf("config: transcoding.timeout.audio_factor must not be negative")
+	}
+}
+
+func validateScheduling(r *Report, cfg *Config) {
+	s := cfg.Scheduling
+	if _, err := scheduler.ParsePolicy(string(s.Policy)); err != nil {
+		r.errorf("config: scheduling.policy: %s", err)
+	}
+
+	for _, rule := range s.Rules {
+		if err := rule.Validate(); err != nil {
+			r.errorf("config: scheduling.rules: %s", err)
+		}
+	}
+
+	if _, err := timewindow.ParseAll(s.Windows); err != nil {
+		r.errorf("config: scheduling.windows: %s", err)
+	}
+
+	if s.PauseWhileRecording.Enabled && s.PauseWhileRecording.URL == "" {
+		r.errorf("config: scheduling.pause_while_recording.url must be set when it is enabled")
+	}
+}
+
+func validateRename(r *Report, cfg *Config) {
+	rules := cfg.Media.Renamer.Rules
+	for i := range rules {
+		if err := rules[i].Validate(); err != nil {
+			r.errorf("config: rename.rules: %s", err)
+		}
+	}
+}
+
+func validateWatch(r *Report, cfg *Config) {
+	if err := cfg.Watch.Validate(); err != nil {
+		r.errorf("config: %s", err)
+	}
+	if err := cfg.Reconcile.Validate(); err != nil {
+		r.errorf("config: %s", err)
+	}
+}
+
+func validateRemote(r *Report, cfg *Config) {
+	if err := cfg.Remote.Validate(); err != nil {
+		r.errorf("config: %s", err)
+	}
+	if cfg.Remote.Enabled && len(cfg.Remote.PathMap) == 0 {
+		r.warnf("config: remote.listen.path_map is empty, recordings submitted to the listener will be refused")
+	}
+	if u := cfg.RemoteClient.URL; u != "" && !strings.HasPrefix(u, "https://") {
+		r.errorf("config: remote.client.url must be an https:// URL, not '%s'", u)
+	}
+}
+
+func validateCluster(r *Report, cfg *Config) {
+	if cfg.Cluster.Enabled && !cfg.Remote.Enabled {
+		r.errorf("config: cluster.coordinator needs remote.listen to be enabled for workers to connect")
+	}
+	if cfg.Cluster.RemoteOnly && !cfg.Cluster.Enabled {
+		r.warnf("config: cluster.coordinator.remote_only is set but the coordinator isn't enabled, nothing will be transcoded")
+	}
+	if err := cfg.Worker.Validate(); err != nil {
+		r.errorf("config: %s", err)
+	}
+	if hb := cfg.Worker.HeartbeatInterval; hb > 0 && hb >= cfg.Cluster.TTL()/2 && cfg.Cluster.Enabled {
+		r.warnf("config: cluster.worker.heartbeat_interval %s is close to the lease TTL %s, leases may expire", hb, cfg.Cluster.TTL())
+	}
+}
+
+func validateTVHeadend(r *Report, cfg *Config) {
+	if err := cfg.TVHeadend.Validate(); err != nil {
+		r.errorf("config: %s", err)
+	}
+}
+
+func validateNotifications(r *Report, cfg *Config) {
+	if err := cfg.Notify.ValidateRouting(); err != nil {
+		r.errorf("config: %s", err)
+	}
+
+	warnings, errs := cfg.Notify.ValidateRecipients()
+	for _, w := range warnings {
+		r.warnf("config: %s", w)
+	}
+	for _, err := range errs {
+		r.errorf("config: %s", err)
+	}
+
+	if err := cfg.Notify.ValidateTemplates(); err != nil {
+		r.errorf("config: notifications.templates: %s", err)
+	}
+}
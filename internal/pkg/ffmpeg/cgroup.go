@@ -0,0 +1,107 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/dustin/go-humanize"
+	log "github.com/sirupsen/logrus"
+)
+
+// cgroupPeriod is the cpu.max period in microseconds.
+const cgroupPeriod = 100000
+
+// CgroupOptions place ffmpeg into a cgroup v2 child of Parent with CPU and
+// memory limits. Parent must exist and be writable by the daemon, such as a
+// delegated systemd slice.
+type CgroupOptions struct {
+	Parent string
+	// CPULimit is the number of CPUs ffmpeg may use, e.g. 1.5. Zero is unlimited.
+	CPULimit float64
+	// MemoryLimit is a human readable size such as "2GiB". Empty is unlimited.
+	MemoryLimit string
+}
+
+func (c CgroupOptions) enabled() bool {
+	return c.Parent != "" && (c.CPULimit > 0 || c.MemoryLimit != "")
+}
+
+type cgroup struct {
+	path string
+	dir  *os.File
+}
+
+// newCgroup creates a cgroup with the configured limits for ffmpeg to be
+// started in. It returns nil without error if cgroups aren't configured.
+func newCgroup(opts CgroupOptions) (*cgroup, error) {
+	if !opts.enabled() {
+		return nil, nil
+	}
+
+	path, err := ioutil.TempDir(opts.Parent, "tvhtc2-ffmpeg-")
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg: error creating cgroup in %s: %s", opts.Parent, err)
+	}
+	cg := &cgroup{path: path}
+
+	if opts.CPULimit > 0 {
+		quota := int(opts.CPULimit * cgroupPeriod)
+		if err := cg.write("cpu.max", fmt.Sprintf("%d %d", quota, cgroupPeriod)); err != nil {
+			cg.remove()
+			return nil, err
+		}
+	}
+
+	if opts.MemoryLimit != "" {
+		limit, err := humanize.ParseBytes(opts.MemoryLimit)
+		if err != nil {
+			cg.remove()
+			return nil, fmt.Errorf("ffmpeg: invalid memory limit '%s': %s", opts.MemoryLimit, err)
+		}
+		if err := cg.write("memory.max", strconv.FormatUint(limit, 10)); err != nil {
+			cg.remove()
+			return nil, err
+		}
+	}
+
+	// The process is cloned straight into the cgroup, rather than moved
+	// there once started, so it never runs for a moment without limits
+	if cg.dir, err = os.Open(cg.path); err != nil {
+		cg.remove()
+		return nil, fmt.Errorf("ffmpeg: error opening cgroup %s: %s", cg.path, err)
+	}
+
+	log.WithFields(log.Fields{
+		"path":   cg.path,
+		"cpu":    opts.CPULimit,
+		"memory": opts.MemoryLimit,
+	}).Debug("ffmpeg: created cgroup")
+	return cg, nil
+}
+
+// attach makes cmd start inside the cgroup.
+func (cg *cgroup) attach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		UseCgroupFD: true,
+		CgroupFD:    int(cg.dir.Fd()),
+	}
+}
+
+func (cg *cgroup) write(file, value string) error {
+	if err := ioutil.WriteFile(filepath.Join(cg.path, file), []byte(value), 0644); err != nil {
+		return fmt.Errorf("ffmpeg: error writing %s to cgroup %s: %s", file, cg.path, err)
+	}
+	return nil
+}
+
+func (cg *cgroup) remove() error {
+	if cg.dir != nil {
+		cg.dir.Close()
+	}
+	return os.Remove(cg.path)
+}
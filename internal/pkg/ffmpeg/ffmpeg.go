@@ -0,0 +1,192 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Options control the resources an ffmpeg process may use.
+type Options struct {
+	// Nice is the scheduling niceness to run ffmpeg with, zero leaves it alone.
+	Nice int
+	// IOClass and IOLevel are passed to ionice. A class of zero leaves it alone.
+	IOClass int
+	IOLevel int
+	// Threads limits the threads ffmpeg uses for encoding, zero lets ffmpeg decide.
+	Threads int
+
+	// Timeout kills ffmpeg once it has been running this long, not counting
+	// time spent paused. Zero disables the timeout.
+	Timeout time.Duration
+	// StallTimeout kills ffmpeg if its progress hasn't advanced for this long.
+	// Zero disables the watchdog.
+	StallTimeout time.Duration
+
+	Cgroup    CgroupOptions
+	LoadPause LoadPauseOptions
+
+	// Progress, if set, is called with the output timestamp ffmpeg has
+	// reached each time it reports its progress.
+	Progress func(outTime time.Duration)
+	// Cancel, if set, kills ffmpeg when it is closed.
+	Cancel <-chan struct{}
+}
+
+// OutputArgs returns extra ffmpeg output options implied by o. They must be
+// placed before the output filename.
+func (o Options) OutputArgs() []string {
+	if o.Threads <= 0 {
+		return nil
+	}
+	return []string{"-threads", strconv.Itoa(o.Threads)}
+}
+
+// command builds the command line for ffmpeg, wrapped in nice and ionice
+// where needed. Both wrappers exec ffmpeg, so the PID is that of ffmpeg.
+func (o Options) command(args []string) []string {
+	var cmd []string
+	if o.Nice != 0 {
+		cmd = append(cmd, "nice", "-n", strconv.Itoa(o.Nice))
+	}
+	if o.IOClass != 0 {
+		cmd = append(cmd, "ionice", "-c", strconv.Itoa(o.IOClass))
+		if o.IOClass == 1 || o.IOClass == 2 {
+			cmd = append(cmd, "-n", strconv.Itoa(o.IOLevel))
+		}
+	}
+	cmd = append(cmd, "ffmpeg")
+	return append(cmd, args...)
+}
+
+// Timeouts limit how long a transcode may run for, relative to the
+// duration of the recording.
+type Timeouts struct {
+	VideoFactor float64
+	AudioFactor float64
+	// Minimum is the shortest timeout, however short the recording.
+	Minimum time.Duration
+}
+
+// For returns the timeout for transcoding media of the given duration with
+// the named profile, "video" or "audio". It is the profile's factor
+// multiplied by the duration, but never less than Minimum. Zero means no
+// timeout.
+func (t Timeouts) For(profile string, duration time.Duration) time.Duration {
+	factor := t.VideoFactor
+	if profile == "audio" {
+		factor = t.AudioFactor
+	}
+	if factor <= 0 || duration <= 0 {
+		return 0
+	}
+
+	timeout := time.Duration(factor * float64(duration))
+	if timeout < t.Minimum {
+		timeout = t.Minimum
+	}
+	return timeout
+}
+
+// outputTailLines is the number of lines of output included in errors.
+const outputTailLines = 20
+
+// maxOutputBytes caps how much of ffmpeg's output is kept in memory.
+const maxOutputBytes = 64 * 1024
+
+// Error is returned when ffmpeg fails or is killed by the watchdog. Tail
+// holds the last lines of ffmpeg's output.
+type Error struct {
+	Reason string
+	Tail   string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("ffmpeg: %s, output:\n%s", e.Reason, e.Tail)
+}
+
+// Run runs ffmpeg with args under the given resource controls and watchdog,
+// and returns the last of its output.
+func Run(args []string, opts Options) ([]byte, error) {
+	args = append([]string{"-nostats", "-progress", "pipe:1"}, args...)
+	argv := opts.command(args)
+	out := &tailBuffer{max: maxOutputBytes}
+
+	cg, err := newCgroup(opts.Cgroup)
+	if err != nil {
+		log.WithError(err).Warning("ffmpeg: unable to apply cgroup limits, continuing without them")
+	}
+
+	log.WithFields(log.Fields{
+		"command": argv,
+		"timeout": opts.Timeout,
+		"stall":   opts.StallTimeout,
+	}).Debug("ffmpeg: starting process")
+	cmd, progress, err := start(argv, out, cg)
+	if err != nil && cg != nil {
+		// Starting a process in a cgroup needs Linux 5.7 or later
+		log.WithError(err).Warning("ffmpeg: unable to start process in cgroup, continuing without cgroup limits")
+		cg.remove()
+		cg = nil
+		cmd, progress, err = start(argv, out, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	mon := newMonitor()
+	mon.onProgress = opts.Progress
+	done := make(chan struct{})
+	killed := make(chan string, 1)
+	if opts.LoadPause.enabled() {
+		go watchLoad(cmd.Process, opts.LoadPause, mon, done)
+	}
+	go mon.watchdog(cmd.Process, opts.Timeout, opts.StallTimeout, opts.Cancel, done, killed)
+
+	// Wait must not be called until the progress pipe has been drained
+	mon.readProgress(progress)
+	err = cmd.Wait()
+	close(done)
+
+	if cg != nil {
+		// The kernel needs a moment to notice the cgroup is empty
+		time.Sleep(100 * time.Millisecond)
+		if rerr := cg.remove(); rerr != nil {
+			log.WithError(rerr).Warning("ffmpeg: unable to remove cgroup")
+		}
+	}
+
+	select {
+	case reason := <-killed:
+		return out.Bytes(), &Error{Reason: reason, Tail: out.Lines(outputTailLines)}
+	default:
+	}
+
+	if err != nil {
+		return out.Bytes(), &Error{Reason: err.Error(), Tail: out.Lines(outputTailLines)}
+	}
+	return out.Bytes(), nil
+}
+
+// start starts argv writing its output to out, inside cg if it isn't nil,
+// and returns it along with its progress pipe.
+func start(argv []string, out io.Writer, cg *cgroup) (*exec.Cmd, io.ReadCloser, error) {
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stderr = out
+	if cg != nil {
+		cg.attach(cmd)
+	}
+
+	progress, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("ffmpeg: error creating progress pipe: %s", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, fmt.Errorf("ffmpeg: error starting process: %s", err)
+	}
+	return cmd, progress, nil
+}
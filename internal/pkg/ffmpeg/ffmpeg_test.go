@@ -0,0 +1,152 @@
+package ffmpeg
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOptions_command(t *testing.T) {
+	args := []string{"-i", "in.ts", "out.mkv"}
+
+	assert.Equal(t, []string{"ffmpeg", "-i", "in.ts", "out.mkv"}, Options{}.command(args))
+	assert.Equal(t, []string{"nice", "-n", "10", "ionice", "-c", "3", "ffmpeg", "-i", "in.ts", "out.mkv"},
+		Options{Nice: 10, IOClass: 3, IOLevel: 7}.command(args))
+	assert.Equal(t, []string{"ionice", "-c", "2", "-n", "7", "ffmpeg", "-i", "in.ts", "out.mkv"},
+		Options{IOClass: 2, IOLevel: 7}.command(args))
+
+	assert.Nil(t, Options{}.OutputArgs())
+	assert.Equal(t, []string{"-threads", "2"}, Options{Threads: 2}.OutputArgs())
+}
+
+func TestCgroup(t *testing.T) {
+	parent := t.TempDir()
+
+	cg, err := newCgroup(CgroupOptions{Parent: parent, CPULimit: 1.5, MemoryLimit: "2GiB"})
+	require.NoError(t, err)
+	defer cg.dir.Close()
+
+	read := func(file string) string {
+		b, err := ioutil.ReadFile(filepath.Join(cg.path, file))
+		require.NoError(t, err)
+		return string(b)
+	}
+	assert.Equal(t, "150000 100000", read("cpu.max"))
+	assert.Equal(t, "2147483648", read("memory.max"))
+
+	cmd := exec.Command("true")
+	cg.attach(cmd)
+	assert.True(t, cmd.SysProcAttr.UseCgroupFD, "ffmpeg starts inside the cgroup")
+	assert.Equal(t, int(cg.dir.Fd()), cmd.SysProcAttr.CgroupFD)
+
+	parent = t.TempDir()
+	cg, err = newCgroup(CgroupOptions{Parent: parent})
+	assert.NoError(t, err)
+	assert.Nil(t, cg, "no limits means no cgroup")
+
+	_, err = newCgroup(CgroupOptions{Parent: parent, MemoryLimit: "lots"})
+	assert.Error(t, err)
+	entries, err := ioutil.ReadDir(parent)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "failed cgroup is removed")
+}
+
+func TestLoadAverage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "loadavg")
+	require.NoError(t, ioutil.WriteFile(path, []byte("4.25 3.10 2.00 2/345 6789\n"), 0644))
+
+	orig := loadavgPath
+	loadavgPath = path
+	defer func() { loadavgPath = orig }()
+
+	load, err := loadAverage()
+	require.NoError(t, err)
+	assert.Equal(t, 4.25, load)
+
+	assert.Equal(t, 3.0, LoadPauseOptions{Above: 6, ResumeBelow: 3}.resumeThreshold())
+	assert.Equal(t, 6.0, LoadPauseOptions{Above: 6}.resumeThreshold())
+}
+
+func TestMonitor_check(t *testing.T) {
+	m := newMonitor()
+	start := m.start
+
+	assert.Empty(t, m.check(start.Add(time.Minute), 0, 0))
+	assert.Contains(t, m.check(start.Add(2*time.Minute), time.Minute, 0), "timed out")
+	assert.Contains(t, m.check(start.Add(2*time.Minute), 0, time.Minute), "no progress")
+
+	m.progress(1000)
+	assert.Empty(t, m.check(time.Now().Add(30*time.Second), 0, time.Minute))
+
+	m.setPaused(true)
+	assert.Empty(t, m.check(start.Add(time.Hour), time.Minute, time.Minute), "paused processes are left alone")
+}
+
+// fakeFFmpeg puts a shell script named ffmpeg at the front of PATH.
+func fakeFFmpeg(t *testing.T, script string) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "ffmpeg"), []byte("#!/bin/sh\n"+script), 0755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestTimeouts_For(t *testing.T) {
+	timeouts := Timeouts{VideoFactor: 2, AudioFactor: 0.5, Minimum: 10 * time.Minute}
+
+	assert.Equal(t, 2*time.Hour, timeouts.For("video", time.Hour))
+	assert.Equal(t, 30*time.Minute, timeouts.For("audio", time.Hour))
+	assert.Equal(t, 10*time.Minute, timeouts.For("video", time.Minute))
+	assert.Zero(t, timeouts.For("video", 0), "unknown durations have no timeout")
+	assert.Zero(t, Timeouts{}.For("video", time.Hour))
+}
+
+func TestRun_watchdogKillsStalledProcess(t *testing.T) {
+	fakeFFmpeg(t, "echo 'Input #0, mpegts' >&2\necho out_time_us=1000\nexec sleep 30\n")
+
+	orig := watchdogInterval
+	watchdogInterval = 50 * time.Millisecond
+	defer func() { watchdogInterval = orig }()
+
+	start := time.Now()
+	_, err := Run([]string{"-i", "in.ts", "out.mkv"}, Options{StallTimeout: 200 * time.Millisecond})
+	require.Error(t, err)
+	assert.Less(t, time.Since(start), 10*time.Second)
+
+	ferr, ok := err.(*Error)
+	require.True(t, ok)
+	assert.Contains(t, ferr.Reason, "no progress")
+	assert.Contains(t, ferr.Tail, "Input #0, mpegts")
+}
+
+func TestRun_failureIncludesOutput(t *testing.T) {
+	fakeFFmpeg(t, "echo 'in.ts: Invalid data found when processing input' >&2\nexit 1\n")
+
+	_, err := Run([]string{"-i", "in.ts", "out.mkv"}, Options{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Invalid data found")
+}
+
+func TestValidateArgs(t *testing.T) {
+	assert.NoError(t, ValidateArgs("-vf yadif=1 -c:v libx264 -preset veryfast -crf 21 -c:a ac3 -b:a 192k -sn"))
+	assert.Error(t, ValidateArgs(""))
+	assert.Error(t, ValidateArgs("libx264"))
+	assert.Error(t, ValidateArgs("-c:v  libx264"))
+	assert.Error(t, ValidateArgs("-c:v libx264 "))
+	assert.Error(t, ValidateArgs(`-vf "yadif=1"`))
+	assert.Error(t, ValidateArgs("-i in.ts -c:v libx264"))
+	assert.Error(t, ValidateArgs("-c:v libx264 -y"))
+}
+
+func TestOptions_Validate(t *testing.T) {
+	assert.NoError(t, Options{Nice: 10, IOClass: 3, IOLevel: 7, Cgroup: CgroupOptions{MemoryLimit: "2GiB"}}.Validate())
+	assert.Error(t, Options{Nice: 20}.Validate())
+	assert.Error(t, Options{IOClass: 4}.Validate())
+	assert.Error(t, Options{Threads: -1}.Validate())
+	assert.Error(t, Options{Cgroup: CgroupOptions{MemoryLimit: "lots"}}.Validate())
+	assert.Error(t, Options{LoadPause: LoadPauseOptions{Above: 2, ResumeBelow: 3}}.Validate())
+}
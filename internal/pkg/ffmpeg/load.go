@@ -0,0 +1,104 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultLoadInterval = 30 * time.Second
+
+// loadavgPath is a variable so tests can point it at a fake file.
+var loadavgPath = "/proc/loadavg"
+
+// LoadPauseOptions suspend ffmpeg with SIGSTOP while the one minute load
+// average is above Above, resuming it with SIGCONT once it drops below
+// ResumeBelow.
+type LoadPauseOptions struct {
+	Above       float64
+	ResumeBelow float64
+	Interval    time.Duration
+}
+
+func (l LoadPauseOptions) enabled() bool {
+	return l.Above > 0
+}
+
+func (l LoadPauseOptions) resumeThreshold() float64 {
+	if l.ResumeBelow <= 0 || l.ResumeBelow > l.Above {
+		return l.Above
+	}
+	return l.ResumeBelow
+}
+
+func loadAverage() (float64, error) {
+	b, err := ioutil.ReadFile(loadavgPath)
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("ffmpeg: empty %s", loadavgPath)
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// watchLoad pauses and resumes proc according to the system load until done
+// is closed. A paused process is always resumed before returning.
+func watchLoad(proc *os.Process, opts LoadPauseOptions, mon *monitor, done chan struct{}) {
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = defaultLoadInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	paused := false
+	defer func() {
+		if paused {
+			proc.Signal(syscall.SIGCONT)
+			mon.setPaused(false)
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		load, err := loadAverage()
+		if err != nil {
+			log.WithError(err).Warning("ffmpeg: unable to read load average")
+			continue
+		}
+
+		switch {
+		case !paused && load > opts.Above:
+			log.WithField("load", load).Info("ffmpeg: system load too high, pausing transcode")
+			if err := proc.Signal(syscall.SIGSTOP); err != nil {
+				log.WithError(err).Error("ffmpeg: failed to pause process")
+				continue
+			}
+			paused = true
+			mon.setPaused(true)
+		case paused && load < opts.resumeThreshold():
+			log.WithField("load", load).Info("ffmpeg: system load dropped, resuming transcode")
+			if err := proc.Signal(syscall.SIGCONT); err != nil {
+				log.WithError(err).Error("ffmpeg: failed to resume process")
+				continue
+			}
+			paused = false
+			mon.setPaused(false)
+		}
+	}
+}
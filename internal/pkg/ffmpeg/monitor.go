@@ -0,0 +1,162 @@
+package ffmpeg
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// watchdogInterval is how often the watchdog checks on ffmpeg. It is a
+// variable so tests don't have to wait.
+var watchdogInterval = 5 * time.Second
+
+// monitor tracks the progress of an ffmpeg process so the watchdog can tell
+// whether it is stuck. Time spent paused due to system load doesn't count
+// towards either the timeout or the stall timeout.
+type monitor struct {
+	sync.Mutex
+	start        time.Time
+	lastProgress time.Time
+	outTime      int64
+	paused       bool
+	pausedAt     time.Time
+	pausedFor    time.Duration
+	onProgress   func(time.Duration)
+}
+
+func newMonitor() *monitor {
+	now := time.Now()
+	return &monitor{start: now, lastProgress: now}
+}
+
+func (m *monitor) setPaused(paused bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now()
+	if paused && !m.paused {
+		m.pausedAt = now
+	}
+	if !paused && m.paused {
+		m.pausedFor += now.Sub(m.pausedAt)
+		m.lastProgress = now
+	}
+	m.paused = paused
+}
+
+// progress records the output timestamp ffmpeg has reached, in microseconds.
+func (m *monitor) progress(outTime int64) {
+	m.Lock()
+	defer m.Unlock()
+
+	if outTime > m.outTime {
+		m.outTime = outTime
+		m.lastProgress = time.Now()
+	}
+}
+
+// check returns a reason to kill the process, or an empty string if it
+// should be left alone.
+func (m *monitor) check(now time.Time, timeout, stall time.Duration) string {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.paused {
+		return ""
+	}
+
+	if timeout > 0 && now.Sub(m.start)-m.pausedFor > timeout {
+		return "timed out after " + timeout.String()
+	}
+
+	if stall > 0 && now.Sub(m.lastProgress) > stall {
+		return "no progress for " + stall.String()
+	}
+
+	return ""
+}
+
+// readProgress parses the key=value output of ffmpeg's -progress option.
+func (m *monitor) readProgress(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Older versions of ffmpeg call this out_time_ms, but it is still microseconds
+		for _, key := range []string{"out_time_us=", "out_time_ms="} {
+			if strings.HasPrefix(line, key) {
+				if v, err := strconv.ParseInt(strings.TrimPrefix(line, key), 10, 64); err == nil {
+					m.progress(v)
+					if m.onProgress != nil {
+						m.onProgress(time.Duration(v) * time.Microsecond)
+					}
+				}
+				break
+			}
+		}
+	}
+}
+
+// watchdog kills proc when the monitor reports it is stuck or cancel is
+// closed, until done is closed. The reason for killing it is sent on killed.
+func (m *monitor) watchdog(proc *os.Process, timeout, stall time.Duration, cancel <-chan struct{}, done chan struct{}, killed chan<- string) {
+	if timeout <= 0 && stall <= 0 && cancel == nil {
+		return
+	}
+
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+
+	for {
+		var reason string
+		select {
+		case <-done:
+			return
+		case <-cancel:
+			reason = "cancelled"
+		case now := <-ticker.C:
+			if reason = m.check(now, timeout, stall); reason == "" {
+				continue
+			}
+		}
+
+		log.WithField("reason", reason).Error("ffmpeg: watchdog killing process")
+		killed <- reason
+		if err := proc.Kill(); err != nil {
+			log.WithError(err).Error("ffmpeg: watchdog failed to kill process")
+		}
+		return
+	}
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - t.max; over > 0 {
+		t.buf = t.buf[over:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) Bytes() []byte {
+	return t.buf
+}
+
+// Lines returns up to the last n lines in the buffer.
+func (t *tailBuffer) Lines(n int) string {
+	lines := strings.Split(strings.TrimRight(string(t.buf), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,196 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Rate control modes for video.
+const (
+	// ModeCRF uses the video arguments as they are, which normally set a
+	// constant quality with -crf.
+	ModeCRF = "crf"
+	// ModeABR encodes in two passes at an average bitrate.
+	ModeABR = "abr"
+	// ModeSize encodes in two passes at the bitrate that makes the output
+	// the target size, given the duration of the recording.
+	ModeSize = "size"
+)
+
+// RateControl chooses how the video bitrate is decided.
+type RateControl struct {
+	// Mode is one of ModeCRF, ModeABR or ModeSize. Empty is ModeCRF.
+	Mode string
+	// VideoBitrate is the average bitrate for ModeABR, such as 2500k.
+	VideoBitrate string
+	// TargetSize is the size of the output for ModeSize, such as 2GiB.
+	TargetSize string
+	// AudioBitrate is set aside from the target size for the audio. It
+	// should match the audio bitrate in the video arguments.
+	AudioBitrate string
+	// MinVideoBitrate is the lowest bitrate ModeSize will choose, however
+	// long the recording.
+	MinVideoBitrate string
+}
+
+// TwoPass reports whether the mode encodes in two passes.
+func (r RateControl) TwoPass() bool {
+	return r.Mode == ModeABR || r.Mode == ModeSize
+}
+
+// Validate checks the mode has what it needs.
+func (r RateControl) Validate() error {
+	switch r.Mode {
+	case "", ModeCRF:
+	case ModeABR:
+		if r.VideoBitrate == "" {
+			return fmt.Errorf("ffmpeg: video_bitrate must be set for %s rate control", r.Mode)
+		}
+	case ModeSize:
+		if r.TargetSize == "" {
+			return fmt.Errorf("ffmpeg: target_size must be set for %s rate control", r.Mode)
+		}
+	default:
+		return fmt.Errorf("ffmpeg: unknown rate control mode '%s', expected one of %s, %s or %s", r.Mode, ModeCRF, ModeABR, ModeSize)
+	}
+
+	for name, value := range map[string]string{
+		"video_bitrate":     r.VideoBitrate,
+		"target_size":       r.TargetSize,
+		"audio_bitrate":     r.AudioBitrate,
+		"min_video_bitrate": r.MinVideoBitrate,
+	} {
+		if value == "" {
+			continue
+		}
+		if _, err := humanize.ParseBytes(value); err != nil {
+			return fmt.Errorf("ffmpeg: invalid %s '%s': %s", name, value, err)
+		}
+	}
+	return nil
+}
+
+// Bitrate returns the video bitrate in bits per second for a recording of
+// the given duration.
+func (r RateControl) Bitrate(duration time.Duration) (uint64, error) {
+	if r.Mode == ModeABR {
+		return ParseBitrate(r.VideoBitrate)
+	}
+
+	if duration <= 0 {
+		return 0, fmt.Errorf("ffmpeg: duration is unknown, can't work out the bitrate for the target size")
+	}
+	size, err := humanize.ParseBytes(r.TargetSize)
+	if err != nil {
+		return 0, fmt.Errorf("ffmpeg: invalid target size '%s': %s", r.TargetSize, err)
+	}
+	audio, err := ParseBitrate(r.AudioBitrate)
+	if err != nil {
+		return 0, err
+	}
+	min, err := ParseBitrate(r.MinVideoBitrate)
+	if err != nil {
+		return 0, err
+	}
+
+	total := float64(size*8) / duration.Seconds()
+	video := uint64(0)
+	if total > float64(audio) {
+		video = uint64(total) - audio
+	}
+	if video < min {
+		video = min
+	}
+	if video == 0 {
+		return 0, fmt.Errorf("ffmpeg: %s is too small for %s of audio at %s", r.TargetSize, duration, r.AudioBitrate)
+	}
+	return video, nil
+}
+
+// ParseBitrate returns the number of bits per second in a bitrate such as 2500k.
+// Empty is zero.
+func ParseBitrate(bitrate string) (uint64, error) {
+	if bitrate == "" {
+		return 0, nil
+	}
+	v, err := humanize.ParseBytes(bitrate)
+	if err != nil {
+		return 0, fmt.Errorf("ffmpeg: invalid bitrate '%s': %s", bitrate, err)
+	}
+	return v, nil
+}
+
+// rateArgs are the options that TwoPassArgs replaces with its own.
+var rateArgs = map[string]bool{
+	"-crf": true, "-b:v": true, "-q:v": true, "-qp": true,
+	"-maxrate": true, "-bufsize": true, "-pass": true, "-passlogfile": true,
+}
+
+// TwoPassArgs returns the arguments for each pass of a two-pass encode at
+// bitrate, from args with any rate options removed. The first pass only
+// analyses the video, so its output must be discarded, see NullOutput.
+// Both passes share the statistics in the files starting with passlog.
+func TwoPassArgs(args []string, bitrate uint64, passlog string) ([]string, []string) {
+	var base []string
+	for i := 0; i < len(args); i++ {
+		if rateArgs[args[i]] {
+			i++
+			continue
+		}
+		base = append(base, args[i])
+	}
+
+	rate := []string{"-b:v", strconv.FormatUint(bitrate, 10), "-passlogfile", passlog}
+	first := append(append(append([]string(nil), base...), rate...), "-pass", "1", "-an", "-sn")
+	second := append(append(append([]string(nil), base...), rate...), "-pass", "2")
+	return first, second
+}
+
+// NullOutput is the output of a first pass, which is thrown away.
+func NullOutput() []string {
+	return []string{"-f", "null", os.DevNull}
+}
+
+// PassLog returns a prefix for the statistics files of a two-pass encode in
+// the temporary directory, named after name.
+func PassLog(name string) string {
+	return filepath.Join(os.TempDir(), "tvhtc2-passlog-"+name)
+}
+
+// RemovePassLogs removes the statistics files of a two-pass encode, which
+// encoders name by adding to the prefix.
+func RemovePassLogs(prefix string) error {
+	matches, err := filepath.Glob(prefix + "*")
+	if err != nil {
+		return fmt.Errorf("ffmpeg: error finding pass logs: %s", err)
+	}
+	for _, path := range matches {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("ffmpeg: error removing pass log: %s", err)
+		}
+	}
+	return nil
+}
+
+// WithFilters returns args with any video filters replaced by filters, or
+// removed if there are none.
+func WithFilters(args []string, filters []string) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-vf" || args[i] == "-filter:v" {
+			i++
+			continue
+		}
+		out = append(out, args[i])
+	}
+	if len(filters) == 0 {
+		return out
+	}
+	return append([]string{"-vf", strings.Join(filters, ",")}, out...)
+}
@@ -0,0 +1,76 @@
+package ffmpeg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateControl_Validate(t *testing.T) {
+	assert.NoError(t, RateControl{}.Validate())
+	assert.NoError(t, RateControl{Mode: ModeABR, VideoBitrate: "2500k"}.Validate())
+	assert.NoError(t, RateControl{Mode: ModeSize, TargetSize: "2GiB", AudioBitrate: "192k"}.Validate())
+	assert.Error(t, RateControl{Mode: ModeABR}.Validate())
+	assert.Error(t, RateControl{Mode: ModeSize}.Validate())
+	assert.Error(t, RateControl{Mode: ModeSize, TargetSize: "big"}.Validate())
+	assert.Error(t, RateControl{Mode: "vbr"}.Validate())
+}
+
+func TestRateControl_Bitrate(t *testing.T) {
+	b, err := RateControl{Mode: ModeABR, VideoBitrate: "2.5M"}.Bitrate(0)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2500000), b)
+
+	// 2GiB over two hours is 2386092 bits per second, less the audio
+	rc := RateControl{Mode: ModeSize, TargetSize: "2GiB", AudioBitrate: "192k"}
+	b, err = rc.Bitrate(2 * time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2386092-192000), b)
+
+	rc.MinVideoBitrate = "500k"
+	b, err = rc.Bitrate(24 * time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(500000), b, "never below the minimum")
+
+	_, err = rc.Bitrate(0)
+	assert.Error(t, err, "size needs the duration")
+
+	_, err = RateControl{Mode: ModeSize, TargetSize: "1MB", AudioBitrate: "192k"}.Bitrate(time.Hour)
+	assert.Error(t, err, "no room for the video")
+}
+
+func TestTwoPassArgs(t *testing.T) {
+	args := []string{"-vf", "yadif=1", "-c:v", "libx264", "-crf", "21", "-c:a", "ac3", "-b:a", "192k"}
+	first, second := TwoPassArgs(args, 2000000, "/tmp/log")
+
+	assert.Equal(t, []string{"-vf", "yadif=1", "-c:v", "libx264", "-c:a", "ac3", "-b:a", "192k",
+		"-b:v", "2000000", "-passlogfile", "/tmp/log", "-pass", "1", "-an", "-sn"}, first)
+	assert.Equal(t, []string{"-vf", "yadif=1", "-c:v", "libx264", "-c:a", "ac3", "-b:a", "192k",
+		"-b:v", "2000000", "-passlogfile", "/tmp/log", "-pass", "2"}, second)
+	assert.Equal(t, "-crf", args[4], "args are left alone")
+}
+
+func TestRemovePassLogs(t *testing.T) {
+	dir := t.TempDir()
+	prefix := filepath.Join(dir, "tvhtc2-passlog-abc")
+	for _, name := range []string{"tvhtc2-passlog-abc-0.log", "tvhtc2-passlog-abc-0.log.mbtree", "other.log"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0600))
+	}
+
+	require.NoError(t, RemovePassLogs(prefix))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "other.log", entries[0].Name())
+}
+
+func TestWithFilters(t *testing.T) {
+	args := []string{"-c:v", "libx264", "-vf", "yadif=1", "-crf", "22"}
+	assert.Equal(t, []string{"-vf", "yadif=1,scale=-2:720", "-c:v", "libx264", "-crf", "22"},
+		WithFilters(args, []string{"yadif=1", "scale=-2:720"}))
+	assert.Equal(t, []string{"-c:v", "libx264", "-crf", "22"}, WithFilters(args, nil))
+}
@@ -0,0 +1,75 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// ValidateArgs checks a profile's ffmpeg arguments, such as
+// transcoding.video_config. They are split on single spaces and passed to
+// ffmpeg between the input and output files without any shell parsing.
+func ValidateArgs(args string) error {
+	if strings.TrimSpace(args) == "" {
+		return fmt.Errorf("ffmpeg: arguments are empty")
+	}
+
+	fields := strings.Split(args, " ")
+	if !strings.HasPrefix(fields[0], "-") {
+		return fmt.Errorf("ffmpeg: arguments must start with an option, not '%s'", fields[0])
+	}
+
+	for _, f := range fields {
+		switch {
+		case f == "":
+			return fmt.Errorf("ffmpeg: arguments contain repeated, leading or trailing spaces, which ffmpeg would see as empty arguments")
+		case strings.ContainsAny(f, `"'`):
+			return fmt.Errorf("ffmpeg: argument %s contains quotes, which are passed to ffmpeg as-is", f)
+		case f == "-i":
+			return fmt.Errorf("ffmpeg: arguments must not include an input, it is added automatically")
+		case f == "-y" || f == "-progress" || f == "-nostats":
+			return fmt.Errorf("ffmpeg: argument %s is added automatically", f)
+		case f == "-pass" || f == "-passlogfile":
+			return fmt.Errorf("ffmpeg: argument %s is added automatically for two-pass rate control", f)
+		}
+	}
+	return nil
+}
+
+// Validate checks that the options are within the ranges the tools accept.
+func (o Options) Validate() error {
+	if o.Nice < -20 || o.Nice > 19 {
+		return fmt.Errorf("ffmpeg: nice %d is out of range -20 to 19", o.Nice)
+	}
+	if o.IOClass < 0 || o.IOClass > 3 {
+		return fmt.Errorf("ffmpeg: ionice class %d is out of range 0 to 3", o.IOClass)
+	}
+	if o.IOLevel < 0 || o.IOLevel > 7 {
+		return fmt.Errorf("ffmpeg: ionice level %d is out of range 0 to 7", o.IOLevel)
+	}
+	if o.Threads < 0 {
+		return fmt.Errorf("ffmpeg: threads must not be negative")
+	}
+	if o.Timeout < 0 || o.StallTimeout < 0 {
+		return fmt.Errorf("ffmpeg: timeouts must not be negative")
+	}
+
+	if o.Cgroup.CPULimit < 0 {
+		return fmt.Errorf("ffmpeg: cgroup cpu limit must not be negative")
+	}
+	if o.Cgroup.MemoryLimit != "" {
+		if _, err := humanize.ParseBytes(o.Cgroup.MemoryLimit); err != nil {
+			return fmt.Errorf("ffmpeg: invalid memory limit '%s': %s", o.Cgroup.MemoryLimit, err)
+		}
+	}
+
+	if o.LoadPause.Above < 0 || o.LoadPause.ResumeBelow < 0 || o.LoadPause.Interval < 0 {
+		return fmt.Errorf("ffmpeg: load pause settings must not be negative")
+	}
+	if o.LoadPause.enabled() && o.LoadPause.ResumeBelow > o.LoadPause.Above {
+		return fmt.Errorf("ffmpeg: load pause resume_below %.2f is above the pause threshold %.2f",
+			o.LoadPause.ResumeBelow, o.LoadPause.Above)
+	}
+	return nil
+}
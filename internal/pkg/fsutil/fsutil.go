@@ -0,0 +1,119 @@
+package fsutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes data to a temporary file in the same directory as path,
+// syncs it to disk and then renames it over path. Readers will only ever see
+// either the previous contents or the new contents, never a partial write.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := writeTemp(path, data, perm)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("fsutil: error renaming %s to %s: %s", tmp, path, err)
+	}
+
+	return SyncDir(filepath.Dir(path))
+}
+
+// ReplaceFileAtomic behaves like WriteFileAtomic, but before the new file is
+// renamed into place the existing file at path (if any) is copied to backup.
+// There is always a file at path, so a crash never leaves only the backup.
+func ReplaceFileAtomic(path, backup string, data []byte, perm os.FileMode) error {
+	tmp, err := writeTemp(path, data, perm)
+	if err != nil {
+		return err
+	}
+
+	if err := copyFileAtomic(path, backup, perm); err != nil && !os.IsNotExist(err) {
+		os.Remove(tmp)
+		return fmt.Errorf("fsutil: error copying %s to %s: %s", path, backup, err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("fsutil: error renaming %s to %s: %s", tmp, path, err)
+	}
+
+	return SyncDir(filepath.Dir(path))
+}
+
+// copyFileAtomic copies the file at src over dst as WriteFileAtomic would.
+// Errors reading src are returned as they are, so callers can check for
+// os.IsNotExist.
+func copyFileAtomic(src, dst string, perm os.FileMode) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := writeTemp(dst, data, perm)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// SyncDir fsyncs the directory at path so that renames within it are durable.
+func SyncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("fsutil: error opening directory %s: %s", path, err)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("fsutil: error syncing directory %s: %s", path, err)
+	}
+	return nil
+}
+
+func writeTemp(path string, data []byte, perm os.FileMode) (string, error) {
+	dir, file := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	f, err := os.CreateTemp(dir, "."+file+".tmp-*")
+	if err != nil {
+		return "", fmt.Errorf("fsutil: error creating temporary file: %s", err)
+	}
+
+	cleanup := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	if _, err := f.Write(data); err != nil {
+		cleanup()
+		return "", fmt.Errorf("fsutil: error writing temporary file: %s", err)
+	}
+
+	if err := f.Chmod(perm); err != nil {
+		cleanup()
+		return "", fmt.Errorf("fsutil: error setting permissions on temporary file: %s", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		cleanup()
+		return "", fmt.Errorf("fsutil: error syncing temporary file: %s", err)
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("fsutil: error closing temporary file: %s", err)
+	}
+
+	return f.Name(), nil
+}
@@ -0,0 +1,33 @@
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplaceFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	backup := path + ".bak"
+
+	require.NoError(t, ReplaceFileAtomic(path, backup, []byte("one"), 0640))
+	assert.NoFileExists(t, backup, "nothing to back up the first time")
+
+	require.NoError(t, ReplaceFileAtomic(path, backup, []byte("two"), 0640))
+	require.NoError(t, ReplaceFileAtomic(path, backup, []byte("three"), 0640))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "three", string(data))
+	data, err = os.ReadFile(backup)
+	require.NoError(t, err)
+	assert.Equal(t, "two", string(data))
+
+	matches, err := filepath.Glob(filepath.Join(dir, ".*"))
+	require.NoError(t, err)
+	assert.Empty(t, matches, "no temporary files are left behind")
+}
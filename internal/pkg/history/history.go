@@ -0,0 +1,178 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/fsutil"
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultRetention = 30 * 24 * time.Hour
+
+// Config says where the history is kept and for how long.
+type Config struct {
+	Path      string
+	Retention time.Duration
+}
+
+// A Record is a recording that has finished processing, successfully or not.
+type Record struct {
+	ID       string        `json:"id"`
+	Finished time.Time     `json:"finished"`
+	Entity   *media.Entity `json:"entity"`
+	Outcome  string        `json:"outcome"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// History keeps finished recordings for a while, so that they can be
+// summarised later. It also remembers when each digest was last sent.
+type History struct {
+	sync.Mutex
+	Records []Record             `json:"records"`
+	Digests map[string]time.Time `json:"digests"`
+
+	path      string
+	retention time.Duration
+}
+
+// Load reads the history at cfg.Path, creating it if it doesn't exist.
+func Load(cfg Config) (*History, error) {
+	path := cfg.Path
+	h := &History{
+		Digests:   make(map[string]time.Time),
+		path:      path,
+		retention: cfg.Retention,
+	}
+
+	rb, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return h, h.save()
+		}
+		return nil, fmt.Errorf("history: error reading history: %s", err)
+	}
+
+	if err := json.Unmarshal(rb, h); err != nil {
+		// The history is only used for summaries, so don't refuse to start
+		log.WithError(err).WithField("path", path).Error("history: history is corrupt, starting afresh")
+		h.Records = nil
+		h.Digests = make(map[string]time.Time)
+		return h, h.save()
+	}
+
+	if h.Digests == nil {
+		h.Digests = make(map[string]time.Time)
+	}
+
+	log.WithField("count", len(h.Records)).Info("history: loaded history from disk")
+	return h, nil
+}
+
+// Update replaces the retention used from now on. The path only takes
+// effect on restart.
+func (h *History) Update(cfg Config) {
+	h.Lock()
+	defer h.Unlock()
+	h.retention = cfg.Retention
+}
+
+func (h *History) save() error {
+	jout, err := json.Marshal(h)
+	if err != nil {
+		return fmt.Errorf("history: error marshalling history: %s", err)
+	}
+
+	if err := fsutil.WriteFileAtomic(h.path, jout, 0640); err != nil {
+		return fmt.Errorf("history: error writing history: %s", err)
+	}
+	return nil
+}
+
+// Add records that entity has finished with outcome, and forgets records
+// older than the retention.
+func (h *History) Add(entity *media.Entity, outcome string) error {
+	h.Lock()
+	defer h.Unlock()
+
+	// ffmpeg's output can be large and isn't useful after the fact
+	e := *entity
+	e.Stats.CommandStdout = nil
+
+	rec := Record{
+		ID:       uuid.New().String(),
+		Finished: time.Now(),
+		Entity:   &e,
+		Outcome:  outcome,
+	}
+	if err := entity.Error(); err != nil {
+		rec.Error = err.Error()
+	}
+
+	retention := h.retention
+	if retention <= 0 {
+		retention = defaultRetention
+	}
+
+	records := h.Records[:0]
+	for _, r := range h.Records {
+		if time.Since(r.Finished) < retention {
+			records = append(records, r)
+		}
+	}
+	h.Records = append(records, rec)
+
+	return h.save()
+}
+
+// Contains reports whether path is the source or destination of a recorded
+// recording.
+func (h *History) Contains(path string) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	for _, r := range h.Records {
+		if r.Entity.Path == path || r.Entity.DestPath == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Between returns the records that finished after from and up to and
+// including to, oldest first.
+func (h *History) Between(from, to time.Time) []Record {
+	h.Lock()
+	defer h.Unlock()
+
+	var records []Record
+	for _, r := range h.Records {
+		if r.Finished.After(from) && !r.Finished.After(to) {
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+// LastDigest returns the end of the period covered by the last digest sent
+// for key, or the zero time if none has been sent.
+func (h *History) LastDigest(key string) time.Time {
+	h.Lock()
+	defer h.Unlock()
+	return h.Digests[key]
+}
+
+// SetDigest records that the digest for key has covered up to t.
+func (h *History) SetDigest(key string, t time.Time) error {
+	h.Lock()
+	defer h.Unlock()
+
+	h.Digests[key] = t
+	return h.save()
+}
@@ -0,0 +1,49 @@
+package history
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory_roundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+	h, err := Load(Config{Path: path})
+	require.NoError(t, err)
+
+	start := time.Now()
+	e := &media.Entity{Details: media.Details{Title: "Vera"}}
+	e.Stats.CommandStdout = []byte("frame=1")
+	e.SetError(errors.New("boom"))
+	require.NoError(t, h.Add(e, "failed"))
+	require.NoError(t, h.SetDigest("ntfy/foo", start))
+
+	h, err = Load(Config{Path: path})
+	require.NoError(t, err)
+
+	records := h.Between(start.Add(-time.Minute), time.Now())
+	require.Len(t, records, 1)
+	assert.Equal(t, "Vera", records[0].Entity.Title)
+	assert.Equal(t, "failed", records[0].Outcome)
+	assert.Equal(t, "boom", records[0].Error)
+	assert.Nil(t, records[0].Entity.Stats.CommandStdout)
+	assert.True(t, start.Equal(h.LastDigest("ntfy/foo")))
+
+	assert.Empty(t, h.Between(time.Now(), time.Now().Add(time.Hour)))
+}
+
+func TestHistory_retention(t *testing.T) {
+	h, err := Load(Config{Path: filepath.Join(t.TempDir(), "history.json"), Retention: time.Hour})
+	require.NoError(t, err)
+
+	h.Records = []Record{{ID: "old", Finished: time.Now().Add(-2 * time.Hour), Entity: &media.Entity{}}}
+	require.NoError(t, h.Add(&media.Entity{}, "success"))
+
+	require.Len(t, h.Records, 1)
+	assert.NotEqual(t, "old", h.Records[0].ID)
+}
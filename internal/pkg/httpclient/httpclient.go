@@ -0,0 +1,49 @@
+package httpclient
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const DefaultTimeout = 30 * time.Second
+
+// Default is used by callers that haven't been given a client. It honours
+// the usual proxy environment variables.
+var Default = &http.Client{Timeout: DefaultTimeout}
+
+// Options configure a client for talking to HTTP services.
+type Options struct {
+	// Timeout limits the whole of each request, zero uses DefaultTimeout.
+	Timeout time.Duration
+	// Proxy is the URL of a proxy for all requests. If empty, the proxy
+	// environment variables are used.
+	Proxy string
+}
+
+// New returns a client configured by opts.
+func New(opts Options) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.Proxy != "" {
+		u, err := url.Parse(opts.Proxy)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("httpclient: invalid proxy URL '%s'", opts.Proxy)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}, nil
+}
+
+// Or returns c, or Default if c is nil.
+func Or(c *http.Client) *http.Client {
+	if c != nil {
+		return c
+	}
+	return Default
+}
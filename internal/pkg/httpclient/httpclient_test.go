@@ -0,0 +1,49 @@
+package httpclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew_proxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+	}))
+	defer proxy.Close()
+
+	c, err := New(Options{Proxy: proxy.URL})
+	require.NoError(t, err)
+	assert.Equal(t, DefaultTimeout, c.Timeout)
+
+	resp, err := c.Get("http://api.example.com/1/messages.json")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "http://api.example.com/1/messages.json", proxied)
+
+	_, err = New(Options{Proxy: "not a url"})
+	assert.Error(t, err)
+}
+
+func TestNew_timeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	c, err := New(Options{Timeout: 10 * time.Millisecond})
+	require.NoError(t, err)
+	_, err = c.Get(srv.URL)
+	assert.Error(t, err)
+}
+
+func TestOr(t *testing.T) {
+	assert.Equal(t, Default, Or(nil))
+	c := &http.Client{}
+	assert.Equal(t, c, Or(c))
+}
@@ -0,0 +1,104 @@
+package media
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/ffmpeg"
+)
+
+// Deinterlace modes.
+const (
+	DeinterlaceAuto   = "auto"
+	DeinterlaceAlways = "always"
+	DeinterlaceNever  = "never"
+)
+
+// Decisions decide how to transcode each video from what ffprobe says
+// about it, in place of only_sd. The video filters are chosen here, so any
+// -vf in the video arguments is replaced.
+type Decisions struct {
+	Enabled bool
+	// Deinterlace is auto, to deinterlace only video ffprobe finds to be
+	// interlaced, always or never.
+	Deinterlace string
+	// DeinterlaceFilter is the filter used to deinterlace, yadif=1 if empty.
+	DeinterlaceFilter string
+	// MaxHeight scales taller video down to this height. Zero never scales.
+	MaxHeight int
+	// MaxFrameRate reduces faster video to this frame rate. Zero never does.
+	MaxFrameRate float64
+	// SkipCodecs are codecs that are left alone when there is nothing else
+	// to do, which only_sd did for h264.
+	SkipCodecs []string
+	// SkipBelowBitrate leaves video at or below this bitrate alone, such as
+	// 3M, when there is nothing else to do. If empty, the bitrate chosen by
+	// two-pass rate control is used.
+	SkipBelowBitrate string
+}
+
+// Validate checks the settings.
+func (d Decisions) Validate() error {
+	switch d.Deinterlace {
+	case "", DeinterlaceAuto, DeinterlaceAlways, DeinterlaceNever:
+	default:
+		return fmt.Errorf("media: unknown deinterlace mode '%s', expected one of %s, %s or %s",
+			d.Deinterlace, DeinterlaceAuto, DeinterlaceAlways, DeinterlaceNever)
+	}
+	if d.MaxHeight < 0 || d.MaxFrameRate < 0 {
+		return fmt.Errorf("media: max_height and max_frame_rate must not be negative")
+	}
+	if d.SkipBelowBitrate != "" {
+		if _, err := ffmpeg.ParseBitrate(d.SkipBelowBitrate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A Decision is how to transcode a video.
+type Decision struct {
+	// Skip leaves the video as it is, for Reason.
+	Skip   bool
+	Reason string
+	// Filters are the video filters to apply, in order.
+	Filters []string
+}
+
+// Decide works out what to do with the video described by info. target is
+// the bitrate the transcode would aim for, or zero if it isn't known.
+func (d Decisions) Decide(info VideoInfo, target uint64) Decision {
+	var dec Decision
+
+	if d.Deinterlace == DeinterlaceAlways || (d.Deinterlace != DeinterlaceNever && info.Interlaced()) {
+		filter := d.DeinterlaceFilter
+		if filter == "" {
+			filter = "yadif=1"
+		}
+		dec.Filters = append(dec.Filters, filter)
+	}
+	if d.MaxHeight > 0 && info.Height > d.MaxHeight {
+		dec.Filters = append(dec.Filters, fmt.Sprintf("scale=-2:%d", d.MaxHeight))
+	}
+	if d.MaxFrameRate > 0 && info.FrameRate > d.MaxFrameRate {
+		dec.Filters = append(dec.Filters, "fps="+strconv.FormatFloat(d.MaxFrameRate, 'f', -1, 64))
+	}
+	if len(dec.Filters) > 0 {
+		return dec
+	}
+
+	for _, codec := range d.SkipCodecs {
+		if strings.EqualFold(codec, info.Codec) {
+			return Decision{Skip: true, Reason: fmt.Sprintf("codec %s is in skip_codecs", info.Codec)}
+		}
+	}
+
+	if threshold, err := ffmpeg.ParseBitrate(d.SkipBelowBitrate); err == nil && threshold > 0 {
+		target = threshold
+	}
+	if target > 0 && info.BitRate > 0 && info.BitRate <= target {
+		return Decision{Skip: true, Reason: fmt.Sprintf("bitrate %d is already at or below %d", info.BitRate, target)}
+	}
+	return dec
+}
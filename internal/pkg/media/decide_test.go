@@ -0,0 +1,56 @@
+package media
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseVideoInfo(t *testing.T) {
+	v, err := parseVideoInfo([]byte(`{
+		"streams": [{"codec_name": "mpeg2video", "width": 720, "height": 576,
+			"field_order": "tt", "r_frame_rate": "25/1", "avg_frame_rate": "25/1"}],
+		"format": {"bit_rate": "4500000"}
+	}`))
+	require.NoError(t, err)
+	assert.Equal(t, VideoInfo{Codec: "mpeg2video", Width: 720, Height: 576, FieldOrder: "tt", FrameRate: 25, BitRate: 4500000}, v)
+	assert.True(t, v.Interlaced())
+
+	_, err = parseVideoInfo([]byte(`{"streams": []}`))
+	assert.Error(t, err)
+
+	assert.InDelta(t, 29.97, parseRate("30000/1001"), 0.01)
+	assert.Zero(t, parseRate("0/0"))
+}
+
+func TestDecisions_Decide(t *testing.T) {
+	d := Decisions{Enabled: true, Deinterlace: DeinterlaceAuto, MaxHeight: 720, SkipCodecs: []string{"hevc"}, SkipBelowBitrate: "3M"}
+	sd := VideoInfo{Codec: "mpeg2video", Height: 576, FieldOrder: "tt", FrameRate: 25, BitRate: 4500000}
+	hd := VideoInfo{Codec: "h264", Height: 1080, FieldOrder: "progressive", FrameRate: 50, BitRate: 8000000}
+
+	assert.Equal(t, []string{"yadif=1"}, d.Decide(sd, 0).Filters, "interlaced")
+	assert.Equal(t, []string{"scale=-2:720"}, d.Decide(hd, 0).Filters, "progressive but too tall")
+
+	sd.FieldOrder = "progressive"
+	dec := d.Decide(sd, 0)
+	assert.False(t, dec.Skip, "above the bitrate threshold")
+	assert.Empty(t, dec.Filters)
+
+	sd.BitRate = 2000000
+	assert.True(t, d.Decide(sd, 0).Skip, "below the bitrate threshold")
+
+	d.SkipBelowBitrate = ""
+	assert.False(t, d.Decide(sd, 0).Skip, "no threshold")
+	assert.True(t, d.Decide(sd, 2500000).Skip, "below the rate control target")
+	assert.True(t, d.Decide(VideoInfo{Codec: "hevc", Height: 720}, 0).Skip, "skipped codec")
+
+	d.Deinterlace = DeinterlaceAlways
+	d.DeinterlaceFilter = "bwdif"
+	d.MaxFrameRate = 25
+	assert.Equal(t, []string{"bwdif", "scale=-2:720", "fps=25"}, d.Decide(hd, 0).Filters)
+
+	assert.NoError(t, d.Validate())
+	assert.Error(t, Decisions{Deinterlace: "sometimes"}.Validate())
+	assert.Error(t, Decisions{SkipBelowBitrate: "fast"}.Validate())
+}
@@ -4,15 +4,15 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
+	"github.com/Xiol/tvhtc2/internal/pkg/ffmpeg"
 	"github.com/Xiol/tvhtc2/internal/pkg/renamer"
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 	"github.com/vansante/go-ffprobe"
 )
 
@@ -29,12 +29,75 @@ type Details struct {
 	Title       string `json:"title"`
 	Status      string `json:"status"`
 	Description string `json:"description"`
+
+	// The rest aren't passed by TVHeadend on the command line, they are
+	// filled in from its API if it is configured.
+	Subtitle string    `json:"subtitle,omitempty"`
+	Season   int       `json:"season,omitempty"`
+	Episode  int       `json:"episode,omitempty"`
+	Genre    []string  `json:"genre,omitempty"`
+	ImageURL string    `json:"image_url,omitempty"`
+	Start    time.Time `json:"start"`
+	Stop     time.Time `json:"stop"`
 }
 
 func (d *Details) Clean() {
 	d.Channel = strings.TrimSpace(d.Channel)
 	d.Title = strings.TrimSpace(d.Title)
 	d.Description = strings.TrimSpace(d.Description)
+	d.Subtitle = strings.TrimSpace(d.Subtitle)
+}
+
+// dateMatcher finds the date TVHeadend adds to recording filenames.
+var dateMatcher = regexp.MustCompile(`\d{4}-\d{2}-\d{2}`)
+
+// DetailsFromPath infers what it can about the recording at path, which is
+// below the recordings directory root. The title is the name of the directory
+// the recording is in, if it isn't root itself, as TVHeadend puts each
+// programme in its own directory. Otherwise it is the filename without the
+// date TVHeadend appends.
+func DetailsFromPath(root, path string) Details {
+	d := Details{Path: path}
+
+	if dir := filepath.Dir(path); filepath.Clean(dir) != filepath.Clean(root) {
+		d.Title = filepath.Base(dir)
+	} else {
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		if loc := dateMatcher.FindStringIndex(name); loc != nil && loc[0] > 0 {
+			name = name[:loc[0]]
+		}
+		d.Title = strings.Trim(name, " -_.")
+	}
+	d.Title = strings.Replace(d.Title, "_", " ", -1)
+
+	d.Clean()
+	return d
+}
+
+// Config controls how an Entity is transcoded and renamed. An Entity keeps
+// the Config it was created with, so a configuration change never affects a
+// transcode that is already underway.
+type Config struct {
+	// KeepOriginals leaves the original recording in place after transcoding.
+	KeepOriginals bool
+	// OnlySD skips transcoding media that is already H.264. It is ignored
+	// when Decisions are enabled.
+	OnlySD bool
+	// VideoArgs and AudioArgs are the ffmpeg output arguments for each
+	// kind of media.
+	VideoArgs string
+	AudioArgs string
+	// Rename moves the transcoded file to the name chosen by Renamer.
+	Rename   bool
+	Renamer  renamer.Config
+	FFmpeg   ffmpeg.Options
+	Timeouts ffmpeg.Timeouts
+	// RateControl can replace the rate options in VideoArgs with a two-pass
+	// encode.
+	RateControl ffmpeg.RateControl
+	// Decisions choose the video filters, and whether to transcode at all,
+	// from the properties of each recording.
+	Decisions Decisions
 }
 
 type Type int
@@ -46,21 +109,38 @@ const (
 	MEDIA_UNKNOWN
 )
 
+func (t Type) String() string {
+	switch t {
+	case MEDIA_VIDEO:
+		return "video"
+	case MEDIA_H264_VIDEO:
+		return "h264"
+	case MEDIA_AUDIO:
+		return "audio"
+	default:
+		return "unknown"
+	}
+}
+
 type Entity struct {
 	Details
 	DestPath         string `json:"dest_path"`
 	Media            Type   `json:"type"`
 	Stats            Stats  `json:"stats"`
 	TranscodeSuccess bool   `json:"transcode_success"`
-
-	renamer       renamer.Renamer
-	skipTranscode bool
-	basename      string
-	tmpfile       string
-	err           error
+	Quarantined      bool   `json:"quarantined"`
+
+	config         Config
+	renamer        renamer.Renamer
+	sourceDuration time.Duration
+	skipTranscode  bool
+	filters        []string
+	basename       string
+	tmpfile        string
+	err            error
 }
 
-func NewEntity(details Details) (*Entity, error) {
+func NewEntity(details Details, config Config) (*Entity, error) {
 	if details.Path == "" {
 		return nil, fmt.Errorf("media: path must not be empty")
 	}
@@ -70,7 +150,8 @@ func NewEntity(details Details) (*Entity, error) {
 		Details:  details,
 		Stats:    Stats{},
 		DestPath: details.Path,
-		renamer:  renamer.NewRenamer(),
+		config:   config,
+		renamer:  renamer.NewRenamer(config.Renamer),
 	}
 	e.basename = filepath.Base(e.Details.Path)
 
@@ -97,6 +178,10 @@ func (e *Entity) detectMediaType() error {
 		return fmt.Errorf("media: error getting probe data: %s", err)
 	}
 
+	if data.Format != nil {
+		e.sourceDuration = data.Format.Duration()
+	}
+
 	vidStream := data.GetFirstVideoStream()
 	if vidStream == nil {
 		audioStream := data.GetFirstAudioStream()
@@ -109,6 +194,37 @@ func (e *Entity) detectMediaType() error {
 	return e.detectVideo(vidStream)
 }
 
+// ProbeDuration returns the duration of the media at path as reported by ffprobe.
+func ProbeDuration(path string) (time.Duration, error) {
+	data, err := ffprobe.GetProbeData(path, 3*time.Second)
+	if err != nil {
+		return 0, fmt.Errorf("media: error getting probe data: %s", err)
+	}
+	if data.Format == nil {
+		return 0, fmt.Errorf("media: probe data has no format information")
+	}
+	return data.Format.Duration(), nil
+}
+
+// NeedsTranscode probes the media at path and reports whether it is in a
+// format that would be transcoded, which is video that isn't H.264 or audio
+// that isn't MP3. This is what recordings look like before they have been
+// processed.
+func NeedsTranscode(path string) (bool, error) {
+	data, err := ffprobe.GetProbeData(path, 3*time.Second)
+	if err != nil {
+		return false, fmt.Errorf("media: error getting probe data: %s", err)
+	}
+
+	if stream := data.GetFirstVideoStream(); stream != nil {
+		return stream.CodecName != "h264", nil
+	}
+	if stream := data.GetFirstAudioStream(); stream != nil {
+		return stream.CodecName != "mp3", nil
+	}
+	return false, fmt.Errorf("media: found no audio or video streams in file")
+}
+
 func (e *Entity) detectAudioOnly(stream *ffprobe.Stream) error {
 	log.WithFields(log.Fields{
 		"codec":    stream.CodecName,
@@ -135,16 +251,61 @@ func (e *Entity) detectVideo(stream *ffprobe.Stream) error {
 	switch stream.CodecName {
 	case "h264":
 		e.Media = MEDIA_H264_VIDEO
-		if viper.GetBool("transcoding.only_sd") {
+		if e.config.OnlySD && !e.config.Decisions.Enabled {
 			log.Info("media: skipping transcode, only_sd is set")
 			e.skipTranscode = true
 		}
 	default:
 		e.Media = MEDIA_VIDEO
 	}
+
+	if e.config.Decisions.Enabled {
+		e.decide()
+	}
 	return nil
 }
 
+// decide probes the video and decides how to transcode it. If it can't be
+// probed, it is transcoded without any filters.
+func (e *Entity) decide() {
+	info, err := ProbeVideo(e.Path)
+	if err != nil {
+		log.WithError(err).WithField("filename", e.basename).Warning("media: unable to probe video, transcoding without filters")
+		return
+	}
+
+	var target uint64
+	if rc := e.config.RateControl; rc.TwoPass() {
+		if target, err = rc.Bitrate(e.sourceDuration); err != nil {
+			log.WithError(err).Debug("media: unable to work out the target bitrate")
+		}
+	}
+
+	d := e.config.Decisions.Decide(info, target)
+	log.WithFields(log.Fields{
+		"filename":    e.basename,
+		"height":      info.Height,
+		"field_order": info.FieldOrder,
+		"frame_rate":  info.FrameRate,
+		"bit_rate":    info.BitRate,
+		"filters":     d.Filters,
+		"skip":        d.Skip,
+		"reason":      d.Reason,
+	}).Info("media: decided how to transcode video")
+
+	e.skipTranscode = d.Skip
+	e.filters = d.Filters
+}
+
+// tempFileMatcher matches the names given to files while they are transcoded.
+var tempFileMatcher = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}(\.[^.]+)?$`)
+
+// IsTempFile reports whether name is that of a file being transcoded, or
+// left behind by a transcode that never finished.
+func IsTempFile(name string) bool {
+	return tempFileMatcher.MatchString(name)
+}
+
 func (e *Entity) tempFilename() {
 	dir := filepath.Dir(e.Path)
 	var ext string
@@ -162,14 +323,59 @@ func (e *Entity) tempFilename() {
 	log.WithField("path", e.tmpfile).Debug("media: temporary path for encoding media")
 }
 
+// profile returns the name of the transcoding profile used for this media.
+func (e *Entity) profile() string {
+	if e.Media == MEDIA_AUDIO {
+		return "audio"
+	}
+	return "video"
+}
+
+// passes returns the ffmpeg arguments for each pass of the transcode, and
+// the prefix of the pass log files if there is more than one.
+func (e *Entity) passes(opts ffmpeg.Options) ([][]string, string, error) {
+	input := []string{"-i", e.Path}
+	output := append(opts.OutputArgs(), "-y", e.tmpfile)
+
+	rc := e.config.RateControl
+	if e.profile() != "video" || !rc.TwoPass() {
+		return [][]string{concat(input, e.ffmpegArgs(), output)}, "", nil
+	}
+
+	bitrate, err := rc.Bitrate(e.sourceDuration)
+	if err != nil {
+		return nil, "", fmt.Errorf("media: %s", err)
+	}
+	log.WithFields(log.Fields{
+		"mode":    rc.Mode,
+		"bitrate": bitrate,
+	}).Info("media: encoding in two passes")
+
+	passlog := ffmpeg.PassLog(strings.TrimSuffix(filepath.Base(e.tmpfile), filepath.Ext(e.tmpfile)))
+	first, second := ffmpeg.TwoPassArgs(e.ffmpegArgs(), bitrate, passlog)
+	return [][]string{
+		concat(input, first, opts.OutputArgs(), []string{"-y"}, ffmpeg.NullOutput()),
+		concat(input, second, output),
+	}, passlog, nil
+}
+
+func concat(slices ...[]string) []string {
+	var all []string
+	for _, s := range slices {
+		all = append(all, s...)
+	}
+	return all
+}
+
 func (e *Entity) ffmpegArgs() []string {
-	var args string
 	if e.Media == MEDIA_VIDEO || e.Media == MEDIA_H264_VIDEO {
-		args = viper.GetString("transcoding.video_config")
-	} else {
-		args = viper.GetString("transcoding.audio_config")
+		args := strings.Split(e.config.VideoArgs, " ")
+		if e.config.Decisions.Enabled {
+			args = ffmpeg.WithFilters(args, e.filters)
+		}
+		return args
 	}
-	return strings.Split(args, " ")
+	return strings.Split(e.config.AudioArgs, " ")
 }
 
 func (e *Entity) rename() error {
@@ -184,7 +390,7 @@ func (e *Entity) rename() error {
 		src = e.Path
 	}
 
-	if !viper.GetBool("rename.enabled") {
+	if !e.config.Rename {
 		log.Debug("rename is not enabled, not perfoming full renaming")
 		os.Rename(src, e.DestPath)
 		return nil
@@ -216,7 +422,7 @@ func (e *Entity) cleanup() error {
 	// If we're not doing renames, and the media is a video, then we'll have nothing
 	// to clean up, return early. If we've skipped transcoding but we're doing renames,
 	// then we'll also have nothing to cleanup, as the file will have been moved.
-	rename := viper.GetBool("rename.enabled")
+	rename := e.config.Rename
 	if (!rename && e.Media != MEDIA_AUDIO) || (rename && e.skipTranscode) {
 		return e.cleanDir()
 	}
@@ -305,7 +511,7 @@ func (e *Entity) Transcode() error {
 		return fmt.Errorf("media: error renaming file at %s: %s", e.Path, err)
 	}
 
-	if !viper.GetBool("transcoding.keep_originals") {
+	if !e.config.KeepOriginals {
 		if err := e.cleanup(); err != nil {
 			log.WithField("error", err).Errorf("media: error cleaning up unneeded files")
 		}
@@ -322,23 +528,46 @@ func (e *Entity) doTranscode() error {
 		return nil
 	}
 
-	args := make([]string, 2)
-	args[0] = "-i"
-	args[1] = e.Path
-	args = append(args, e.ffmpegArgs()...)
-	args = append(args, []string{"-y", e.tmpfile}...)
-
-	log.WithFields(log.Fields{
-		"src_path":    e.Path,
-		"tmp_path":    e.tmpfile,
-		"ffmpeg_args": args,
-	}).Info("media: transcoding file")
+	opts := e.config.FFmpeg
+	opts.Timeout = e.config.Timeouts.For(e.profile(), e.sourceDuration)
 
-	cmd := exec.Command("ffmpeg", args...)
+	passes, passlog, err := e.passes(opts)
+	if err != nil {
+		return err
+	}
+	if passlog != "" {
+		// Whether the passes finish, fail or are cancelled
+		defer func() {
+			if err := ffmpeg.RemovePassLogs(passlog); err != nil {
+				log.WithError(err).Warning("media: error removing pass logs")
+			}
+		}()
+	}
 
-	var err error
 	start := time.Now()
-	e.Stats.CommandStdout, err = cmd.CombinedOutput()
+	for i, args := range passes {
+		passOpts := opts
+		if progress := opts.Progress; progress != nil && len(passes) > 1 {
+			// Report progress through all of the passes, not each one
+			done := time.Duration(i) * e.sourceDuration
+			passOpts.Progress = func(outTime time.Duration) {
+				progress((done + outTime) / time.Duration(len(passes)))
+			}
+		}
+
+		log.WithFields(log.Fields{
+			"src_path":    e.Path,
+			"tmp_path":    e.tmpfile,
+			"ffmpeg_args": args,
+			"pass":        i + 1,
+			"passes":      len(passes),
+		}).Info("media: transcoding file")
+
+		e.Stats.CommandStdout, err = ffmpeg.Run(args, passOpts)
+		if err != nil {
+			break
+		}
+	}
 	e.Stats.Duration = time.Now().Sub(start)
 	e.Stats.EndSizeBytes = e.getSizeBytes(e.tmpfile)
 
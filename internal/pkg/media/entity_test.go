@@ -0,0 +1,23 @@
+package media
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetailsFromPath(t *testing.T) {
+	tests := map[string]string{
+		"/dvr/Vera/Vera2020-01-0121-00.ts":         "Vera",
+		"/dvr/Vera2020-01-0121-00.ts":              "Vera",
+		"/dvr/Would_I_Lie_to_You-2020-01-01.ts":    "Would I Lie to You",
+		"/dvr/The Sky at Night.mkv":                "The Sky at Night",
+		"/dvr/Dragons' Den/Dragons' Den - 2020.ts": "Dragons' Den",
+		"/dvr/2020-01-01 Unknown.ts":               "2020-01-01 Unknown",
+	}
+	for path, title := range tests {
+		d := DetailsFromPath("/dvr", path)
+		assert.Equal(t, path, d.Path)
+		assert.Equal(t, title, d.Title, path)
+	}
+}
@@ -0,0 +1,114 @@
+package media
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// probeTimeout limits how long ffprobe may take to describe a video.
+const probeTimeout = 10 * time.Second
+
+// VideoInfo describes the first video stream of a recording.
+type VideoInfo struct {
+	Codec  string
+	Width  int
+	Height int
+	// FieldOrder is progressive, or the order of the fields of interlaced
+	// video, such as tt or bb. It may be empty or unknown.
+	FieldOrder string
+	FrameRate  float64
+	// BitRate is that of the video stream in bits per second. MPEG-TS
+	// recordings rarely say, so it falls back to the bitrate of the whole
+	// recording. Zero if neither is known.
+	BitRate uint64
+}
+
+// Interlaced reports whether ffprobe found the video to be interlaced.
+func (v VideoInfo) Interlaced() bool {
+	switch v.FieldOrder {
+	case "tt", "bb", "tb", "bt":
+		return true
+	}
+	return false
+}
+
+// ProbeVideo describes the first video stream of the recording at path.
+// The ffprobe library doesn't report the field order, so this runs ffprobe
+// itself.
+func ProbeVideo(path string) (VideoInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-of", "json",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=codec_name,width,height,field_order,r_frame_rate,avg_frame_rate,bit_rate:format=bit_rate",
+		path).Output()
+	if err != nil {
+		return VideoInfo{}, fmt.Errorf("media: error probing video: %s", err)
+	}
+	return parseVideoInfo(out)
+}
+
+type probeOutput struct {
+	Streams []struct {
+		CodecName    string `json:"codec_name"`
+		Width        int    `json:"width"`
+		Height       int    `json:"height"`
+		FieldOrder   string `json:"field_order"`
+		RFrameRate   string `json:"r_frame_rate"`
+		AvgFrameRate string `json:"avg_frame_rate"`
+		BitRate      string `json:"bit_rate"`
+	} `json:"streams"`
+	Format struct {
+		BitRate string `json:"bit_rate"`
+	} `json:"format"`
+}
+
+func parseVideoInfo(data []byte) (VideoInfo, error) {
+	var out probeOutput
+	if err := json.Unmarshal(data, &out); err != nil {
+		return VideoInfo{}, fmt.Errorf("media: error parsing probe output: %s", err)
+	}
+	if len(out.Streams) == 0 {
+		return VideoInfo{}, fmt.Errorf("media: found no video stream")
+	}
+
+	s := out.Streams[0]
+	v := VideoInfo{
+		Codec:      s.CodecName,
+		Width:      s.Width,
+		Height:     s.Height,
+		FieldOrder: s.FieldOrder,
+		FrameRate:  parseRate(s.AvgFrameRate),
+	}
+	if v.FrameRate == 0 {
+		v.FrameRate = parseRate(s.RFrameRate)
+	}
+	if v.BitRate, _ = strconv.ParseUint(s.BitRate, 10, 64); v.BitRate == 0 {
+		v.BitRate, _ = strconv.ParseUint(out.Format.BitRate, 10, 64)
+	}
+	return v, nil
+}
+
+// parseRate parses a frame rate such as 25/1 or 30000/1001. Zero if it
+// can't be parsed.
+func parseRate(rate string) float64 {
+	num, den, ok := strings.Cut(rate, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	if !ok {
+		return n
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
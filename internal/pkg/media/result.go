@@ -0,0 +1,66 @@
+package media
+
+import (
+	"errors"
+	"time"
+)
+
+// A Result is what became of an Entity, as reported to the coordinator by
+// a worker that transcoded it on another machine.
+type Result struct {
+	DestPath         string `json:"dest_path"`
+	Media            Type   `json:"type"`
+	Stats            Stats  `json:"stats"`
+	TranscodeSuccess bool   `json:"transcode_success"`
+	Skipped          bool   `json:"skipped"`
+	Error            string `json:"error,omitempty"`
+}
+
+// Result returns what became of the entity.
+func (e *Entity) Result() Result {
+	r := Result{
+		DestPath:         e.DestPath,
+		Media:            e.Media,
+		Stats:            e.Stats,
+		TranscodeSuccess: e.TranscodeSuccess,
+		Skipped:          e.skipTranscode,
+	}
+	if e.err != nil {
+		r.Error = e.err.Error()
+	}
+	return r
+}
+
+// FromResult recreates the entity for details that a worker reported r
+// for, so it can be recorded and notified as if it had been transcoded
+// locally.
+func FromResult(details Details, r Result) *Entity {
+	e := &Entity{
+		Details:          details,
+		DestPath:         r.DestPath,
+		Media:            r.Media,
+		Stats:            r.Stats,
+		TranscodeSuccess: r.TranscodeSuccess,
+		skipTranscode:    r.Skipped,
+	}
+	if r.Error != "" {
+		e.err = errors.New(r.Error)
+	}
+	return e
+}
+
+// OnProgress calls fn with the fraction of the recording that has been
+// transcoded, each time ffmpeg reports its progress.
+func (e *Entity) OnProgress(fn func(done float64)) {
+	e.config.FFmpeg.Progress = func(outTime time.Duration) {
+		if e.sourceDuration > 0 {
+			fn(float64(outTime) / float64(e.sourceDuration))
+		}
+	}
+}
+
+// CancelOn stops the transcode when cancel is closed, leaving the original
+// recording untouched.
+func (e *Entity) CancelOn(cancel <-chan struct{}) {
+	e.config.FFmpeg.Cancel = cancel
+}
@@ -0,0 +1,56 @@
+package media
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/ffmpeg"
+	log "github.com/sirupsen/logrus"
+)
+
+const thumbnailTimeout = time.Minute
+
+// Thumbnail extracts a JPEG frame from a third of the way into the video at
+// path, scaled to width pixels wide, running ffmpeg with opts.
+func Thumbnail(path string, width int, opts ffmpeg.Options) ([]byte, error) {
+	var offset time.Duration
+	if d, err := ProbeDuration(path); err == nil {
+		offset = d / 3
+	} else {
+		log.WithError(err).WithField("path", path).Debug("media: unable to probe duration for thumbnail, using first frame")
+	}
+
+	tmp, err := ioutil.TempFile("", "tvhtc2-thumbnail-*.jpg")
+	if err != nil {
+		return nil, fmt.Errorf("media: error creating thumbnail file: %s", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	args := []string{
+		"-y",
+		"-ss", strconv.FormatFloat(offset.Seconds(), 'f', 3, 64),
+		"-i", path,
+		"-frames:v", "1",
+		"-vf", fmt.Sprintf("scale=%d:-2", width),
+		"-q:v", "5",
+		tmp.Name(),
+	}
+
+	opts.Timeout = thumbnailTimeout
+	if _, err := ffmpeg.Run(args, opts); err != nil {
+		return nil, fmt.Errorf("media: error extracting thumbnail: %s", err)
+	}
+
+	img, err := ioutil.ReadFile(tmp.Name())
+	if err != nil {
+		return nil, fmt.Errorf("media: error reading thumbnail: %s", err)
+	}
+	if len(img) == 0 {
+		return nil, fmt.Errorf("media: ffmpeg produced an empty thumbnail")
+	}
+	return img, nil
+}
@@ -0,0 +1,327 @@
+package notify
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/httpclient"
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/Xiol/tvhtc2/internal/pkg/notify/email"
+	"github.com/Xiol/tvhtc2/internal/pkg/notify/gotify"
+	"github.com/Xiol/tvhtc2/internal/pkg/notify/matrix"
+	"github.com/Xiol/tvhtc2/internal/pkg/notify/ntfy"
+	"github.com/Xiol/tvhtc2/internal/pkg/notify/pushover"
+	"github.com/Xiol/tvhtc2/internal/pkg/notify/telegram"
+	"github.com/Xiol/tvhtc2/internal/pkg/notify/webhook"
+	log "github.com/sirupsen/logrus"
+)
+
+// thumbnailFunc extracts thumbnails, replaced in tests.
+var thumbnailFunc = media.Thumbnail
+
+// Content is a rendered notification, ready to be handed to a backend.
+type Content struct {
+	Subject string
+	Body    string
+	// Priority uses the Pushover scale from -2 (lowest) to 2 (emergency).
+	// Backends with their own scale map it onto theirs.
+	Priority pushover.Priority
+	Entity   *media.Entity
+	// ID identifies the outbox entry being delivered, so anything prepared
+	// for an earlier attempt at it can be reused.
+	ID string
+}
+
+// A BackendFunc creates a Notifier that delivers c to a recipient configured
+// under notifications.<backend>.
+type BackendFunc func(recipient Config, c Content) (Notifier, error)
+
+var builtinBackends = []string{"pushover", "webhook", "email", "ntfy", "gotify", "telegram", "matrix"}
+
+// Backends returns the names of the built in notification backends.
+func Backends() []string {
+	return append([]string(nil), builtinBackends...)
+}
+
+var gotifyPriorities = map[pushover.Priority]int{
+	pushover.PriorityNoNotification:      0,
+	pushover.PrioritySilent:              2,
+	pushover.PriorityNormal:              5,
+	pushover.PriorityHighPriority:        8,
+	pushover.PriorityRequireConfirmation: 10,
+}
+
+func (h *Handler) defaultBackends() map[string]BackendFunc {
+	return map[string]BackendFunc{
+		"pushover": h.newPushover,
+		"webhook":  h.newWebhook,
+		"email":    newEmail,
+		"ntfy":     h.newNtfy,
+		"gotify":   h.newGotify,
+		"telegram": h.newTelegram,
+		"matrix":   h.newMatrix,
+	}
+}
+
+// httpClients creates the HTTP client for each built in backend, configured
+// by the backend's timeout and proxy settings, falling back to settings.HTTP.
+func httpClients(settings Settings) (map[string]*http.Client, error) {
+	clients := make(map[string]*http.Client)
+	for _, backend := range builtinBackends {
+		if backend == "email" {
+			continue
+		}
+
+		c, err := httpclient.New(settings.httpOptions(backend))
+		if err != nil {
+			return nil, fmt.Errorf("notify: %s: %s", backend, err)
+		}
+		clients[backend] = c
+	}
+	return clients, nil
+}
+
+const defaultThumbnailWidth = 640
+
+// pushoverState holds what Pushover notifications keep between attempts,
+// shared by copies of a Handler.
+type pushoverState struct {
+	sync.Mutex
+	// thumbnails holds the attachment made for each outbox entry, nil if
+	// there couldn't be one, until the entry leaves the outbox
+	thumbnails map[string]*pushover.Attachment
+	// receipts holds the emergency priority messages being watched
+	receipts map[string]bool
+}
+
+func newPushoverState() *pushoverState {
+	return &pushoverState{
+		thumbnails: make(map[string]*pushover.Attachment),
+		receipts:   make(map[string]bool),
+	}
+}
+
+func (h *Handler) newPushover(r Config, c Content) (Notifier, error) {
+	m := pushover.NewMessage(r.Option("pushover", "api_url"), r.Option("pushover", "app_token"), r.Key, c.Subject, c.Body)
+	m.Client = h.client("pushover")
+	m.Priority = c.Priority
+	m.Sound = r.Option("pushover", "sound")
+	m.Device = r.Option("pushover", "device")
+
+	var err error
+	if m.HTML, err = r.BoolOption("pushover", "html"); err != nil {
+		return nil, err
+	}
+	if m.Retry, err = r.DurationOption("pushover", "retry", m.Retry); err != nil {
+		return nil, err
+	}
+	if m.Expire, err = r.DurationOption("pushover", "expire", m.Expire); err != nil {
+		return nil, err
+	}
+	if m.ReceiptInterval, err = r.DurationOption("pushover", "receipt_interval", time.Minute); err != nil {
+		return nil, err
+	}
+	m.OnReceipt = func(receipt string) {
+		h.watchReceipt(m, receipt)
+	}
+
+	if m.URL, err = optionTemplate(r, "pushover", "url", c.Entity); err != nil {
+		return nil, err
+	}
+	if m.URLTitle, err = optionTemplate(r, "pushover", "url_title", c.Entity); err != nil {
+		return nil, err
+	}
+
+	thumbnail, err := r.BoolOption("pushover", "thumbnail")
+	if err != nil {
+		return nil, err
+	}
+	if thumbnail {
+		m.Attachment = h.thumbnail(r, c)
+	}
+	return m, nil
+}
+
+// watchReceipt logs the outcome of an emergency priority message in the
+// background until the handler is closed. Each receipt is only watched once.
+func (h *Handler) watchReceipt(m pushover.Message, receipt string) {
+	s := h.pushover
+	s.Lock()
+	defer s.Unlock()
+	if s.receipts[receipt] {
+		return
+	}
+	s.receipts[receipt] = true
+
+	go func() {
+		m.WatchReceipt(receipt, h.closeCh)
+		s.Lock()
+		delete(s.receipts, receipt)
+		s.Unlock()
+	}()
+}
+
+// thumbnail returns the thumbnail for the outbox entry being delivered,
+// making it on the first attempt only.
+func (h *Handler) thumbnail(r Config, c Content) *pushover.Attachment {
+	if c.ID == "" {
+		return h.thumbnailFor(r, c.Entity)
+	}
+
+	s := h.pushover
+	s.Lock()
+	a, ok := s.thumbnails[c.ID]
+	s.Unlock()
+	if ok {
+		return a
+	}
+
+	a = h.thumbnailFor(r, c.Entity)
+	s.Lock()
+	s.thumbnails[c.ID] = a
+	s.Unlock()
+	return a
+}
+
+// forget drops anything kept for the outbox entry with id once it has left
+// the outbox.
+func (h *Handler) forget(id string) {
+	h.pushover.Lock()
+	defer h.pushover.Unlock()
+	delete(h.pushover.thumbnails, id)
+}
+
+// optionTemplate returns the recipient's setting for key executed as a
+// template against entity. Digests have no entity, so only settings without
+// any template actions are used for them.
+func optionTemplate(r Config, backend, key string, entity *media.Entity) (string, error) {
+	text := r.Option(backend, key)
+	if entity == nil {
+		if strings.Contains(text, "{{") {
+			return "", nil
+		}
+		return text, nil
+	}
+
+	out, err := execute(backend+"/"+key, text, TemplateData{Entity: entity, Outcome: OutcomeOf(entity)})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// thumbnailFor returns a frame of the recording to attach to a notification,
+// or nil if there isn't one. Thumbnails are a nicety, so failing to create
+// one never stops a notification being sent.
+func (h *Handler) thumbnailFor(r Config, entity *media.Entity) *pushover.Attachment {
+	if entity == nil || entity.Media == media.MEDIA_AUDIO || entity.Media == media.MEDIA_UNKNOWN {
+		return nil
+	}
+
+	// The source is usually removed after a successful transcode
+	path := entity.DestPath
+	if _, err := os.Stat(path); err != nil {
+		path = entity.Path
+	}
+
+	width, err := strconv.Atoi(r.Option("pushover", "thumbnail_width"))
+	if err != nil || width <= 0 {
+		width = defaultThumbnailWidth
+	}
+
+	img, err := thumbnailFunc(path, width, h.settings().FFmpeg)
+	if err != nil {
+		log.WithError(err).WithField("path", path).Warning("notify: unable to create thumbnail, sending without")
+		return nil
+	}
+	if len(img) > pushover.MaxAttachmentBytes {
+		log.WithField("bytes", len(img)).Warning("notify: thumbnail is too large for Pushover, sending without")
+		return nil
+	}
+	return &pushover.Attachment{Name: "thumbnail.jpg", ContentType: "image/jpeg", Data: img}
+}
+
+func (h *Handler) newWebhook(r Config, c Content) (Notifier, error) {
+	url := r.Option("webhook", "url")
+	if url == "" {
+		return nil, fmt.Errorf("notify: webhook recipient '%s' has no url", r.Name)
+	}
+	// Digests aren't about a single recording, so have no data
+	var data interface{}
+	if c.Entity != nil {
+		data = c.Entity
+	}
+	m := webhook.NewMessage(url, r.StringMap("webhook", "headers"), c.Subject, c.Body, data)
+	m.Client = h.client("webhook")
+	return m, nil
+}
+
+func newEmail(r Config, c Content) (Notifier, error) {
+	var port int
+	if p := r.Option("email", "port"); p != "" {
+		var err error
+		if port, err = strconv.Atoi(p); err != nil {
+			return nil, fmt.Errorf("notify: invalid email port '%s': %s", p, err)
+		}
+	}
+
+	server := email.Server{
+		Host:     r.Option("email", "host"),
+		Port:     port,
+		Username: r.Option("email", "username"),
+		Password: r.Option("email", "password"),
+		From:     r.Option("email", "from"),
+	}
+	to := r.Option("email", "address")
+	if to == "" {
+		return nil, fmt.Errorf("notify: email recipient '%s' has no address", r.Name)
+	}
+	return email.NewMessage(server, to, c.Subject, c.Body), nil
+}
+
+func (h *Handler) newNtfy(r Config, c Content) (Notifier, error) {
+	topic := r.Option("ntfy", "topic")
+	if topic == "" {
+		return nil, fmt.Errorf("notify: ntfy recipient '%s' has no topic", r.Name)
+	}
+	m := ntfy.NewMessage(r.Option("ntfy", "server"), topic, r.Option("ntfy", "token"), c.Subject, c.Body)
+	// ntfy priorities run from 1 (min) to 5 (max), with 3 the default
+	m.Priority = int(c.Priority) + 3
+	m.Client = h.client("ntfy")
+	return m, nil
+}
+
+func (h *Handler) newGotify(r Config, c Content) (Notifier, error) {
+	m := gotify.NewMessage(r.Option("gotify", "server"), r.Option("gotify", "token"), c.Subject, c.Body)
+	// Gotify priorities run from 0 to 10, with 5 the default
+	m.Priority = gotifyPriorities[c.Priority]
+	m.Client = h.client("gotify")
+	return m, nil
+}
+
+func (h *Handler) newTelegram(r Config, c Content) (Notifier, error) {
+	chatID := r.Option("telegram", "chat_id")
+	if chatID == "" {
+		return nil, fmt.Errorf("notify: telegram recipient '%s' has no chat_id", r.Name)
+	}
+	m := telegram.NewMessage(r.Option("telegram", "api_url"), r.Option("telegram", "bot_token"),
+		chatID, c.Subject, c.Body)
+	m.Client = h.client("telegram")
+	return m, nil
+}
+
+func (h *Handler) newMatrix(r Config, c Content) (Notifier, error) {
+	roomID := r.Option("matrix", "room_id")
+	if roomID == "" {
+		return nil, fmt.Errorf("notify: matrix recipient '%s' has no room_id", r.Name)
+	}
+	m := matrix.NewMessage(r.Option("matrix", "homeserver"), r.Option("matrix", "access_token"),
+		roomID, c.Subject, c.Body)
+	m.Client = h.client("matrix")
+	return m, nil
+}
@@ -0,0 +1,184 @@
+package notify
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/ffmpeg"
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/Xiol/tvhtc2/internal/pkg/notify/pushover"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler_newPushover(t *testing.T) {
+	thumbnails := 0
+	thumbnailFunc = func(path string, width int, opts ffmpeg.Options) ([]byte, error) {
+		thumbnails++
+		assert.Equal(t, 320, width)
+		assert.Equal(t, 10, opts.Nice)
+		if path == "/missing.ts" {
+			return nil, errors.New("no such file")
+		}
+		return []byte("jpeg"), nil
+	}
+	defer func() { thumbnailFunc = media.Thumbnail }()
+
+	h := &Handler{current: &current{settings: Settings{FFmpeg: ffmpeg.Options{Nice: 10}}}, pushover: newPushoverState()}
+	r := Config{Name: "foo", Key: "userkey", shared: map[string]map[string]interface{}{"pushover": {"thumbnail_width": 320}}, Options: map[string]interface{}{
+		"url":       "https://jellyfin.example.com/search?q={{ .Title }}",
+		"url_title": "Watch {{ .Title }}",
+		"sound":     "magic",
+		"html":      true,
+		"thumbnail": true,
+		"retry":     "2m",
+	}}
+
+	e := entity("Vera")
+	n, err := h.newPushover(r, Content{Subject: "s", Body: "b", Priority: pushover.PriorityRequireConfirmation, Entity: e})
+	require.NoError(t, err)
+	m := n.(pushover.Message)
+	assert.Equal(t, "https://jellyfin.example.com/search?q=Vera", m.URL)
+	assert.Equal(t, "Watch Vera", m.URLTitle)
+	assert.Equal(t, "magic", m.Sound)
+	assert.True(t, m.HTML)
+	assert.Equal(t, pushover.PriorityRequireConfirmation, m.Priority)
+	assert.Equal(t, 2*time.Minute, m.Retry)
+	assert.Equal(t, time.Hour, m.Expire)
+	require.NotNil(t, m.Attachment)
+	assert.Equal(t, []byte("jpeg"), m.Attachment.Data)
+
+	// Thumbnails are best effort
+	e.Path, e.DestPath = "/missing.ts", "/missing.ts"
+	n, err = h.newPushover(r, Content{Entity: e})
+	require.NoError(t, err)
+	assert.Nil(t, n.(pushover.Message).Attachment)
+
+	// Digests have no recording for templates or thumbnails
+	n, err = h.newPushover(r, Content{Subject: "digest"})
+	require.NoError(t, err)
+	assert.Empty(t, n.(pushover.Message).URL)
+	assert.Nil(t, n.(pushover.Message).Attachment)
+	assert.Equal(t, 2, thumbnails)
+
+	// Thumbnails are made once per outbox entry, however many attempts
+	e.Path, e.DestPath = "/recordings/Vera.ts", "/recordings/Vera.mkv"
+	for i := 0; i < 2; i++ {
+		n, err = h.newPushover(r, Content{Entity: e, ID: "1"})
+		require.NoError(t, err)
+		assert.NotNil(t, n.(pushover.Message).Attachment)
+	}
+	assert.Equal(t, 3, thumbnails)
+	h.forget("1")
+	_, err = h.newPushover(r, Content{Entity: e, ID: "1"})
+	require.NoError(t, err)
+	assert.Equal(t, 4, thumbnails)
+
+	r.Options["retry"] = "often"
+	_, err = h.newPushover(r, Content{Entity: e})
+	assert.Error(t, err)
+}
+
+func TestHandler_watchReceipt(t *testing.T) {
+	polled := make(chan string, 2)
+	release := make(chan struct{})
+	rt := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		polled <- r.URL.Path
+		<-release
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader(`{"status":1,"acknowledged":0}`)),
+			Header:     make(http.Header),
+			Request:    r,
+		}, nil
+	})
+
+	h := &Handler{pushover: newPushoverState(), closeCh: make(chan struct{})}
+	m := pushover.NewMessage("http://pushover.invalid/1", "apptoken", "userkey", "s", "b")
+	m.Client = &http.Client{Transport: rt}
+	m.ReceiptInterval = time.Hour
+
+	h.watchReceipt(m, "rcpt")
+	h.watchReceipt(m, "rcpt")
+	assert.Equal(t, "/1/receipts/rcpt.json", <-polled)
+
+	// Closing the handler stops the polling
+	h.Close()
+	close(release)
+	assert.Eventually(t, func() bool {
+		h.pushover.Lock()
+		defer h.pushover.Unlock()
+		return len(h.pushover.receipts) == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Empty(t, polled, "each receipt is only polled once")
+}
+
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+type recordingTransport struct {
+	urls []string
+	body string
+}
+
+func (rt *recordingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	rt.urls = append(rt.urls, r.URL.String())
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader(rt.body)),
+		Header:     make(http.Header),
+		Request:    r,
+	}, nil
+}
+
+func TestHandler_httpClient(t *testing.T) {
+	settings := Settings{
+		Backends: map[string]map[string]interface{}{
+			"pushover": {"app_token": "apptoken", "api_url": "http://pushover.invalid/1/"},
+		},
+		Outbox: OutboxSettings{Path: t.TempDir() + "/outbox.json"},
+	}
+
+	rt := &recordingTransport{body: `{"status":1}`}
+	h, err := NewHandler(settings, WithHTTPClient(&http.Client{Transport: rt}))
+	require.NoError(t, err)
+
+	// The injected client survives updates
+	require.NoError(t, h.Update(settings))
+
+	n, err := h.backends["pushover"](Config{Key: "userkey", shared: settings.Backends}, Content{Subject: "s"})
+	require.NoError(t, err)
+	require.NoError(t, n.Fire())
+
+	n, err = h.backends["ntfy"](Config{Options: map[string]interface{}{"server": "http://ntfy.invalid", "topic": "t"}}, Content{Subject: "s"})
+	require.NoError(t, err)
+	require.NoError(t, n.Fire())
+
+	assert.Equal(t, []string{"http://pushover.invalid/1/messages.json", "http://ntfy.invalid/t"}, rt.urls)
+}
+
+func TestHttpClients(t *testing.T) {
+	settings := Settings{
+		Backends: map[string]map[string]interface{}{
+			"ntfy": {"timeout": "1m"},
+		},
+	}
+	settings.HTTP.Timeout = 5 * time.Second
+
+	clients, err := httpClients(settings)
+	require.NoError(t, err)
+	assert.Equal(t, 5*time.Second, clients["pushover"].Timeout)
+	assert.Equal(t, time.Minute, clients["ntfy"].Timeout)
+	assert.NotContains(t, clients, "email")
+
+	settings.Backends["gotify"] = map[string]interface{}{"proxy": "::nonsense"}
+	_, err = httpClients(settings)
+	assert.Error(t, err)
+}
@@ -1,8 +1,178 @@
 package notify
 
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Config is a single recipient configured under notifications.<backend>.
 type Config struct {
 	Name    string
 	Default bool
 	Key     string
-	Notify  []string
+	// Notify is a list of title regexps, a shorthand for rules that only
+	// match on the title. They are checked after Rules.
+	Notify []string
+	Rules  []Rule
+	// QuietHours is a window such as "22:00-07:00" during which notifications
+	// are held back, unless their priority is high or above.
+	QuietHours string `mapstructure:"quiet_hours"`
+	// Admin recipients are sent every failure, whatever the other rules say.
+	Admin bool
+	// Digest is daily or weekly to send the recipient a summary of their
+	// recordings at DigestTime, on DigestDay for weekly digests, instead of
+	// a notification for each one. High priority notifications are still
+	// sent immediately.
+	Digest     string
+	DigestTime string `mapstructure:"digest_time"`
+	DigestDay  string `mapstructure:"digest_day"`
+
+	// Options holds any other backend specific settings for the recipient,
+	// such as an ntfy topic or an email address.
+	Options map[string]interface{} `mapstructure:",remain"`
+
+	// shared holds the backend-wide settings from Settings.Backends, by
+	// backend
+	shared map[string]map[string]interface{}
+}
+
+// Option returns the recipient's setting for key, falling back to the
+// backend-wide setting at <backend>.<key>.
+func (c Config) Option(backend, key string) string {
+	if v, ok := c.Options[key]; ok && v != nil {
+		return fmt.Sprint(v)
+	}
+	if v, ok := c.shared[backend][key]; ok && v != nil {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// StringMap returns the recipient's map setting for key, falling back to the
+// backend-wide setting at <backend>.<key>.
+func (c Config) StringMap(backend, key string) map[string]string {
+	v, ok := c.Options[key].(map[string]interface{})
+	if !ok {
+		v, _ = c.shared[backend][key].(map[string]interface{})
+	}
+	m := make(map[string]string, len(v))
+	for k, val := range v {
+		m[k] = fmt.Sprint(val)
+	}
+	return m
+}
+
+// BoolOption returns the recipient's boolean setting for key, as Option.
+// Unset settings are false.
+func (c Config) BoolOption(backend, key string) (bool, error) {
+	v := c.Option(backend, key)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("notify: invalid %s setting %s '%s': %s", backend, key, v, err)
+	}
+	return b, nil
+}
+
+// DurationOption returns the recipient's duration setting for key, as
+// Option, or def if it isn't set.
+func (c Config) DurationOption(backend, key string, def time.Duration) (time.Duration, error) {
+	v := c.Option(backend, key)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("notify: invalid %s setting %s '%s': %s", backend, key, v, err)
+	}
+	return d, nil
+}
+
+// backendOptions lists the settings each built in backend understands, which
+// can be set per recipient or for the whole backend under <backend>.<key>.
+var backendOptions = map[string][]string{
+	"pushover": {"app_token", "api_url", "url", "url_title", "sound", "device", "html", "thumbnail",
+		"thumbnail_width", "retry", "expire", "receipt_interval", "timeout", "proxy"},
+	"webhook":  {"url", "headers", "timeout", "proxy"},
+	"email":    {"address", "host", "port", "username", "password", "from"},
+	"ntfy":     {"server", "topic", "token", "timeout", "proxy"},
+	"gotify":   {"server", "token", "timeout", "proxy"},
+	"telegram": {"chat_id", "bot_token", "api_url", "timeout", "proxy"},
+	"matrix":   {"room_id", "homeserver", "access_token", "timeout", "proxy"},
+}
+
+// requiredOptions lists the settings without which a backend can't deliver.
+var requiredOptions = map[string][]string{
+	"pushover": {"app_token"},
+	"webhook":  {"url"},
+	"email":    {"address", "host", "from"},
+	"ntfy":     {"topic"},
+	"gotify":   {"server", "token"},
+	"telegram": {"chat_id", "bot_token"},
+	"matrix":   {"room_id", "homeserver", "access_token"},
+}
+
+// BackendOptions returns the settings understood by a built in backend.
+func BackendOptions(backend string) []string {
+	return append([]string(nil), backendOptions[backend]...)
+}
+
+// ValidateRecipients checks that every recipient of the built in backends
+// has a unique name and all the settings its backend needs. Settings the
+// backend doesn't understand are returned as warnings.
+func (s Settings) ValidateRecipients() ([]string, []error) {
+	var warnings []string
+	var errs []error
+
+	for _, backend := range Backends() {
+		nconf := s.recipients(backend)
+		names := make(map[string]bool)
+		defaults := 0
+		for i, conf := range nconf {
+			if conf.Name == "" {
+				errs = append(errs, fmt.Errorf("notify: %s recipient %d has no name", backend, i+1))
+				continue
+			}
+			if names[conf.Name] {
+				errs = append(errs, fmt.Errorf("notify: %s recipient name '%s' is used more than once", backend, conf.Name))
+			}
+			names[conf.Name] = true
+			if conf.Default {
+				defaults++
+			}
+
+			if backend == "pushover" && conf.Key == "" {
+				errs = append(errs, fmt.Errorf("notify: pushover recipient '%s' has no key", conf.Name))
+			}
+			for _, key := range requiredOptions[backend] {
+				if conf.Option(backend, key) == "" {
+					errs = append(errs, fmt.Errorf("notify: %s recipient '%s' has no %s, set it on the recipient or at %s.%s",
+						backend, conf.Name, key, backend, key))
+				}
+			}
+
+			for key := range conf.Options {
+				if !contains(backendOptions[backend], key) {
+					warnings = append(warnings, fmt.Sprintf("notify: %s recipient '%s' has unknown setting '%s'", backend, conf.Name, key))
+				}
+			}
+		}
+
+		if defaults > 1 {
+			errs = append(errs, fmt.Errorf("notify: %s has %d default recipients, expected at most one", backend, defaults))
+		}
+	}
+	return warnings, errs
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
 }
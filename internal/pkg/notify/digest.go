@@ -0,0 +1,261 @@
+package notify
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/history"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDigestTime     = "08:00"
+	defaultDigestDay      = "monday"
+	defaultDigestInterval = time.Minute
+)
+
+// DigestData is what digest templates are executed against. Completed holds
+// recordings that succeeded or were skipped, Failed those that failed or were
+// quarantined, and Saved is the total space saved by transcoding.
+type DigestData struct {
+	Recipient string
+	Period    string
+	From      time.Time
+	To        time.Time
+	Completed []TemplateData
+	Failed    []TemplateData
+	Saved     uint64
+}
+
+// WithHistory enables digests, which are built from the recordings in hist.
+func WithHistory(hist *history.History) func(*Handler) {
+	return func(h *Handler) {
+		h.history = hist
+	}
+}
+
+// digestPeriod returns the start and end of the recipient's most recent
+// complete digest period at now.
+func (c Config) digestPeriod(now time.Time) (time.Time, time.Time, error) {
+	at := c.DigestTime
+	if at == "" {
+		at = defaultDigestTime
+	}
+	hm, err := time.Parse("15:04", at)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("notify: invalid digest time '%s', expected HH:MM", at)
+	}
+	to := time.Date(now.Year(), now.Month(), now.Day(), hm.Hour(), hm.Minute(), 0, 0, now.Location())
+
+	switch strings.ToLower(c.Digest) {
+	case "daily":
+		if to.After(now) {
+			to = to.AddDate(0, 0, -1)
+		}
+		return to.AddDate(0, 0, -1), to, nil
+	case "weekly":
+		day := c.DigestDay
+		if day == "" {
+			day = defaultDigestDay
+		}
+		weekday, err := parseWeekday(day)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		for to.After(now) || to.Weekday() != weekday {
+			to = to.AddDate(0, 0, -1)
+		}
+		return to.AddDate(0, 0, -7), to, nil
+	default:
+		return time.Time{}, time.Time{}, fmt.Errorf("notify: unknown digest period '%s', expected daily or weekly", c.Digest)
+	}
+}
+
+func parseWeekday(s string) (time.Weekday, error) {
+	s = strings.ToLower(s)
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		if s == name || s == name[:3] {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("notify: unknown digest day '%s'", s)
+}
+
+func (h *Handler) digestLoop() {
+	ticker := time.NewTicker(durationOr(h.settings().Digest.Interval, defaultDigestInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.closeCh:
+			return
+		case now := <-ticker.C:
+			if err := h.sendDigests(now); err != nil {
+				log.WithError(err).Error("notify: error sending digests")
+			}
+		}
+	}
+}
+
+// sendDigests sends every digest that has fallen due by now.
+func (h *Handler) sendDigests(now time.Time) error {
+	var errs []error
+	settings := h.settings()
+	for _, backend := range h.backendNames() {
+		nconf := settings.recipients(backend)
+		for _, conf := range nconf {
+			if conf.Digest == "" {
+				continue
+			}
+			if err := h.sendDigest(settings, backend, nconf, conf, now); err != nil {
+				errs = append(errs, fmt.Errorf("notify: %s recipient '%s': %s", backend, conf.Name, err))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("notify: errors encountered: %s", strings.Join(h.strErrors(errs), ";"))
+	}
+	return nil
+}
+
+func (h *Handler) sendDigest(settings Settings, backend string, nconf []Config, conf Config, now time.Time) error {
+	from, to, err := conf.digestPeriod(now)
+	if err != nil {
+		return err
+	}
+
+	key := backend + "/" + conf.Name
+	last := h.history.LastDigest(key)
+	if !last.Before(to) {
+		return nil
+	}
+	// Include anything finished while we were down and missed a digest
+	if !last.IsZero() {
+		from = last
+	}
+
+	data, err := h.digest(backend, nconf, conf, from, to)
+	if err != nil {
+		return err
+	}
+
+	fields := log.Fields{
+		"backend":   backend,
+		"recipient": conf.Name,
+		"completed": len(data.Completed),
+		"failed":    len(data.Failed),
+	}
+
+	if len(data.Completed) == 0 && len(data.Failed) == 0 {
+		log.WithFields(fields).Debug("notify: nothing to include in digest")
+		return h.history.SetDigest(key, to)
+	}
+
+	subject, body, err := settings.RenderDigest(backend, data)
+	if err != nil {
+		return err
+	}
+
+	e := newEntry(backend, conf.Name, subject, body, nil)
+	if until, quiet := (Recipient{Config: conf}).quietUntil(now); quiet {
+		e.NextAttempt = until
+	}
+	queued, err := h.outbox.Add(e, durationOr(settings.Outbox.DedupWindow, defaultDedupWindow))
+	if err != nil {
+		return err
+	}
+	// The outbox takes care of delivery from here
+	if err := h.history.SetDigest(key, to); err != nil {
+		return err
+	}
+
+	log.WithFields(fields).Info("notify: sending digest")
+	if queued && !e.NextAttempt.After(now) && h.outbox.Claim(e.ID) {
+		return h.deliver(*e)
+	}
+	return nil
+}
+
+// digest gathers the recordings that finished between from and to which
+// the recipient would have been notified about.
+func (h *Handler) digest(backend string, nconf []Config, conf Config, from, to time.Time) (DigestData, error) {
+	data := DigestData{
+		Recipient: conf.Name,
+		Period:    strings.ToLower(conf.Digest),
+		From:      from,
+		To:        to,
+	}
+
+	for _, rec := range h.history.Between(from, to) {
+		outcome := Outcome(rec.Outcome)
+		recipients, err := route(backend, nconf, rec.Entity, outcome)
+		if err != nil {
+			return data, err
+		}
+
+		included := false
+		for _, r := range recipients {
+			included = included || r.Name == conf.Name
+		}
+		if !included {
+			continue
+		}
+
+		td := TemplateData{Entity: rec.Entity, Outcome: outcome, Error: rec.Error}
+		switch outcome {
+		case OutcomeFailed, OutcomeQuarantined:
+			data.Failed = append(data.Failed, td)
+		case OutcomeSuccess:
+			if rec.Entity.Stats.InitialSizeBytes > rec.Entity.Stats.EndSizeBytes {
+				data.Saved += rec.Entity.Stats.InitialSizeBytes - rec.Entity.Stats.EndSizeBytes
+			}
+			fallthrough
+		default:
+			data.Completed = append(data.Completed, td)
+		}
+	}
+	return data, nil
+}
+
+// RenderDigest returns the subject and body of a digest, using the digest
+// templates for backend.
+func (s Settings) RenderDigest(backend string, data DigestData) (string, string, error) {
+	t := s.templateFor(backend, digestKey)
+
+	subject, err := execute(backend+"/digest/subject", t.Subject, data)
+	if err != nil {
+		return "", "", err
+	}
+	body, err := execute(backend+"/digest/body", t.Body, data)
+	if err != nil {
+		return "", "", err
+	}
+	return strings.TrimSpace(strings.Replace(subject, "\n", " ", -1)), strings.TrimSpace(body), nil
+}
+
+// SampleDigest returns a made up digest for previewing templates.
+func SampleDigest() DigestData {
+	to := time.Date(2020, 1, 2, 8, 0, 0, 0, time.Local)
+	data := DigestData{
+		Recipient: "foo",
+		Period:    "daily",
+		From:      to.AddDate(0, 0, -1),
+		To:        to,
+	}
+
+	for _, outcome := range Outcomes {
+		e := SampleEntity(outcome)
+		td := TemplateData{Entity: e, Outcome: outcome}
+		if err := e.Error(); err != nil {
+			td.Error = err.Error()
+			data.Failed = append(data.Failed, td)
+			continue
+		}
+		data.Completed = append(data.Completed, td)
+	}
+	data.Saved = data.Completed[0].Stats.InitialSizeBytes - data.Completed[0].Stats.EndSizeBytes
+	return data
+}
@@ -0,0 +1,90 @@
+package notify
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/history"
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_digestPeriod(t *testing.T) {
+	// Wednesday
+	now := time.Date(2020, 1, 1, 9, 30, 0, 0, time.Local)
+
+	from, to, err := Config{Digest: "daily"}.digestPeriod(now)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2020, 1, 1, 8, 0, 0, 0, time.Local), to)
+	assert.Equal(t, time.Date(2019, 12, 31, 8, 0, 0, 0, time.Local), from)
+
+	_, to, err = Config{Digest: "daily", DigestTime: "20:00"}.digestPeriod(now)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2019, 12, 31, 20, 0, 0, 0, time.Local), to)
+
+	from, to, err = Config{Digest: "Weekly", DigestDay: "fri", DigestTime: "18:00"}.digestPeriod(now)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2019, 12, 27, 18, 0, 0, 0, time.Local), to)
+	assert.Equal(t, time.Date(2019, 12, 20, 18, 0, 0, 0, time.Local), from)
+
+	_, _, err = Config{Digest: "hourly"}.digestPeriod(now)
+	assert.Error(t, err)
+	_, _, err = Config{Digest: "weekly", DigestDay: "someday"}.digestPeriod(now)
+	assert.Error(t, err)
+	_, _, err = Config{Digest: "daily", DigestTime: "8am"}.digestPeriod(now)
+	assert.Error(t, err)
+}
+
+func TestHandler_digest(t *testing.T) {
+	hist, err := history.Load(history.Config{Path: filepath.Join(t.TempDir(), "history.json")})
+	require.NoError(t, err)
+
+	h, _ := testHandler(t)
+	h.history = hist
+	settings := h.settings()
+	settings.Recipients = map[string][]Config{"fake": {
+		{Name: "foo", Default: true, Digest: "daily", DigestTime: "08:00"},
+		{Name: "bar", Notify: []string{"vera"}},
+	}}
+	require.NoError(t, h.Update(settings))
+
+	var sent []Content
+	h.RegisterBackend("fake", func(r Config, c Content) (Notifier, error) {
+		return fakeNotifier{func() error {
+			if r.Name == "foo" {
+				sent = append(sent, c)
+			}
+			return nil
+		}}, nil
+	})
+
+	ok := &media.Entity{
+		Details:          media.Details{Title: "Doctor Who", Channel: "BBC One", Status: "OK"},
+		Stats:            media.Stats{InitialSizeBytes: 3000, EndSizeBytes: 1000},
+		TranscodeSuccess: true,
+	}
+	failed := &media.Entity{Details: media.Details{Title: "Casualty", Channel: "BBC One", Status: "OK"}}
+	failed.SetError(errors.New("exit status 1"))
+	other := &media.Entity{Details: media.Details{Title: "Vera", Channel: "ITV", Status: "OK"}}
+
+	for _, e := range []*media.Entity{ok, failed, other} {
+		require.NoError(t, hist.Add(e, string(OutcomeOf(e))))
+		require.NoError(t, h.DoNotifications(e))
+	}
+	assert.Empty(t, sent, "digest recipients aren't notified immediately")
+
+	tomorrow := time.Now().Add(24 * time.Hour)
+	require.NoError(t, h.sendDigests(tomorrow))
+	require.Len(t, sent, 1)
+	assert.Equal(t, "TVHTC2 daily digest: 1 new, 1 failed", sent[0].Subject)
+	assert.Contains(t, sent[0].Body, "Doctor Who (BBC One)")
+	assert.Contains(t, sent[0].Body, "Casualty (BBC One): exit status 1")
+	assert.Contains(t, sent[0].Body, "Saved 2.0 KiB")
+	assert.NotContains(t, sent[0].Body, "Vera", "recordings routed elsewhere aren't included")
+
+	require.NoError(t, h.sendDigests(tomorrow))
+	assert.Len(t, sent, 1, "each digest is only sent once")
+}
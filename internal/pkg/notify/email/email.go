@@ -0,0 +1,112 @@
+package email
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/notify/retry"
+	log "github.com/sirupsen/logrus"
+)
+
+// Server holds the SMTP settings used to send mail.
+type Server struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (s Server) addr() string {
+	port := s.Port
+	if port == 0 {
+		port = 25
+	}
+	return net.JoinHostPort(s.Host, strconv.Itoa(port))
+}
+
+// A Message is a notification sent as a plain text email. STARTTLS is used
+// whenever the server offers it.
+type Message struct {
+	Server  Server
+	To      string
+	Subject string
+	Body    string
+}
+
+// NewMessage returns a Message emailing subject and body to the address to.
+func NewMessage(server Server, to, subject, body string) Message {
+	return Message{
+		Server:  server,
+		To:      to,
+		Subject: subject,
+		Body:    body,
+	}
+}
+
+func (m Message) build() []byte {
+	sb := strings.Builder{}
+	sb.WriteString("From: " + m.Server.From + "\r\n")
+	sb.WriteString("To: " + m.To + "\r\n")
+	sb.WriteString("Subject: " + mimeHeader(m.Subject) + "\r\n")
+	sb.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	sb.WriteString("MIME-Version: 1.0\r\n")
+	sb.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	sb.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	sb.WriteString("\r\n")
+	sb.WriteString(strings.Replace(m.Body, "\n", "\r\n", -1))
+	sb.WriteString("\r\n")
+	return []byte(sb.String())
+}
+
+// mimeHeader encodes non-ASCII header values, as programme titles often have them.
+func mimeHeader(s string) string {
+	for _, r := range s {
+		if r > 127 {
+			return "=?utf-8?q?" + qEncode(s) + "?="
+		}
+	}
+	return s
+}
+
+func qEncode(s string) string {
+	sb := strings.Builder{}
+	for _, b := range []byte(s) {
+		switch {
+		case b == ' ':
+			sb.WriteByte('_')
+		case b > 127 || b == '=' || b == '?' || b == '_' || b < 32:
+			sb.WriteString(fmt.Sprintf("=%02X", b))
+		default:
+			sb.WriteByte(b)
+		}
+	}
+	return sb.String()
+}
+
+func (m Message) Fire() error {
+	if m.Server.Host == "" || m.Server.From == "" || m.To == "" {
+		return fmt.Errorf("email: host, from and to addresses must be configured")
+	}
+
+	var auth smtp.Auth
+	if m.Server.Username != "" {
+		auth = smtp.PlainAuth("", m.Server.Username, m.Server.Password, m.Server.Host)
+	}
+
+	if err := smtp.SendMail(m.Server.addr(), auth, m.Server.From, []string{m.To}, m.build()); err != nil {
+		// Permanent SMTP failures are 5xx replies, anything else is worth retrying
+		if tperr, ok := err.(*textproto.Error); ok && tperr.Code >= 500 {
+			return fmt.Errorf("email: error sending notification: %s", err)
+		}
+		return retry.Temporaryf(0, "email: error sending notification: %s", err)
+	}
+
+	log.WithField("to", m.To).Info("email: notification sent")
+	return nil
+}
@@ -0,0 +1,91 @@
+package email
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSMTP accepts a single message and sends what it received on the
+// returned channel. It doesn't offer STARTTLS or AUTH.
+func fakeSMTP(t *testing.T, reject bool) (Server, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		w := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		w("220 localhost ESMTP fake")
+
+		var sb strings.Builder
+		data := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if data {
+				if line == ".\r\n" {
+					data = false
+					received <- sb.String()
+					w("250 OK")
+					continue
+				}
+				sb.WriteString(line)
+				continue
+			}
+
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				w("250 localhost")
+			case strings.HasPrefix(cmd, "RCPT") && reject:
+				w("550 no such user")
+			case cmd == "DATA":
+				data = true
+				w("354 go ahead")
+			case cmd == "QUIT":
+				w("221 bye")
+				return
+			default:
+				w("250 OK")
+			}
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return Server{Host: host, Port: p, From: "tvhtc2@localhost"}, received
+}
+
+func TestMessage_Fire(t *testing.T) {
+	server, received := fakeSMTP(t, false)
+
+	require.NoError(t, NewMessage(server, "foo@example.com", "New Recording: Café", "line one\nline two").Fire())
+
+	msg := <-received
+	assert.Contains(t, msg, "To: foo@example.com\r\n")
+	assert.Contains(t, msg, "Subject: =?utf-8?q?New_Recording:_Caf=C3=A9?=\r\n")
+	assert.Contains(t, msg, "line one\r\nline two")
+}
+
+func TestMessage_FireRejected(t *testing.T) {
+	server, _ := fakeSMTP(t, true)
+
+	err := NewMessage(server, "nobody@example.com", "s", "b").Fire()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "550")
+}
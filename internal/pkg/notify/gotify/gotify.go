@@ -0,0 +1,76 @@
+package gotify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/httpclient"
+	"github.com/Xiol/tvhtc2/internal/pkg/notify/retry"
+	log "github.com/sirupsen/logrus"
+)
+
+type payload struct {
+	Title    string `json:"title"`
+	Message  string `json:"message"`
+	Priority int    `json:"priority"`
+}
+
+// A Message is a notification pushed to a Gotify server using an
+// application token.
+type Message struct {
+	Server   string
+	Token    string
+	Subject  string
+	Body     string
+	Priority int
+
+	// Client sends requests, nil uses httpclient.Default.
+	Client *http.Client
+}
+
+// NewMessage returns a Message sending subject and body to the Gotify server.
+func NewMessage(server, token, subject, body string) Message {
+	return Message{
+		Server:   strings.TrimRight(server, "/"),
+		Token:    token,
+		Subject:  subject,
+		Body:     body,
+		Priority: 5,
+	}
+}
+
+func (m Message) Fire() error {
+	if m.Server == "" || m.Token == "" {
+		return fmt.Errorf("gotify: server and token must be configured")
+	}
+
+	p, err := json.Marshal(payload{Title: m.Subject, Message: m.Body, Priority: m.Priority})
+	if err != nil {
+		return fmt.Errorf("gotify: error marshalling payload: %s", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, m.Server+"/message", bytes.NewReader(p))
+	if err != nil {
+		return fmt.Errorf("gotify: error creating request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", m.Token)
+
+	resp, err := httpclient.Or(m.Client).Do(req)
+	if err != nil {
+		return retry.Temporaryf(0, "gotify: error sending notification: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return retry.StatusError(resp, "gotify: bad status code %d from Gotify, response body: %s", resp.StatusCode, body)
+	}
+
+	log.WithField("server", m.Server).Info("gotify: notification sent")
+	return nil
+}
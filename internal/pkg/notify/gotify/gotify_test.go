@@ -0,0 +1,33 @@
+package gotify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessage_Fire(t *testing.T) {
+	var got payload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/message" || r.Header.Get("X-Gotify-Key") != "app_token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		w.Write([]byte(`{"id":1}`))
+	}))
+	defer srv.Close()
+
+	require.NoError(t, NewMessage(srv.URL, "app_token", "New Recording", "body").Fire())
+	assert.Equal(t, payload{Title: "New Recording", Message: "body", Priority: 5}, got)
+
+	err := NewMessage(srv.URL, "wrong", "s", "b").Fire()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "401")
+
+	assert.Error(t, NewMessage("", "app_token", "s", "b").Fire())
+}
@@ -2,97 +2,322 @@ package notify
 
 import (
 	"fmt"
-	"regexp"
+	"net/http"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/Xiol/tvhtc2/internal/pkg/history"
 	"github.com/Xiol/tvhtc2/internal/pkg/media"
 	"github.com/Xiol/tvhtc2/internal/pkg/notify/pushover"
+	"github.com/Xiol/tvhtc2/internal/pkg/notify/retry"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
+)
+
+const (
+	defaultRetryInterval  = 30 * time.Second
+	defaultInitialBackoff = 30 * time.Second
+	defaultMaxBackoff     = time.Hour
+	defaultMaxAge         = 24 * time.Hour
+	defaultDedupWindow    = time.Hour
 )
 
 type Handler struct {
-	pushoverToken string
+	backends map[string]BackendFunc
+	outbox   *Outbox
+	history  *history.History
+	current  *current
+	pushover *pushoverState
+	closeCh  chan struct{}
 }
 
-func NewHandler(pushoverToken string) Handler {
-	return Handler{
-		pushoverToken: pushoverToken,
+// current holds the settings in use, shared by copies of a Handler so that
+// an Update is seen by all of them.
+type current struct {
+	sync.RWMutex
+	settings Settings
+	clients  map[string]*http.Client
+	// client replaces every backend's client if set by WithHTTPClient
+	client *http.Client
+}
+
+// NewHandler returns a Handler using settings, delivering notifications
+// through the outbox at settings.Outbox.Path.
+func NewHandler(settings Settings, options ...func(*Handler)) (Handler, error) {
+	h := Handler{
+		current:  &current{},
+		pushover: newPushoverState(),
+		closeCh:  make(chan struct{}),
+	}
+	h.backends = h.defaultBackends()
+
+	for _, opt := range options {
+		opt(&h)
+	}
+
+	if err := h.Update(settings); err != nil {
+		return h, err
+	}
+
+	if settings.Outbox.Path == "" {
+		return h, fmt.Errorf("notify: no outbox path configured")
 	}
+	var err error
+	if h.outbox, err = LoadOutbox(settings.Outbox.Path); err != nil {
+		return h, err
+	}
+	return h, nil
 }
 
-func (h *Handler) createNotifications(entity *media.Entity) ([]Notifier, error) {
-	if entity.Title == "" {
-		return nil, nil
+// WithHTTPClient makes every built in backend send requests with c.
+func WithHTTPClient(c *http.Client) func(*Handler) {
+	return func(h *Handler) {
+		h.current.client = c
 	}
+}
 
-	var notify []Notifier
-	np, err := h.createPushoverNotifications(entity)
+// Update replaces the settings used for notifications from now on. Queued
+// notifications are delivered using the new settings. The outbox path and
+// the intervals of the background loops only take effect on restart.
+func (h *Handler) Update(settings Settings) error {
+	clients, err := httpClients(settings)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	notify = append(notify, np...)
-	return notify, nil
+	h.current.Lock()
+	defer h.current.Unlock()
+	if h.current.client != nil {
+		for backend := range clients {
+			clients[backend] = h.current.client
+		}
+	}
+	h.current.settings = settings
+	h.current.clients = clients
+	return nil
+}
+
+// settings returns the settings currently in use.
+func (h *Handler) settings() Settings {
+	h.current.RLock()
+	defer h.current.RUnlock()
+	return h.current.settings
+}
+
+// client returns the HTTP client for a built in backend.
+func (h *Handler) client(backend string) *http.Client {
+	h.current.RLock()
+	defer h.current.RUnlock()
+	return h.current.clients[backend]
+}
+
+// Start retries queued notifications, and sends digests if there is a
+// history, in the background until Close is called.
+func (h *Handler) Start() {
+	go h.retryLoop()
+	if h.history != nil {
+		go h.digestLoop()
+	}
+}
+
+// Close stops retrying queued notifications and sending digests. Queued
+// notifications remain in the outbox.
+func (h *Handler) Close() {
+	close(h.closeCh)
+}
+
+func (h *Handler) retryLoop() {
+	ticker := time.NewTicker(durationOr(h.settings().Outbox.RetryInterval, defaultRetryInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.closeCh:
+			return
+		case <-ticker.C:
+			for _, e := range h.outbox.Due(time.Now()) {
+				if err := h.deliver(e); err != nil {
+					log.WithError(err).Error("notify: error during notification retry")
+				}
+			}
+		}
+	}
+}
+
+// RegisterBackend adds a notification backend, or replaces an existing one,
+// for recipients configured under notifications.<name>.
+func (h *Handler) RegisterBackend(name string, fn BackendFunc) {
+	h.backends[name] = fn
+}
+
+func (h *Handler) backendNames() []string {
+	names := make([]string, 0, len(h.backends))
+	for name := range h.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
-func (h *Handler) createPushoverNotifications(entity *media.Entity) ([]Notifier, error) {
-	var nconf []Config
-	if err := viper.UnmarshalKey("notifications.pushover", &nconf); err != nil {
-		return nil, fmt.Errorf("notify: error unmarshalling Pushover notification config: %s", err)
+func (h *Handler) createEntries(entity *media.Entity) ([]*Entry, error) {
+	if entity.Title == "" {
+		return nil, nil
 	}
 
-	haveMatch := false
-	defKey := ""
-	defName := ""
-	var notifiers []Notifier
-	for _, conf := range nconf {
-		if conf.Default {
-			defName = conf.Name
-			defKey = conf.Key
+	outcome := OutcomeOf(entity)
+	now := time.Now()
+	settings := h.settings()
+
+	var entries []*Entry
+	for _, name := range h.backendNames() {
+		recipients, err := route(name, settings.recipients(name), entity, outcome)
+		if err != nil {
+			return nil, err
+		}
+		if len(recipients) == 0 {
+			continue
+		}
+
+		subject, body, err := settings.Render(name, outcome, entity)
+		if err != nil {
+			return nil, err
 		}
 
-		for _, rgx := range conf.Notify {
-			testRegex, err := regexp.Compile(rgx)
-			if err != nil {
-				return nil, fmt.Errorf("notify: error compiling Pushover regex '%s': %s", rgx, err)
+		for _, r := range recipients {
+			if r.Digest != "" && r.Priority < pushover.PriorityHighPriority {
+				log.WithFields(log.Fields{
+					"backend":   name,
+					"recipient": r.Name,
+				}).Debug("notify: recipient gets digests, not notifying")
+				continue
 			}
 
-			if testRegex.MatchString(strings.ToLower(entity.Title)) {
-				notifiers = append(notifiers, pushover.NewMessage(h.pushoverToken, conf.Key, entity))
-				haveMatch = true
+			e := newEntry(name, r.Name, subject, body, entity)
+			e.Priority = r.Priority
+			if until, quiet := r.quietUntil(now); quiet {
 				log.WithFields(log.Fields{
-					"name":   conf.Name,
-					"regexp": rgx,
-					"title":  entity.Title,
-				}).Debug("notify: adding pushover notification")
-				break
+					"backend":   name,
+					"recipient": r.Name,
+					"until":     until,
+				}).Info("notify: recipient is in quiet hours, deferring notification")
+				e.NextAttempt = until
 			}
+			entries = append(entries, e)
 		}
 	}
 
-	if !haveMatch {
-		notifiers = append(notifiers, pushover.NewMessage(h.pushoverToken, defKey, entity))
-		log.WithFields(log.Fields{
-			"name":  defName,
-			"title": entity.Title,
-		}).Debug("notify: no match for title, sending pushover to default user")
+	return entries, nil
+}
+
+// notifier creates the Notifier for an outbox entry, using the recipient's
+// current configuration.
+func (h *Handler) notifier(e Entry) (Notifier, error) {
+	fn, ok := h.backends[e.Backend]
+	if !ok {
+		return nil, fmt.Errorf("notify: unknown backend '%s'", e.Backend)
 	}
 
-	return notifiers, nil
+	for _, r := range h.settings().recipients(e.Backend) {
+		if r.Name == e.Recipient {
+			return fn(r, Content{
+				Subject:  e.Subject,
+				Body:     e.Body,
+				Priority: e.Priority,
+				Entity:   e.Entity,
+				ID:       e.ID,
+			})
+		}
+	}
+	return nil, fmt.Errorf("notify: %s recipient '%s' is no longer configured", e.Backend, e.Recipient)
+}
+
+// deliver attempts to send an outbox entry. Temporary failures are scheduled
+// for another attempt with exponential backoff, or later if the remote end
+// asked us to wait longer. Only permanent failures are returned as errors.
+func (h *Handler) deliver(e Entry) error {
+	fields := log.Fields{
+		"backend":   e.Backend,
+		"recipient": e.Recipient,
+		"attempts":  e.Attempts,
+	}
+
+	n, err := h.notifier(e)
+	if err == nil {
+		err = n.Fire()
+	}
+
+	settings := h.settings().Outbox
+	if err == nil {
+		h.forget(e.ID)
+		return h.outbox.Delivered(e.ID, durationOr(settings.DedupWindow, defaultDedupWindow))
+	}
+
+	temp, after := retry.IsTemporary(err)
+	maxAge := durationOr(settings.MaxAge, defaultMaxAge)
+	if !temp || time.Since(e.Created) > maxAge {
+		h.forget(e.ID)
+		if rerr := h.outbox.Remove(e.ID); rerr != nil {
+			log.WithError(rerr).Error("notify: failed to remove notification from outbox")
+		}
+		if temp {
+			return fmt.Errorf("notify: giving up after %d attempts: %s", e.Attempts+1, err)
+		}
+		return err
+	}
+
+	wait := settings.backoff(e.Attempts)
+	if after > wait {
+		wait = after
+	}
+
+	log.WithError(err).WithFields(fields).WithField("retry_in", wait).Warning("notify: temporary failure, will retry")
+	if rerr := h.outbox.Retry(e.ID, err, time.Now().Add(wait)); rerr != nil {
+		return rerr
+	}
+	return nil
+}
+
+func (s OutboxSettings) backoff(attempts int) time.Duration {
+	wait := durationOr(s.InitialBackoff, defaultInitialBackoff)
+	max := durationOr(s.MaxBackoff, defaultMaxBackoff)
+	for i := 0; i < attempts && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait
 }
 
 func (h *Handler) DoNotifications(entity *media.Entity) error {
 	var errs []error
 
-	n, err := h.createNotifications(entity)
+	entries, err := h.createEntries(entity)
 	if err != nil {
 		return fmt.Errorf("notify: error creating notifications: %s", err)
 	}
 
-	for i := range n {
-		err := n[i].Fire()
+	window := durationOr(h.settings().Outbox.DedupWindow, defaultDedupWindow)
+	for _, e := range entries {
+		queued, err := h.outbox.Add(e, window)
 		if err != nil {
+			log.WithError(err).Error("notify: failed to queue notification, sending anyway")
+		} else if !queued {
+			log.WithFields(log.Fields{
+				"backend":   e.Backend,
+				"recipient": e.Recipient,
+			}).Info("notify: skipping duplicate notification")
+			continue
+		}
+
+		// Deferred notifications are left in the outbox for the retry loop,
+		// as are those it has already picked up
+		if e.NextAttempt.After(time.Now()) || (queued && !h.outbox.Claim(e.ID)) {
+			continue
+		}
+
+		if err := h.deliver(*e); err != nil {
 			log.WithError(err).Error("notify: error during notification")
 			errs = append(errs, err)
 		}
@@ -0,0 +1,123 @@
+package notify
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/Xiol/tvhtc2/internal/pkg/notify/pushover"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func names(recipients []Recipient) []string {
+	out := make([]string, len(recipients))
+	for i := range recipients {
+		out[i] = recipients[i].Name
+	}
+	return out
+}
+
+func entity(title string) *media.Entity {
+	return &media.Entity{Details: media.Details{Title: title, Channel: "BBC One HD", Status: "OK"}, Media: media.MEDIA_H264_VIDEO}
+}
+
+func TestRoute(t *testing.T) {
+	nconf := []Config{
+		{Name: "foo", Default: true, Notify: []string{"dragons.+den"}},
+		{Name: "bar", Notify: []string{"eastenders", "dragons.+den"}},
+	}
+
+	r, err := route("ntfy", nconf, entity("Dragons' Den"), OutcomeSuccess)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo", "bar"}, names(r))
+
+	r, err = route("ntfy", nconf, entity("EastEnders"), OutcomeSuccess)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bar"}, names(r))
+
+	r, err = route("ntfy", nconf, entity("Vera"), OutcomeSuccess)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, names(r), "unmatched titles go to the default recipient")
+
+	r, err = route("ntfy", nconf[1:], entity("Vera"), OutcomeSuccess)
+	require.NoError(t, err)
+	assert.Empty(t, r, "nobody is notified without a default recipient")
+}
+
+func TestRoute_rules(t *testing.T) {
+	nconf := []Config{
+		{
+			Name:    "foo",
+			Default: true,
+			Rules: []Rule{
+				{Title: "news", Exclude: true},
+				{Channel: "^bbc", Type: "video", Outcome: "success", Priority: pushover.PrioritySilent},
+			},
+		},
+		{
+			Name:  "admin",
+			Admin: true,
+			Rules: []Rule{{Type: "audio"}},
+		},
+	}
+
+	r, err := route("pushover", nconf, entity("Doctor Who"), OutcomeSuccess)
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo"}, names(r))
+	assert.Equal(t, pushover.PrioritySilent, r[0].Priority)
+
+	r, err = route("pushover", nconf, entity("BBC News"), OutcomeSuccess)
+	require.NoError(t, err)
+	assert.Empty(t, r, "excluded defaults aren't notified")
+
+	r, err = route("pushover", nconf, entity("BBC News"), OutcomeFailed)
+	require.NoError(t, err)
+	require.Equal(t, []string{"admin"}, names(r), "admins get failures")
+	assert.Equal(t, pushover.PriorityHighPriority, r[0].Priority)
+
+	radio := entity("The Archers")
+	radio.Media = media.MEDIA_AUDIO
+	r, err = route("pushover", nconf, radio, OutcomeSuccess)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"admin"}, names(r))
+}
+
+func TestRecipient_quietUntil(t *testing.T) {
+	night := time.Date(2020, 1, 1, 23, 0, 0, 0, time.Local)
+	r := Recipient{Config: Config{QuietHours: "22:00-07:00"}}
+
+	until, quiet := r.quietUntil(night)
+	assert.True(t, quiet)
+	assert.Equal(t, time.Date(2020, 1, 2, 7, 0, 0, 0, time.Local), until)
+
+	_, quiet = r.quietUntil(night.Add(12 * time.Hour))
+	assert.False(t, quiet)
+
+	r.Priority = pushover.PriorityHighPriority
+	_, quiet = r.quietUntil(night)
+	assert.False(t, quiet, "high priority ignores quiet hours")
+}
+
+func TestRule_Validate(t *testing.T) {
+	assert.NoError(t, Rule{Title: "news", Type: "Audio", Outcome: "Failed"}.Validate())
+	assert.Error(t, Rule{Title: "("}.Validate())
+	assert.Error(t, Rule{Type: "hologram"}.Validate())
+	assert.Error(t, Rule{Outcome: "exploded"}.Validate())
+	assert.Error(t, Rule{Priority: 3}.Validate())
+}
+
+func TestConfig_Option(t *testing.T) {
+	c := Config{Options: map[string]interface{}{"topic": "mine", "port": 587}}
+	assert.Equal(t, "mine", c.Option("ntfy", "topic"))
+	assert.Equal(t, "587", c.Option("email", "port"))
+	assert.Equal(t, "", c.Option("ntfy", "missing"))
+
+	c.shared = map[string]map[string]interface{}{
+		"ntfy":   {"server": "https://ntfy.example.com"},
+		"gotify": {"token": "secret"},
+	}
+	assert.Equal(t, "https://ntfy.example.com", c.Option("ntfy", "server"))
+	assert.Equal(t, "", c.Option("ntfy", "token"), "another backend's settings aren't used")
+	assert.Equal(t, "mine", c.Option("gotify", "topic"), "the recipient's own settings come first")
+}
@@ -0,0 +1,80 @@
+package matrix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/httpclient"
+	"github.com/Xiol/tvhtc2/internal/pkg/notify/retry"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+type event struct {
+	MsgType string `json:"msgtype"`
+	Body    string `json:"body"`
+}
+
+// A Message is a notification sent as an m.text event to a Matrix room.
+type Message struct {
+	Homeserver  string
+	AccessToken string
+	RoomID      string
+	Subject     string
+	Body        string
+
+	// Client sends requests, nil uses httpclient.Default.
+	Client *http.Client
+}
+
+// NewMessage returns a Message sending subject and body to roomID.
+func NewMessage(homeserver, accessToken, roomID, subject, body string) Message {
+	return Message{
+		Homeserver:  strings.TrimRight(homeserver, "/"),
+		AccessToken: accessToken,
+		RoomID:      roomID,
+		Subject:     subject,
+		Body:        body,
+	}
+}
+
+func (m Message) Fire() error {
+	if m.Homeserver == "" || m.AccessToken == "" || m.RoomID == "" {
+		return fmt.Errorf("matrix: homeserver, access token and room ID must be configured")
+	}
+
+	p, err := json.Marshal(event{MsgType: "m.text", Body: m.Subject + "\n\n" + m.Body})
+	if err != nil {
+		return fmt.Errorf("matrix: error marshalling event: %s", err)
+	}
+
+	// The transaction ID makes retries of the same request idempotent
+	endpoint := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+		m.Homeserver, url.PathEscape(m.RoomID), uuid.New().String())
+
+	req, err := http.NewRequest(http.MethodPut, endpoint, bytes.NewReader(p))
+	if err != nil {
+		return fmt.Errorf("matrix: error creating request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+m.AccessToken)
+
+	resp, err := httpclient.Or(m.Client).Do(req)
+	if err != nil {
+		return retry.Temporaryf(0, "matrix: error sending notification: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return retry.StatusError(resp, "matrix: bad status code %d from homeserver, response body: %s", resp.StatusCode, body)
+	}
+
+	log.WithField("room_id", m.RoomID).Info("matrix: notification sent")
+	return nil
+}
@@ -0,0 +1,36 @@
+package matrix
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessage_Fire(t *testing.T) {
+	var got event
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.Header.Get("Authorization") != "Bearer syt_token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN"}`))
+			return
+		}
+		path = r.URL.EscapedPath()
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		w.Write([]byte(`{"event_id":"$abc"}`))
+	}))
+	defer srv.Close()
+
+	require.NoError(t, NewMessage(srv.URL, "syt_token", "!room:example.com", "New Recording", "body").Fire())
+	assert.True(t, strings.HasPrefix(path, "/_matrix/client/v3/rooms/%21room:example.com/send/m.room.message/"), path)
+	assert.Equal(t, event{MsgType: "m.text", Body: "New Recording\n\nbody"}, got)
+
+	err := NewMessage(srv.URL, "wrong", "!room:example.com", "s", "b").Fire()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "M_UNKNOWN_TOKEN")
+}
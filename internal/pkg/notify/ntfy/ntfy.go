@@ -0,0 +1,78 @@
+package ntfy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/httpclient"
+	"github.com/Xiol/tvhtc2/internal/pkg/notify/retry"
+	log "github.com/sirupsen/logrus"
+)
+
+const DefaultServer string = "https://ntfy.sh"
+
+// A Message is a notification published to an ntfy topic.
+type Message struct {
+	Server   string
+	Topic    string
+	Token    string
+	Subject  string
+	Body     string
+	Priority int
+
+	// Client sends requests, nil uses httpclient.Default.
+	Client *http.Client
+}
+
+// NewMessage returns a Message publishing subject and body to topic on server.
+// An empty server uses the public ntfy.sh instance. Token is optional.
+func NewMessage(server, topic, token, subject, body string) Message {
+	if server == "" {
+		server = DefaultServer
+	}
+
+	return Message{
+		Server:  strings.TrimRight(server, "/"),
+		Topic:   topic,
+		Token:   token,
+		Subject: subject,
+		Body:    body,
+	}
+}
+
+func (m Message) Fire() error {
+	if m.Topic == "" {
+		return fmt.Errorf("ntfy: no topic configured")
+	}
+
+	url := m.Server + "/" + m.Topic
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(m.Body))
+	if err != nil {
+		return fmt.Errorf("ntfy: error creating request: %s", err)
+	}
+
+	req.Header.Set("Title", m.Subject)
+	if m.Priority != 0 {
+		req.Header.Set("Priority", strconv.Itoa(m.Priority))
+	}
+	if m.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+m.Token)
+	}
+
+	resp, err := httpclient.Or(m.Client).Do(req)
+	if err != nil {
+		return retry.Temporaryf(0, "ntfy: error sending notification: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return retry.StatusError(resp, "ntfy: bad status code %d from %s, response body: %s", resp.StatusCode, url, body)
+	}
+
+	log.WithField("topic", m.Topic).Info("ntfy: notification sent")
+	return nil
+}
@@ -0,0 +1,44 @@
+package ntfy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessage_Fire(t *testing.T) {
+	var path, title, auth, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		title = r.Header.Get("Title")
+		auth = r.Header.Get("Authorization")
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		w.Write([]byte(`{"id":"abc"}`))
+	}))
+	defer srv.Close()
+
+	require.NoError(t, NewMessage(srv.URL+"/", "tvhtc2", "tk_123", "New Recording", "body").Fire())
+	assert.Equal(t, "/tvhtc2", path)
+	assert.Equal(t, "New Recording", title)
+	assert.Equal(t, "Bearer tk_123", auth)
+	assert.Equal(t, "body", body)
+
+	assert.Error(t, NewMessage(srv.URL, "", "", "s", "b").Fire())
+	assert.Equal(t, DefaultServer, NewMessage("", "t", "", "s", "b").Server)
+}
+
+func TestMessage_FireError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	err := NewMessage(srv.URL, "tvhtc2", "", "s", "b").Fire()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "401")
+}
@@ -0,0 +1,228 @@
+package notify
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/fsutil"
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/Xiol/tvhtc2/internal/pkg/notify/pushover"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// An Entry is a notification waiting in the outbox to be delivered.
+type Entry struct {
+	ID          string            `json:"id"`
+	Backend     string            `json:"backend"`
+	Recipient   string            `json:"recipient"`
+	Subject     string            `json:"subject"`
+	Body        string            `json:"body"`
+	Entity      *media.Entity     `json:"entity"`
+	Priority    pushover.Priority `json:"priority"`
+	Key         string            `json:"key"`
+	Created     time.Time         `json:"created"`
+	Attempts    int               `json:"attempts"`
+	NextAttempt time.Time         `json:"next_attempt"`
+	LastError   string            `json:"last_error,omitempty"`
+}
+
+func newEntry(backend, recipient, subject, body string, entity *media.Entity) *Entry {
+	sum := sha256.Sum256([]byte(backend + "\x00" + recipient + "\x00" + subject + "\x00" + body))
+	now := time.Now()
+
+	// ffmpeg's output can be large and isn't used by the backends
+	if entity != nil {
+		e := *entity
+		e.Stats.CommandStdout = nil
+		entity = &e
+	}
+
+	return &Entry{
+		ID:          uuid.New().String(),
+		Backend:     backend,
+		Recipient:   recipient,
+		Subject:     subject,
+		Body:        body,
+		Entity:      entity,
+		Key:         hex.EncodeToString(sum[:]),
+		Created:     now,
+		NextAttempt: now,
+	}
+}
+
+// Outbox persists notifications until they have been delivered, so they can
+// be retried after temporary failures and survive restarts. It also remembers
+// recently delivered notifications so duplicates aren't sent.
+type Outbox struct {
+	sync.Mutex
+	Entries map[string]*Entry    `json:"entries"`
+	Sent    map[string]time.Time `json:"sent"`
+
+	path string
+	// inFlight holds the entries being delivered, so they are only ever
+	// sent once at a time. It isn't saved, as nothing is in flight after a
+	// restart.
+	inFlight map[string]bool
+}
+
+// LoadOutbox reads the outbox at path, creating it if it doesn't exist.
+func LoadOutbox(path string) (*Outbox, error) {
+	o := &Outbox{
+		Entries:  make(map[string]*Entry),
+		Sent:     make(map[string]time.Time),
+		path:     path,
+		inFlight: make(map[string]bool),
+	}
+
+	rb, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return o, o.save()
+		}
+		return nil, fmt.Errorf("notify: error reading outbox: %s", err)
+	}
+
+	if err := json.Unmarshal(rb, o); err != nil {
+		// Losing queued notifications is better than refusing to start
+		log.WithError(err).WithField("path", path).Error("notify: outbox is corrupt, starting afresh")
+		o.Entries = make(map[string]*Entry)
+		o.Sent = make(map[string]time.Time)
+		return o, o.save()
+	}
+
+	if o.Entries == nil {
+		o.Entries = make(map[string]*Entry)
+	}
+	if o.Sent == nil {
+		o.Sent = make(map[string]time.Time)
+	}
+
+	log.WithField("pending_count", len(o.Entries)).Info("notify: loaded outbox from disk")
+	return o, nil
+}
+
+func (o *Outbox) save() error {
+	jout, err := json.Marshal(o)
+	if err != nil {
+		return fmt.Errorf("notify: error marshalling outbox: %s", err)
+	}
+
+	if err := fsutil.WriteFileAtomic(o.path, jout, 0640); err != nil {
+		return fmt.Errorf("notify: error writing outbox: %s", err)
+	}
+	return nil
+}
+
+// Add queues e unless an identical notification is already queued or was
+// delivered within window. It reports whether e was queued.
+func (o *Outbox) Add(e *Entry, window time.Duration) (bool, error) {
+	o.Lock()
+	defer o.Unlock()
+
+	if sent, ok := o.Sent[e.Key]; ok && time.Since(sent) < window {
+		return false, nil
+	}
+	for _, queued := range o.Entries {
+		if queued.Key == e.Key {
+			return false, nil
+		}
+	}
+
+	o.Entries[e.ID] = e
+	return true, o.save()
+}
+
+// Due claims the entries whose next attempt is at or before now and that
+// aren't already being delivered, and returns copies of them, oldest first.
+// Each must be released with Delivered, Retry or Remove.
+func (o *Outbox) Due(now time.Time) []Entry {
+	o.Lock()
+	defer o.Unlock()
+
+	var due []Entry
+	for id, e := range o.Entries {
+		if !e.NextAttempt.After(now) && !o.inFlight[id] {
+			o.inFlight[id] = true
+			due = append(due, *e)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].Created.Before(due[j].Created)
+	})
+	return due
+}
+
+// Claim marks the entry with id as being delivered, as Due does, and reports
+// whether it was free to claim.
+func (o *Outbox) Claim(id string) bool {
+	o.Lock()
+	defer o.Unlock()
+
+	if _, ok := o.Entries[id]; !ok || o.inFlight[id] {
+		return false
+	}
+	o.inFlight[id] = true
+	return true
+}
+
+// Delivered removes the entry with id from the outbox and remembers its key.
+func (o *Outbox) Delivered(id string, window time.Duration) error {
+	o.Lock()
+	defer o.Unlock()
+
+	delete(o.inFlight, id)
+	if e, ok := o.Entries[id]; ok {
+		o.Sent[e.Key] = time.Now()
+		delete(o.Entries, id)
+	}
+
+	for key, sent := range o.Sent {
+		if time.Since(sent) > window {
+			delete(o.Sent, key)
+		}
+	}
+	return o.save()
+}
+
+// Retry records a failed attempt at the entry with id and schedules the next.
+func (o *Outbox) Retry(id string, err error, next time.Time) error {
+	o.Lock()
+	defer o.Unlock()
+
+	delete(o.inFlight, id)
+	e, ok := o.Entries[id]
+	if !ok {
+		return nil
+	}
+
+	e.Attempts++
+	e.LastError = err.Error()
+	e.NextAttempt = next
+	return o.save()
+}
+
+// Remove drops the entry with id without remembering it as delivered.
+func (o *Outbox) Remove(id string) error {
+	o.Lock()
+	defer o.Unlock()
+
+	delete(o.inFlight, id)
+	delete(o.Entries, id)
+	return o.save()
+}
+
+// Len returns the number of notifications waiting to be delivered.
+func (o *Outbox) Len() int {
+	o.Lock()
+	defer o.Unlock()
+	return len(o.Entries)
+}
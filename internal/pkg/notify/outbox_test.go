@@ -0,0 +1,124 @@
+package notify
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/Xiol/tvhtc2/internal/pkg/notify/retry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeNotifier struct {
+	fire func() error
+}
+
+func (f fakeNotifier) Fire() error {
+	return f.fire()
+}
+
+// testHandler returns a Handler with a single fake backend whose Fire
+// returns the next error from results, or nil once they run out.
+func testHandler(t *testing.T, results ...error) (Handler, *int) {
+	h, err := NewHandler(Settings{
+		Recipients: map[string][]Config{"fake": {{Name: "foo", Default: true}}},
+		Outbox:     OutboxSettings{Path: filepath.Join(t.TempDir(), "outbox.json")},
+	})
+	require.NoError(t, err)
+	h.backends = map[string]BackendFunc{}
+
+	calls := 0
+	h.RegisterBackend("fake", func(r Config, c Content) (Notifier, error) {
+		return fakeNotifier{func() error {
+			calls++
+			if len(results) >= calls {
+				return results[calls-1]
+			}
+			return nil
+		}}, nil
+	})
+	return h, &calls
+}
+
+func testEntity() *media.Entity {
+	return &media.Entity{
+		Details: media.Details{Title: "Vera", Channel: "ITV", Status: "OK"},
+	}
+}
+
+func TestHandler_deduplicates(t *testing.T) {
+	h, calls := testHandler(t)
+
+	require.NoError(t, h.DoNotifications(testEntity()))
+	require.NoError(t, h.DoNotifications(testEntity()))
+	assert.Equal(t, 1, *calls)
+	assert.Equal(t, 0, h.outbox.Len())
+}
+
+func TestHandler_retriesTemporaryFailures(t *testing.T) {
+	h, calls := testHandler(t, retry.Temporaryf(2*time.Hour, "rate limited"))
+
+	require.NoError(t, h.DoNotifications(testEntity()), "temporary failures are queued, not returned")
+	require.Equal(t, 1, h.outbox.Len())
+	assert.Empty(t, h.outbox.Due(time.Now().Add(time.Hour)), "Retry-After is honoured over the backoff")
+
+	// The outbox survives a restart
+	reloaded, err := LoadOutbox(h.outbox.path)
+	require.NoError(t, err)
+	due := reloaded.Due(time.Now().Add(3 * time.Hour))
+	require.Len(t, due, 1)
+	assert.Equal(t, 1, due[0].Attempts)
+	assert.Equal(t, "rate limited", due[0].LastError)
+
+	require.NoError(t, h.deliver(due[0]))
+	assert.Equal(t, 2, *calls)
+	assert.Equal(t, 0, h.outbox.Len())
+}
+
+func TestNewEntry_stripsOutput(t *testing.T) {
+	entity := testEntity()
+	entity.Stats.CommandStdout = []byte("frame=1")
+
+	e := newEntry("fake", "foo", "subject", "body", entity)
+	assert.Nil(t, e.Entity.Stats.CommandStdout)
+	assert.Equal(t, "Vera", e.Entity.Title)
+	assert.Equal(t, []byte("frame=1"), entity.Stats.CommandStdout, "the entity itself is untouched")
+}
+
+func TestOutbox_claimsInFlightEntries(t *testing.T) {
+	o, err := LoadOutbox(filepath.Join(t.TempDir(), "outbox.json"))
+	require.NoError(t, err)
+
+	e := newEntry("fake", "foo", "subject", "body", nil)
+	_, err = o.Add(e, time.Hour)
+	require.NoError(t, err)
+
+	require.True(t, o.Claim(e.ID))
+	assert.Empty(t, o.Due(time.Now()), "entries being delivered aren't due")
+	assert.False(t, o.Claim(e.ID))
+
+	require.NoError(t, o.Retry(e.ID, fmt.Errorf("timeout"), time.Now()))
+	assert.Len(t, o.Due(time.Now()), 1, "released once the attempt is recorded")
+	assert.Empty(t, o.Due(time.Now()))
+}
+
+func TestHandler_permanentFailure(t *testing.T) {
+	h, _ := testHandler(t, fmt.Errorf("bad user key"))
+
+	assert.Error(t, h.DoNotifications(testEntity()))
+	assert.Equal(t, 0, h.outbox.Len())
+}
+
+func TestOutboxSettings_backoff(t *testing.T) {
+	var s OutboxSettings
+	assert.Equal(t, defaultInitialBackoff, s.backoff(0))
+	assert.Equal(t, 4*defaultInitialBackoff, s.backoff(2))
+	assert.Equal(t, defaultMaxBackoff, s.backoff(20))
+
+	s = OutboxSettings{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	assert.Equal(t, 4*time.Second, s.backoff(2))
+	assert.Equal(t, 5*time.Second, s.backoff(3))
+}
@@ -1,21 +1,39 @@
 package pushover
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"net/url"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
-	"github.com/Xiol/tvhtc2/internal/pkg/media"
-	"github.com/dustin/go-humanize"
+	"github.com/Xiol/tvhtc2/internal/pkg/httpclient"
+	"github.com/Xiol/tvhtc2/internal/pkg/notify/retry"
 	log "github.com/sirupsen/logrus"
 )
 
-const endpoint string = "https://api.pushover.net/1/messages.json"
+const DefaultAPIURL string = "https://api.pushover.net/1"
+
+// MaxAttachmentBytes is the largest attachment Pushover accepts.
+const MaxAttachmentBytes = 2621440
+
+// The longest text Pushover accepts, in characters. Longer text is cut
+// short rather than have the message rejected.
+const (
+	MaxTitleLength    = 250
+	MaxMessageLength  = 1024
+	MaxURLLength      = 512
+	MaxURLTitleLength = 100
+)
 
 type Priority int
 
@@ -27,49 +45,86 @@ const (
 	PriorityRequireConfirmation Priority = 2
 )
 
+// Emergency priority messages are repeated every Retry until acknowledged or
+// Expire has passed. These are the limits Pushover enforces.
+const (
+	MinRetry  = 30 * time.Second
+	MaxExpire = 3 * time.Hour
+)
+
 type Response struct {
-	Status  int    `json:"status"`
-	Request string `json:"request"`
+	Status  int      `json:"status"`
+	Request string   `json:"request"`
+	Receipt string   `json:"receipt"`
+	Errors  []string `json:"errors"`
+}
+
+// A Receipt is the state of an emergency priority message.
+type Receipt struct {
+	Status         int    `json:"status"`
+	Acknowledged   int    `json:"acknowledged"`
+	AcknowledgedAt int64  `json:"acknowledged_at"`
+	AcknowledgedBy string `json:"acknowledged_by"`
+	Expired        int    `json:"expired"`
+	ExpiresAt      int64  `json:"expires_at"`
+}
+
+// An Attachment is an image sent along with a message.
+type Attachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
 }
 
 type Message struct {
+	APIURL   string
 	User     string
 	Subject  string
 	Body     string
 	Priority Priority
 	ApiToken string
+
+	// URL is a supplementary link shown with the message, labelled URLTitle.
+	URL      string
+	URLTitle string
+	// Sound overrides the user's default notification sound.
+	Sound string
+	// Device sends the message to the named device rather than all of them.
+	Device string
+	// HTML allows simple HTML formatting in the body.
+	HTML       bool
+	Attachment *Attachment
+
+	// Retry and Expire control repeats of emergency priority messages.
+	Retry  time.Duration
+	Expire time.Duration
+	// ReceiptInterval is how often WatchReceipt polls the receipt of an
+	// emergency priority message. Zero disables watching.
+	ReceiptInterval time.Duration
+	// OnReceipt, if set, is given the receipt of each emergency priority
+	// message sent, so the caller can watch it with WatchReceipt.
+	OnReceipt func(receipt string)
+
+	// Client sends requests, nil uses httpclient.Default.
+	Client *http.Client
 }
 
-func NewMessage(apiToken, user string, entity *media.Entity) Message {
-	var subj string
-	if entity.Ok() {
-		subj = fmt.Sprintf("New Recording: %s (%s)", entity.Title, entity.Channel)
-	} else {
-		subj = fmt.Sprintf("Failed Recording: %s (%s)", entity.Title, entity.Channel)
-	}
-
-	sb := strings.Builder{}
-	sb.WriteString(strings.TrimSpace(entity.Description))
-	sb.WriteString("\n\n")
-	if entity.Ok() {
-		if entity.IsTranscodable() {
-			sb.WriteString(fmt.Sprintf("Transcode completed in %s minutes, size change %s->%s. Path: %s",
-				entity.Stats.Duration.Round(time.Minute), humanize.IBytes(entity.Stats.InitialSizeBytes),
-				humanize.IBytes(entity.Stats.EndSizeBytes), entity.DestPath))
-		} else {
-			sb.WriteString(fmt.Sprintf("Skipped transcoding. Size %s. Path: %s",
-				humanize.IBytes(entity.Stats.InitialSizeBytes), entity.DestPath))
-		}
-	} else {
-		sb.WriteString(fmt.Sprintf("Errors encountered when processing media: %s", entity.Error()))
+// NewMessage returns a Message sending subject and body to the given user key.
+// An empty apiURL uses the public Pushover API.
+func NewMessage(apiURL, apiToken, user, subject, body string) Message {
+	if apiURL == "" {
+		apiURL = DefaultAPIURL
 	}
 
 	return Message{
+		APIURL:   strings.TrimRight(apiURL, "/"),
 		User:     user,
-		Subject:  subj,
-		Body:     sb.String(),
+		Subject:  subject,
+		Body:     body,
 		Priority: PriorityNormal,
 		ApiToken: apiToken,
+		Retry:    time.Minute,
+		Expire:   time.Hour,
 	}
 }
 
@@ -79,17 +134,94 @@ func (m Message) values() url.Values {
 	v.Add("user", m.User)
 	v.Add("priority", strconv.Itoa(int(m.Priority)))
 	v.Add("timestamp", strconv.Itoa(int(time.Now().Unix())))
-	v.Add("message", m.Body)
-	v.Add("title", m.Subject)
+	v.Add("message", truncate(m.Body, MaxMessageLength))
+	v.Add("title", truncate(m.Subject, MaxTitleLength))
+
+	// A shortened URL would be broken, so it is left out instead
+	if m.URL != "" && utf8.RuneCountInString(m.URL) <= MaxURLLength {
+		v.Add("url", m.URL)
+		if m.URLTitle != "" {
+			v.Add("url_title", truncate(m.URLTitle, MaxURLTitleLength))
+		}
+	}
+	if m.Sound != "" {
+		v.Add("sound", m.Sound)
+	}
+	if m.Device != "" {
+		v.Add("device", m.Device)
+	}
+	if m.HTML {
+		v.Add("html", "1")
+	}
+
+	if m.Priority == PriorityRequireConfirmation {
+		retry, expire := m.Retry, m.Expire
+		if retry < MinRetry {
+			retry = MinRetry
+		}
+		if expire <= 0 || expire > MaxExpire {
+			expire = MaxExpire
+		}
+		v.Add("retry", strconv.Itoa(int(retry.Seconds())))
+		v.Add("expire", strconv.Itoa(int(expire.Seconds())))
+	}
 	return v
 }
 
+// truncate shortens s to at most max characters, ending with an ellipsis
+// where it was cut.
+func truncate(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	return string([]rune(s)[:max-1]) + "…"
+}
+
+// body returns the request body and its content type, which is multipart
+// when there is an attachment.
+func (m Message) body() (io.Reader, string, error) {
+	values := m.values()
+	if m.Attachment == nil {
+		return strings.NewReader(values.Encode()), "application/x-www-form-urlencoded", nil
+	}
+
+	if len(m.Attachment.Data) > MaxAttachmentBytes {
+		return nil, "", fmt.Errorf("pushover: attachment is %d bytes, the limit is %d", len(m.Attachment.Data), MaxAttachmentBytes)
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for k := range values {
+		if err := mw.WriteField(k, values.Get(k)); err != nil {
+			return nil, "", fmt.Errorf("pushover: error writing form: %s", err)
+		}
+	}
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="attachment"; filename="%s"`, m.Attachment.Name))
+	h.Set("Content-Type", m.Attachment.ContentType)
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		return nil, "", fmt.Errorf("pushover: error writing attachment: %s", err)
+	}
+	if _, err := part.Write(m.Attachment.Data); err != nil {
+		return nil, "", fmt.Errorf("pushover: error writing attachment: %s", err)
+	}
+	if err := mw.Close(); err != nil {
+		return nil, "", fmt.Errorf("pushover: error writing form: %s", err)
+	}
+	return &buf, mw.FormDataContentType(), nil
+}
+
 func (m Message) Fire() error {
-	payload := m.values()
+	payload, contentType, err := m.body()
+	if err != nil {
+		return err
+	}
 
-	resp, err := http.PostForm(endpoint, payload)
+	resp, err := httpclient.Or(m.Client).Post(m.APIURL+"/messages.json", contentType, payload)
 	if err != nil {
-		return fmt.Errorf("pushover: error sending notification: %s", err)
+		return retry.Temporaryf(0, "pushover: error sending notification: %s", err)
 	}
 	defer resp.Body.Close()
 
@@ -98,15 +230,11 @@ func (m Message) Fire() error {
 		return fmt.Errorf("pushover: unable to read response body: %s", err)
 	}
 
-	if resp.StatusCode > 200 && resp.StatusCode < 500 {
-		return fmt.Errorf("pushover: bad status code %d from Pushover API, response body: %s",
+	if resp.StatusCode > 200 {
+		return retry.StatusError(resp, "pushover: bad status code %d from Pushover API, response body: %s",
 			resp.StatusCode, body)
 	}
 
-	if resp.StatusCode >= 500 {
-		return fmt.Errorf("pushover: status code %d from Pushover API indicates temporary failure, but not retrying", resp.StatusCode)
-	}
-
 	pr := Response{}
 	err = json.Unmarshal(body, &pr)
 	if err != nil {
@@ -120,5 +248,93 @@ func (m Message) Fire() error {
 
 	log.WithField("user", m.User).Info("pushover: notification sent")
 	log.WithField("message", m.Body).Debug("pushover: message body")
+
+	if pr.Receipt != "" && m.ReceiptInterval > 0 && m.OnReceipt != nil {
+		m.OnReceipt(pr.Receipt)
+	}
 	return nil
 }
+
+// WatchReceipt polls the receipt every ReceiptInterval until the message has
+// been acknowledged or has expired, or done is closed, and logs the outcome.
+func (m Message) WatchReceipt(receipt string, done <-chan struct{}) {
+	fields := log.Fields{"user": m.User, "receipt": receipt}
+
+	r, err := m.PollReceipt(receipt, m.ReceiptInterval, done)
+	if err == ErrStopped {
+		log.WithFields(fields).Debug("pushover: stopped watching receipt")
+		return
+	}
+	if err != nil {
+		log.WithError(err).WithFields(fields).Error("pushover: error polling receipt")
+		return
+	}
+
+	if r.Acknowledged == 1 {
+		log.WithFields(fields).WithFields(log.Fields{
+			"by": r.AcknowledgedBy,
+			"at": time.Unix(r.AcknowledgedAt, 0),
+		}).Info("pushover: emergency notification acknowledged")
+		return
+	}
+	log.WithFields(fields).Warning("pushover: emergency notification expired without being acknowledged")
+}
+
+// GetReceipt returns the current state of an emergency priority message.
+func (m Message) GetReceipt(receipt string) (Receipt, error) {
+	var r Receipt
+
+	u := fmt.Sprintf("%s/receipts/%s.json?token=%s", m.APIURL, url.PathEscape(receipt), url.QueryEscape(m.ApiToken))
+	resp, err := httpclient.Or(m.Client).Get(u)
+	if err != nil {
+		return r, retry.Temporaryf(0, "pushover: error getting receipt: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return r, fmt.Errorf("pushover: unable to read receipt response body: %s", err)
+	}
+
+	if resp.StatusCode > 200 {
+		return r, retry.StatusError(resp, "pushover: bad status code %d getting receipt, response body: %s",
+			resp.StatusCode, body)
+	}
+
+	if err := json.Unmarshal(body, &r); err != nil {
+		return r, fmt.Errorf("pushover: could not unmarshal receipt: %s", err)
+	}
+	if r.Status != 1 {
+		return r, fmt.Errorf("pushover: receipt status was %d, expected 1", r.Status)
+	}
+	return r, nil
+}
+
+// ErrStopped is returned by PollReceipt when it is stopped before the
+// message has been acknowledged or has expired.
+var ErrStopped = errors.New("pushover: stopped polling receipt")
+
+// PollReceipt checks the receipt every interval until the message has been
+// acknowledged or has expired, or done is closed. Temporary errors are
+// retried until no message could still be pending.
+func (m Message) PollReceipt(receipt string, interval time.Duration, done <-chan struct{}) (Receipt, error) {
+	deadline := time.Now().Add(MaxExpire)
+	for {
+		r, err := m.GetReceipt(receipt)
+		if err == nil && (r.Acknowledged == 1 || r.Expired == 1) {
+			return r, nil
+		}
+		if err != nil {
+			if temp, _ := retry.IsTemporary(err); !temp || time.Now().After(deadline) {
+				return r, err
+			}
+			log.WithError(err).WithField("receipt", receipt).Warning("pushover: temporary error polling receipt")
+		}
+
+		select {
+		case <-done:
+			return r, ErrStopped
+		case <-time.After(interval):
+		}
+	}
+}
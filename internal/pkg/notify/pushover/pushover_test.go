@@ -0,0 +1,270 @@
+package pushover
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/notify/retry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePushover is a minimal Pushover API that records the messages it is
+// sent and acknowledges receipts after a number of polls.
+type fakePushover struct {
+	sync.Mutex
+	*httptest.Server
+	messages   []*http.Request
+	attachment []byte
+	polls      int
+	ackAfter   int
+}
+
+func newFakePushover(t *testing.T) *fakePushover {
+	f := &fakePushover{ackAfter: 2}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.Lock()
+		defer f.Unlock()
+
+		switch {
+		case r.URL.Path == "/messages.json":
+			if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+				t.Errorf("parsing form: %s", err)
+			}
+			if r.FormValue("token") != "apptoken" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"status":0,"errors":["application token is invalid"]}`))
+				return
+			}
+			if file, _, err := r.FormFile("attachment"); err == nil {
+				f.attachment, _ = ioutil.ReadAll(file)
+			}
+			f.messages = append(f.messages, r)
+			if r.FormValue("priority") == "2" {
+				w.Write([]byte(`{"status":1,"request":"req","receipt":"rcpt"}`))
+				return
+			}
+			w.Write([]byte(`{"status":1,"request":"req"}`))
+		case r.URL.Path == "/receipts/rcpt.json" && r.URL.Query().Get("token") == "apptoken":
+			f.polls++
+			if f.polls >= f.ackAfter {
+				w.Write([]byte(`{"status":1,"acknowledged":1,"acknowledged_at":1577869200,"acknowledged_by":"user"}`))
+				return
+			}
+			w.Write([]byte(`{"status":1,"acknowledged":0,"expired":0}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"status":0}`))
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakePushover) message(i int) *http.Request {
+	f.Lock()
+	defer f.Unlock()
+	return f.messages[i]
+}
+
+func TestMessage_Fire(t *testing.T) {
+	f := newFakePushover(t)
+
+	m := NewMessage(f.URL, "apptoken", "userkey", "New Recording", "<b>Vera</b>")
+	m.Client = f.Client()
+	m.URL = "https://jellyfin.example.com/Vera"
+	m.URLTitle = "Watch"
+	m.Sound = "magic"
+	m.Device = "phone"
+	m.HTML = true
+	require.NoError(t, m.Fire())
+
+	r := f.message(0)
+	assert.Equal(t, "userkey", r.FormValue("user"))
+	assert.Equal(t, "New Recording", r.FormValue("title"))
+	assert.Equal(t, "<b>Vera</b>", r.FormValue("message"))
+	assert.Equal(t, "https://jellyfin.example.com/Vera", r.FormValue("url"))
+	assert.Equal(t, "Watch", r.FormValue("url_title"))
+	assert.Equal(t, "magic", r.FormValue("sound"))
+	assert.Equal(t, "phone", r.FormValue("device"))
+	assert.Equal(t, "1", r.FormValue("html"))
+	assert.Empty(t, r.FormValue("retry"))
+}
+
+func TestMessage_Fire_truncates(t *testing.T) {
+	f := newFakePushover(t)
+
+	// Failure notifications include ffmpeg's output, which can be long
+	m := NewMessage(f.URL, "apptoken", "userkey", strings.Repeat("T", 300), strings.Repeat("é", 2000))
+	m.Client = f.Client()
+	m.URL = "https://jellyfin.example.com/" + strings.Repeat("x", MaxURLLength)
+	m.URLTitle = "Watch"
+	require.NoError(t, m.Fire())
+
+	r := f.message(0)
+	assert.Len(t, []rune(r.FormValue("title")), MaxTitleLength)
+	assert.Len(t, []rune(r.FormValue("message")), MaxMessageLength)
+	assert.True(t, strings.HasSuffix(r.FormValue("message"), "é…"))
+	assert.Empty(t, r.FormValue("url"), "a URL that is too long is left out")
+	assert.Empty(t, r.FormValue("url_title"))
+}
+
+func TestMessage_Fire_attachment(t *testing.T) {
+	f := newFakePushover(t)
+
+	m := NewMessage(f.URL, "apptoken", "userkey", "s", "b")
+	m.Client = f.Client()
+	m.Attachment = &Attachment{Name: "thumbnail.jpg", ContentType: "image/jpeg", Data: []byte("jpegdata")}
+	require.NoError(t, m.Fire())
+
+	assert.Equal(t, "userkey", f.message(0).FormValue("user"))
+	assert.Equal(t, []byte("jpegdata"), f.attachment)
+
+	m.Attachment.Data = make([]byte, MaxAttachmentBytes+1)
+	assert.Error(t, m.Fire())
+}
+
+func TestMessage_Fire_emergency(t *testing.T) {
+	f := newFakePushover(t)
+
+	m := NewMessage(f.URL, "apptoken", "userkey", "Failed Recording", "b")
+	m.Client = f.Client()
+	m.Priority = PriorityRequireConfirmation
+	m.Retry = time.Second
+	m.Expire = 24 * time.Hour
+	m.ReceiptInterval = time.Minute
+	var receipts []string
+	m.OnReceipt = func(receipt string) { receipts = append(receipts, receipt) }
+	require.NoError(t, m.Fire())
+
+	r := f.message(0)
+	assert.Equal(t, "2", r.FormValue("priority"))
+	assert.Equal(t, "30", r.FormValue("retry"), "retry is raised to the minimum")
+	assert.Equal(t, "10800", r.FormValue("expire"), "expire is capped at the maximum")
+
+	assert.Equal(t, []string{"rcpt"}, receipts)
+
+	done := make(chan struct{})
+	close(done)
+	_, err := m.PollReceipt("rcpt", time.Hour, done)
+	assert.Equal(t, ErrStopped, err, "polling stops when done is closed")
+
+	rcpt, err := m.PollReceipt("rcpt", time.Millisecond, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, rcpt.Acknowledged)
+	assert.Equal(t, "user", rcpt.AcknowledgedBy)
+	assert.Equal(t, 2, f.polls)
+
+	_, err = m.GetReceipt("missing")
+	assert.Error(t, err)
+}
+
+func TestMessage_Fire_errors(t *testing.T) {
+	f := newFakePushover(t)
+
+	m := NewMessage(f.URL, "wrong", "userkey", "s", "b")
+	m.Client = f.Client()
+	err := m.Fire()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "application token is invalid")
+	temp, _ := retry.IsTemporary(err)
+	assert.False(t, temp)
+
+	f.Close()
+	m.ApiToken = "apptoken"
+	err = m.Fire()
+	require.Error(t, err)
+	temp, _ = retry.IsTemporary(err)
+	assert.True(t, temp, "connection errors are temporary")
+}
+
+func TestMessage_Fire_errorPaths(t *testing.T) {
+	tests := []struct {
+		name      string
+		handler   http.HandlerFunc
+		temporary bool
+		after     time.Duration
+		contains  string
+	}{
+		{
+			name: "rate limited",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Retry-After", "120")
+				w.WriteHeader(http.StatusTooManyRequests)
+			},
+			temporary: true,
+			after:     2 * time.Minute,
+			contains:  "bad status code 429",
+		},
+		{
+			name: "server error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("oops"))
+			},
+			temporary: true,
+			contains:  "oops",
+		},
+		{
+			name: "invalid user",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"status":0,"errors":["user identifier is invalid"]}`))
+			},
+			contains: "user identifier is invalid",
+		},
+		{
+			name: "bad json",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("<html>"))
+			},
+			contains: "could not unmarshal",
+		},
+		{
+			name: "bad status",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"status":0}`))
+			},
+			contains: "API status was 0",
+		},
+		{
+			name: "truncated body",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "100")
+				w.Write([]byte(`{"status":1`))
+			},
+			contains: "unable to read response body",
+		},
+		{
+			name: "timeout",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(200 * time.Millisecond)
+			},
+			temporary: true,
+			contains:  "error sending notification",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+
+			m := NewMessage(srv.URL, "apptoken", "userkey", "s", "b")
+			m.Client = srv.Client()
+			m.Client.Timeout = 50 * time.Millisecond
+
+			err := m.Fire()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.contains)
+			temp, after := retry.IsTemporary(err)
+			assert.Equal(t, tt.temporary, temp)
+			assert.Equal(t, tt.after, after)
+		})
+	}
+}
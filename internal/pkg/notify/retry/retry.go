@@ -0,0 +1,84 @@
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error marks a failed delivery as temporary, so it is worth trying again.
+// After is how long the remote end asked us to wait, if it said.
+type Error struct {
+	Err   error
+	After time.Duration
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Temporary wraps err to mark it as temporary.
+func Temporary(err error, after time.Duration) error {
+	return &Error{Err: err, After: after}
+}
+
+// Temporaryf formats an error and marks it as temporary.
+func Temporaryf(after time.Duration, format string, args ...interface{}) error {
+	return Temporary(fmt.Errorf(format, args...), after)
+}
+
+// IsTemporary reports whether err was marked as temporary, and how long the
+// remote end asked us to wait before retrying.
+func IsTemporary(err error) (bool, time.Duration) {
+	var re *Error
+	if errors.As(err, &re) {
+		return true, re.After
+	}
+	return false, 0
+}
+
+// RetryableStatus reports whether an HTTP status code indicates a temporary
+// failure: rate limiting or a server side error.
+func RetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// StatusError returns an error for a bad HTTP response, marked as temporary
+// if the status code warrants a retry. The Retry-After header is honoured.
+func StatusError(resp *http.Response, format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+	if !RetryableStatus(resp.StatusCode) {
+		return err
+	}
+	return Temporary(err, ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()))
+}
+
+// ParseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date. It returns zero if the header is missing or invalid.
+func ParseRetryAfter(header string, now time.Time) time.Duration {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(header); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+
+	if t, err := http.ParseTime(header); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
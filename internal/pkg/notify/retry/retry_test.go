@@ -0,0 +1,40 @@
+package retry
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, time.Duration(0), ParseRetryAfter("", now))
+	assert.Equal(t, 120*time.Second, ParseRetryAfter("120", now))
+	assert.Equal(t, time.Duration(0), ParseRetryAfter("-5", now))
+	assert.Equal(t, time.Duration(0), ParseRetryAfter("soon", now))
+	assert.Equal(t, 90*time.Second, ParseRetryAfter(now.Add(90*time.Second).Format(http.TimeFormat), now))
+}
+
+func TestStatusError(t *testing.T) {
+	resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}
+	resp.Header.Set("Retry-After", "30")
+
+	temp, after := IsTemporary(StatusError(resp, "rate limited"))
+	assert.True(t, temp)
+	assert.Equal(t, 30*time.Second, after)
+
+	resp = &http.Response{StatusCode: http.StatusBadGateway, Header: http.Header{}}
+	temp, _ = IsTemporary(StatusError(resp, "bad gateway"))
+	assert.True(t, temp)
+
+	resp = &http.Response{StatusCode: http.StatusBadRequest, Header: http.Header{}}
+	temp, _ = IsTemporary(StatusError(resp, "bad request"))
+	assert.False(t, temp)
+
+	temp, _ = IsTemporary(fmt.Errorf("wrapped: %w", Temporary(fmt.Errorf("boom"), 0)))
+	assert.True(t, temp)
+}
@@ -0,0 +1,218 @@
+package notify
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/Xiol/tvhtc2/internal/pkg/notify/pushover"
+	"github.com/Xiol/tvhtc2/internal/pkg/timewindow"
+	log "github.com/sirupsen/logrus"
+)
+
+// A Rule decides whether a recipient is notified about a recording. The
+// regexps are case-insensitive and every non-empty field must match. Type is
+// one of video (any video), h264, audio or unknown, and Outcome is one of the
+// notification outcomes. A matching rule with Exclude set stops the recipient
+// being notified at all, otherwise they are notified with Priority.
+type Rule struct {
+	Title       string
+	Channel     string
+	Description string
+	Status      string
+	Type        string
+	Outcome     string
+	Exclude     bool
+	Priority    pushover.Priority
+}
+
+// Validate checks that the rule's regexps compile and its other fields are valid.
+func (r Rule) Validate() error {
+	for _, rgx := range []string{r.Title, r.Channel, r.Description, r.Status} {
+		if _, err := regexp.Compile("(?i)" + rgx); err != nil {
+			return fmt.Errorf("notify: rule regex '%s' did not compile: %s", rgx, err)
+		}
+	}
+
+	switch strings.ToLower(r.Type) {
+	case "", "video", "h264", "audio", "unknown":
+	default:
+		return fmt.Errorf("notify: unknown media type '%s' in rule", r.Type)
+	}
+
+	if r.Outcome != "" {
+		known := false
+		for _, o := range Outcomes {
+			known = known || string(o) == strings.ToLower(r.Outcome)
+		}
+		if !known {
+			return fmt.Errorf("notify: unknown outcome '%s' in rule", r.Outcome)
+		}
+	}
+
+	if r.Priority < pushover.PriorityNoNotification || r.Priority > pushover.PriorityRequireConfirmation {
+		return fmt.Errorf("notify: priority %d in rule is out of range -2 to 2", r.Priority)
+	}
+	return nil
+}
+
+// Match reports whether the rule applies to entity with the given outcome.
+func (r Rule) Match(entity *media.Entity, outcome Outcome) (bool, error) {
+	for _, m := range []struct{ rgx, value string }{
+		{r.Title, entity.Title},
+		{r.Channel, entity.Channel},
+		{r.Description, entity.Description},
+		{r.Status, entity.Status},
+	} {
+		if m.rgx == "" {
+			continue
+		}
+		rgx, err := regexp.Compile("(?i)" + m.rgx)
+		if err != nil {
+			return false, fmt.Errorf("notify: error compiling rule regex '%s': %s", m.rgx, err)
+		}
+		if !rgx.MatchString(m.value) {
+			return false, nil
+		}
+	}
+
+	if t := strings.ToLower(r.Type); t != "" {
+		mt := entity.Media.String()
+		if t != mt && !(t == "video" && mt == "h264") {
+			return false, nil
+		}
+	}
+
+	if r.Outcome != "" && Outcome(strings.ToLower(r.Outcome)) != outcome {
+		return false, nil
+	}
+	return true, nil
+}
+
+// rules returns the recipient's rules followed by its title regexps.
+func (c Config) rules() []Rule {
+	rules := append([]Rule(nil), c.Rules...)
+	for _, rgx := range c.Notify {
+		rules = append(rules, Rule{Title: rgx})
+	}
+	return rules
+}
+
+// A Recipient is a configured recipient chosen to receive a notification.
+type Recipient struct {
+	Config
+	Priority pushover.Priority
+}
+
+// quietUntil reports whether the recipient is in quiet hours at now, and if
+// so when they end. High priority notifications ignore quiet hours.
+func (r Recipient) quietUntil(now time.Time) (time.Time, bool) {
+	if r.QuietHours == "" || r.Priority >= pushover.PriorityHighPriority {
+		return time.Time{}, false
+	}
+
+	w, err := timewindow.Parse(r.QuietHours)
+	if err != nil {
+		log.WithError(err).WithField("name", r.Name).Error("notify: invalid quiet hours, ignoring")
+		return time.Time{}, false
+	}
+
+	if !w.Contains(now) {
+		return time.Time{}, false
+	}
+	return w.NextEnd(now), true
+}
+
+// route returns the recipients that should be notified about entity. Each
+// recipient's rules are checked in order and the first match decides. If
+// no recipient matched, the default recipient is used unless they were
+// explicitly excluded. Admin recipients additionally get every failure.
+func route(backend string, nconf []Config, entity *media.Entity, outcome Outcome) ([]Recipient, error) {
+	var recipients []Recipient
+	var def *Config
+	excluded := make(map[string]bool)
+	included := make(map[string]bool)
+
+	for i, conf := range nconf {
+		if conf.Default {
+			def = &nconf[i]
+		}
+
+		for _, rule := range conf.rules() {
+			ok, err := rule.Match(entity, outcome)
+			if err != nil {
+				return nil, fmt.Errorf("notify: %s recipient '%s': %s", backend, conf.Name, err)
+			}
+			if !ok {
+				continue
+			}
+
+			fields := log.Fields{
+				"backend": backend,
+				"name":    conf.Name,
+				"title":   entity.Title,
+			}
+			if rule.Exclude {
+				excluded[conf.Name] = true
+				log.WithFields(fields).Debug("notify: recipient excluded by rule")
+				break
+			}
+
+			recipients = append(recipients, Recipient{Config: conf, Priority: rule.Priority})
+			included[conf.Name] = true
+			log.WithFields(fields).WithField("priority", rule.Priority).Debug("notify: adding notification")
+			break
+		}
+	}
+
+	if len(recipients) == 0 && def != nil && !excluded[def.Name] {
+		recipients = append(recipients, Recipient{Config: *def})
+		included[def.Name] = true
+		log.WithFields(log.Fields{
+			"backend": backend,
+			"name":    def.Name,
+			"title":   entity.Title,
+		}).Debug("notify: no match for recording, sending to default recipient")
+	}
+
+	if outcome == OutcomeFailed || outcome == OutcomeQuarantined {
+		for _, conf := range nconf {
+			if conf.Admin && !included[conf.Name] {
+				recipients = append(recipients, Recipient{Config: conf, Priority: pushover.PriorityHighPriority})
+				log.WithFields(log.Fields{
+					"backend": backend,
+					"name":    conf.Name,
+					"title":   entity.Title,
+				}).Debug("notify: sending failure to admin recipient")
+			}
+		}
+	}
+
+	return recipients, nil
+}
+
+// ValidateRouting checks the routing configuration of every built in backend.
+func (s Settings) ValidateRouting() error {
+	for _, backend := range Backends() {
+		for _, conf := range s.recipients(backend) {
+			for _, rule := range conf.rules() {
+				if err := rule.Validate(); err != nil {
+					return fmt.Errorf("notify: %s recipient '%s': %s", backend, conf.Name, err)
+				}
+			}
+			if conf.Digest != "" {
+				if _, _, err := conf.digestPeriod(time.Now()); err != nil {
+					return fmt.Errorf("notify: %s recipient '%s': %s", backend, conf.Name, err)
+				}
+			}
+			if conf.QuietHours != "" {
+				if _, err := timewindow.Parse(conf.QuietHours); err != nil {
+					return fmt.Errorf("notify: %s recipient '%s': %s", backend, conf.Name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package notify
+
+import (
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/ffmpeg"
+	"github.com/Xiol/tvhtc2/internal/pkg/httpclient"
+)
+
+// Settings is the whole of the notification configuration. A Handler works
+// from a snapshot of it, which is only ever replaced as a whole by Update.
+type Settings struct {
+	// Recipients are those configured under notifications.<backend>, keyed
+	// by backend.
+	Recipients map[string][]Config
+	// Backends holds the settings shared by all of a backend's recipients,
+	// configured under <backend>.
+	Backends map[string]map[string]interface{}
+	// Templates override the default templates, keyed by backend, or
+	// "default" for all of them, then outcome.
+	Templates map[string]map[Outcome]Template
+
+	Outbox OutboxSettings
+	Digest DigestSettings
+	HTTP   httpclient.Options
+	// FFmpeg is used when extracting thumbnails.
+	FFmpeg ffmpeg.Options
+}
+
+// OutboxSettings controls where notifications are queued and how they are
+// retried. Zero durations use the defaults.
+type OutboxSettings struct {
+	Path           string
+	RetryInterval  time.Duration
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	MaxAge         time.Duration
+	DedupWindow    time.Duration
+}
+
+// DigestSettings are the defaults for recipients that get digests. Empty
+// values use the defaults.
+type DigestSettings struct {
+	Time     string
+	Day      string
+	Interval time.Duration
+}
+
+// recipients returns the recipients configured for backend, with the
+// backend-wide settings and digest defaults filled in.
+func (s Settings) recipients(backend string) []Config {
+	nconf := make([]Config, len(s.Recipients[backend]))
+	for i, conf := range s.Recipients[backend] {
+		conf.shared = s.Backends
+		if conf.DigestTime == "" {
+			conf.DigestTime = s.Digest.Time
+		}
+		if conf.DigestDay == "" {
+			conf.DigestDay = s.Digest.Day
+		}
+		nconf[i] = conf
+	}
+	return nconf
+}
+
+// httpOptions returns the HTTP client options for backend, which can be
+// overridden by its timeout and proxy settings.
+func (s Settings) httpOptions(backend string) httpclient.Options {
+	opts := s.HTTP
+	shared := Config{shared: s.Backends}
+	if t, err := shared.DurationOption(backend, "timeout", 0); err == nil && t > 0 {
+		opts.Timeout = t
+	}
+	if p := shared.Option(backend, "proxy"); p != "" {
+		opts.Proxy = p
+	}
+	return opts
+}
+
+func durationOr(d, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
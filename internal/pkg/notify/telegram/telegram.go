@@ -0,0 +1,122 @@
+package telegram
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/httpclient"
+	"github.com/Xiol/tvhtc2/internal/pkg/notify/retry"
+	log "github.com/sirupsen/logrus"
+)
+
+const DefaultAPIURL string = "https://api.telegram.org"
+
+// MaxTextLength is the longest message Telegram accepts, in characters.
+// Longer messages are cut short rather than have them rejected.
+const MaxTextLength = 4096
+
+type sendMessage struct {
+	ChatID string `json:"chat_id"`
+	Text   string `json:"text"`
+}
+
+// Response is the envelope returned by every Telegram Bot API method.
+type Response struct {
+	OK          bool   `json:"ok"`
+	Description string `json:"description"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+// A Message is a notification sent to a Telegram chat by a bot.
+type Message struct {
+	APIURL   string
+	BotToken string
+	ChatID   string
+	Subject  string
+	Body     string
+
+	// Client sends requests, nil uses httpclient.Default.
+	Client *http.Client
+}
+
+// NewMessage returns a Message sending subject and body to chatID. An empty
+// apiURL uses the public Telegram Bot API.
+func NewMessage(apiURL, botToken, chatID, subject, body string) Message {
+	if apiURL == "" {
+		apiURL = DefaultAPIURL
+	}
+
+	return Message{
+		APIURL:   strings.TrimRight(apiURL, "/"),
+		BotToken: botToken,
+		ChatID:   chatID,
+		Subject:  subject,
+		Body:     body,
+	}
+}
+
+func (m Message) Fire() error {
+	if m.BotToken == "" || m.ChatID == "" {
+		return fmt.Errorf("telegram: bot token and chat ID must be configured")
+	}
+
+	p, err := json.Marshal(sendMessage{ChatID: m.ChatID, Text: truncate(m.Subject+"\n\n"+m.Body, MaxTextLength)})
+	if err != nil {
+		return fmt.Errorf("telegram: error marshalling payload: %s", err)
+	}
+
+	resp, err := httpclient.Or(m.Client).Post(m.APIURL+"/bot"+m.BotToken+"/sendMessage", "application/json", bytes.NewReader(p))
+	if err != nil {
+		// Don't leak the bot token, which is part of the URL
+		return retry.Temporaryf(0, "telegram: error sending notification: %s", strings.Replace(err.Error(), m.BotToken, "<token>", -1))
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("telegram: unable to read response body: %s", err)
+	}
+
+	var tr Response
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return retry.StatusError(resp, "telegram: could not unmarshal response (status %d): %s", resp.StatusCode, err)
+	}
+
+	if resp.StatusCode != http.StatusOK || !tr.OK {
+		// Telegram puts the time to wait in the body rather than a header
+		if tr.Parameters.RetryAfter > 0 {
+			return retry.Temporaryf(time.Duration(tr.Parameters.RetryAfter)*time.Second,
+				"telegram: rate limited by Telegram API: %s", tr.Description)
+		}
+		return retry.StatusError(resp, "telegram: bad status code %d from Telegram API: %s", resp.StatusCode, tr.Description)
+	}
+
+	log.WithField("chat_id", m.ChatID).Info("telegram: notification sent")
+	return nil
+}
+
+// truncate shortens s to at most max characters, ending with an ellipsis
+// where it was cut. Telegram counts characters in UTF-16, so characters
+// outside the Basic Multilingual Plane count twice.
+func truncate(s string, max int) string {
+	if len(utf16.Encode([]rune(s))) <= max {
+		return s
+	}
+
+	n := 1 // the ellipsis
+	for i, r := range s {
+		n += utf16.RuneLen(r)
+		if n > max {
+			return s[:i] + "…"
+		}
+	}
+	return s
+}
@@ -0,0 +1,46 @@
+package telegram
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessage_Fire(t *testing.T) {
+	var got sendMessage
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bot123:abc/sendMessage" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"ok":false,"description":"Unauthorized"}`))
+			return
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		w.Write([]byte(`{"ok":true,"result":{}}`))
+	}))
+	defer srv.Close()
+
+	require.NoError(t, NewMessage(srv.URL, "123:abc", "42", "New Recording", "body").Fire())
+	assert.Equal(t, sendMessage{ChatID: "42", Text: "New Recording\n\nbody"}, got)
+
+	err := NewMessage(srv.URL, "wrong", "42", "s", "b").Fire()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Unauthorized")
+
+	assert.Error(t, NewMessage(srv.URL, "123:abc", "", "s", "b").Fire())
+
+	// Failure notifications include ffmpeg's output, which can be long
+	require.NoError(t, NewMessage(srv.URL, "123:abc", "42", "Failed", strings.Repeat("é", 5000)).Fire())
+	assert.Len(t, []rune(got.Text), MaxTextLength)
+	assert.True(t, strings.HasSuffix(got.Text, "é…"))
+}
+
+func TestTruncate(t *testing.T) {
+	assert.Equal(t, "short", truncate("short", 10))
+	assert.Equal(t, "abcd…", truncate("abcdefgh", 5))
+	assert.Equal(t, "ab…", truncate("ab😀cd", 4), "emoji count twice")
+}
@@ -0,0 +1,221 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/dustin/go-humanize"
+)
+
+// Outcome is what happened to a recording, used to pick a notification template.
+type Outcome string
+
+const (
+	OutcomeSuccess     Outcome = "success"
+	OutcomeSkipped     Outcome = "skipped"
+	OutcomeFailed      Outcome = "failed"
+	OutcomeQuarantined Outcome = "quarantined"
+)
+
+// Outcomes lists every outcome that has a template.
+var Outcomes = []Outcome{OutcomeSuccess, OutcomeSkipped, OutcomeFailed, OutcomeQuarantined}
+
+// OutcomeOf returns the outcome of processing entity.
+func OutcomeOf(entity *media.Entity) Outcome {
+	switch {
+	case entity.Quarantined:
+		return OutcomeQuarantined
+	case !entity.Ok():
+		return OutcomeFailed
+	case !entity.IsTranscodable():
+		return OutcomeSkipped
+	default:
+		return OutcomeSuccess
+	}
+}
+
+// digestKey is the pseudo-outcome that digest templates are configured under.
+const digestKey Outcome = "digest"
+
+// A Template is the subject and body of a notification as Go text/templates.
+type Template struct {
+	Subject string
+	Body    string
+}
+
+var defaultTemplates = map[Outcome]Template{
+	OutcomeSuccess: {
+		Subject: "New Recording: {{ .Title }} ({{ .Channel }})",
+		Body: "{{ .Description }}\n\n" +
+			"Transcode completed in {{ duration .Stats.Duration }}, size change " +
+			"{{ bytes .Stats.InitialSizeBytes }}->{{ bytes .Stats.EndSizeBytes }}. Path: {{ .DestPath }}",
+	},
+	OutcomeSkipped: {
+		Subject: "New Recording: {{ .Title }} ({{ .Channel }})",
+		Body:    "{{ .Description }}\n\nSkipped transcoding. Size {{ bytes .Stats.InitialSizeBytes }}. Path: {{ .DestPath }}",
+	},
+	OutcomeFailed: {
+		Subject: "Failed Recording: {{ .Title }} ({{ .Channel }})",
+		Body:    "{{ .Description }}\n\nErrors encountered when processing media: {{ .Error }}",
+	},
+	OutcomeQuarantined: {
+		Subject: "Quarantined Recording: {{ .Title }} ({{ .Channel }})",
+		Body: "{{ .Description }}\n\nProcessing has failed too many times and won't be retried " +
+			"automatically. Last error: {{ .Error }}",
+	},
+	digestKey: {
+		Subject: "TVHTC2 {{ .Period }} digest: {{ len .Completed }} new, {{ len .Failed }} failed",
+		Body: "{{ range .Completed }}{{ .Title }} ({{ .Channel }})\n{{ end }}" +
+			"{{ if .Failed }}\nFailed:\n{{ range .Failed }}{{ .Title }} ({{ .Channel }}): {{ .Error }}\n{{ end }}{{ end }}" +
+			"\nSaved {{ bytes .Saved }} in total.",
+	},
+}
+
+// TemplateData is what notification templates are executed against. All of
+// the fields of media.Entity, including Details and Stats, are available.
+type TemplateData struct {
+	*media.Entity
+	Outcome Outcome
+	Error   string
+}
+
+var templateFuncs = template.FuncMap{
+	"bytes": func(b uint64) string {
+		return humanize.IBytes(b)
+	},
+	"duration": func(d time.Duration) string {
+		if d < time.Minute {
+			return d.Round(time.Second).String()
+		}
+		return strings.TrimSuffix(d.Round(time.Minute).String(), "0s")
+	},
+	// saving returns how much smaller end is than start, as a percentage
+	"saving": func(start, end uint64) int {
+		if start == 0 {
+			return 0
+		}
+		return int(100 - (end * 100 / start))
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+}
+
+// templateFor returns the template configured for backend and outcome. Each
+// of subject and body is taken from the templates for backend, then the
+// "default" templates, then the built in default.
+func (s Settings) templateFor(backend string, outcome Outcome) Template {
+	t := defaultTemplates[outcome]
+	for _, scope := range []string{"default", backend} {
+		override := s.Templates[scope][outcome]
+		if override.Subject != "" {
+			t.Subject = override.Subject
+		}
+		if override.Body != "" {
+			t.Body = override.Body
+		}
+	}
+	return t
+}
+
+// Render returns the subject and body of the notification for entity, using
+// the templates for backend and outcome.
+func (s Settings) Render(backend string, outcome Outcome, entity *media.Entity) (string, string, error) {
+	t := s.templateFor(backend, outcome)
+
+	data := TemplateData{
+		Entity:  entity,
+		Outcome: outcome,
+	}
+	if err := entity.Error(); err != nil {
+		data.Error = err.Error()
+	}
+
+	subject, err := execute(backend+"/"+string(outcome)+"/subject", t.Subject, data)
+	if err != nil {
+		return "", "", err
+	}
+	body, err := execute(backend+"/"+string(outcome)+"/body", t.Body, data)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Subjects are single line everywhere, so don't let a template break that
+	return strings.TrimSpace(strings.Replace(subject, "\n", " ", -1)), strings.TrimSpace(body), nil
+}
+
+func execute(name, text string, data interface{}) (string, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("notify: error parsing template %s: %s", name, err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("notify: error executing template %s: %s", name, err)
+	}
+	return buf.String(), nil
+}
+
+// ValidateTemplates checks that every configured template parses and can be
+// executed against a sample entity.
+func (s Settings) ValidateTemplates() error {
+	scopes := []string{"default"}
+	for backend := range s.Templates {
+		if backend != "default" {
+			scopes = append(scopes, backend)
+		}
+	}
+
+	for _, scope := range scopes {
+		for _, outcome := range Outcomes {
+			if _, _, err := s.Render(scope, outcome, SampleEntity(outcome)); err != nil {
+				return err
+			}
+		}
+		if _, _, err := s.RenderDigest(scope, SampleDigest()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SampleEntity returns a made up entity for previewing templates.
+func SampleEntity(outcome Outcome) *media.Entity {
+	e := &media.Entity{
+		Details: media.Details{
+			Path:        "/srv/storage/dvr/Vera/Vera2020-01-0121-00.ts",
+			Channel:     "ITV HD",
+			Title:       "Vera",
+			Status:      "OK",
+			Description: "DCI Vera Stanhope investigates the death of a young man found on a beach.",
+			Subtitle:    "Blood Will Tell",
+			Season:      10,
+			Episode:     2,
+			Genre:       []string{"Movie / Drama"},
+			Start:       time.Date(2020, 1, 1, 21, 0, 0, 0, time.UTC),
+			Stop:        time.Date(2020, 1, 1, 23, 0, 0, 0, time.UTC),
+		},
+		DestPath:         "/srv/storage/dvr/Vera/Vera - 2020-01-01T2100.mkv",
+		Media:            media.MEDIA_VIDEO,
+		TranscodeSuccess: true,
+		Stats: media.Stats{
+			Duration:         42 * time.Minute,
+			InitialSizeBytes: 3 * 1024 * 1024 * 1024,
+			EndSizeBytes:     1200 * 1024 * 1024,
+		},
+	}
+
+	switch outcome {
+	case OutcomeFailed:
+		e.SetError(fmt.Errorf("media: error during transcoding: exit status 1"))
+	case OutcomeQuarantined:
+		e.SetError(fmt.Errorf("media: error during transcoding: exit status 1"))
+		e.Quarantined = true
+	}
+	return e
+}
@@ -0,0 +1,63 @@
+package notify
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRender_defaults(t *testing.T) {
+	subject, body, err := Settings{}.Render("pushover", OutcomeSuccess, SampleEntity(OutcomeSuccess))
+	require.NoError(t, err)
+	assert.Equal(t, "New Recording: Vera (ITV HD)", subject)
+	assert.Contains(t, body, "Transcode completed in 42m, size change 3.0 GiB->1.2 GiB")
+
+	subject, body, err = Settings{}.Render("pushover", OutcomeFailed, SampleEntity(OutcomeFailed))
+	require.NoError(t, err)
+	assert.Equal(t, "Failed Recording: Vera (ITV HD)", subject)
+	assert.Contains(t, body, "exit status 1")
+}
+
+func TestRender_overrides(t *testing.T) {
+	s := Settings{Templates: map[string]map[Outcome]Template{
+		"default": {
+			OutcomeSuccess: {
+				Subject: "{{ upper .Title }}",
+				Body:    "saved {{ saving .Stats.InitialSizeBytes .Stats.EndSizeBytes }}%",
+			},
+		},
+		"ntfy": {
+			OutcomeSuccess: {Subject: "{{ .Title }}\non {{ .Channel }}"},
+		},
+	}}
+
+	subject, body, err := s.Render("pushover", OutcomeSuccess, SampleEntity(OutcomeSuccess))
+	require.NoError(t, err)
+	assert.Equal(t, "VERA", subject)
+	assert.Equal(t, "saved 61%", body)
+
+	subject, body, err = s.Render("ntfy", OutcomeSuccess, SampleEntity(OutcomeSuccess))
+	require.NoError(t, err)
+	assert.Equal(t, "Vera on ITV HD", subject, "backend templates win and subjects are one line")
+	assert.Equal(t, "saved 61%", body, "fields not set for the backend fall back to default")
+
+	require.NoError(t, s.ValidateTemplates())
+}
+
+func TestValidateTemplates(t *testing.T) {
+	s := Settings{Templates: map[string]map[Outcome]Template{
+		"email": {OutcomeFailed: {Body: "{{ .NoSuchField }}"}},
+	}}
+	assert.Error(t, s.ValidateTemplates())
+}
+
+func TestOutcomeOf(t *testing.T) {
+	for _, o := range Outcomes {
+		if o == OutcomeSkipped {
+			// Skipping is decided while probing, which the sample can't do
+			continue
+		}
+		assert.Equal(t, o, OutcomeOf(SampleEntity(o)))
+	}
+}
@@ -0,0 +1,74 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/httpclient"
+	"github.com/Xiol/tvhtc2/internal/pkg/notify/retry"
+	log "github.com/sirupsen/logrus"
+)
+
+// Payload is the JSON document posted to the webhook.
+type Payload struct {
+	Title   string      `json:"title"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// A Message is a notification delivered by POSTing JSON to an arbitrary URL.
+type Message struct {
+	URL     string
+	Headers map[string]string
+	Payload Payload
+
+	// Client sends requests, nil uses httpclient.Default.
+	Client *http.Client
+}
+
+// NewMessage returns a Message posting subject and body to url. Data is
+// included in the payload as-is, typically the media entity.
+func NewMessage(url string, headers map[string]string, subject, body string, data interface{}) Message {
+	return Message{
+		URL:     url,
+		Headers: headers,
+		Payload: Payload{
+			Title:   subject,
+			Message: body,
+			Data:    data,
+		},
+	}
+}
+
+func (m Message) Fire() error {
+	payload, err := json.Marshal(m.Payload)
+	if err != nil {
+		return fmt.Errorf("webhook: error marshalling payload: %s", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, m.URL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("webhook: error creating request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range m.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := httpclient.Or(m.Client).Do(req)
+	if err != nil {
+		return retry.Temporaryf(0, "webhook: error sending notification: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return retry.StatusError(resp, "webhook: bad status code %d from %s, response body: %s", resp.StatusCode, m.URL, body)
+	}
+
+	log.WithField("url", m.URL).Info("webhook: notification sent")
+	return nil
+}
@@ -0,0 +1,40 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessage_Fire(t *testing.T) {
+	var got Payload
+	var token string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = r.Header.Get("X-Token")
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	m := NewMessage(srv.URL, map[string]string{"X-Token": "secret"}, "New Recording", "body", map[string]string{"title": "Vera"})
+	require.NoError(t, m.Fire())
+	assert.Equal(t, "secret", token)
+	assert.Equal(t, "New Recording", got.Title)
+	assert.Equal(t, "body", got.Message)
+	assert.Equal(t, map[string]interface{}{"title": "Vera"}, got.Data)
+}
+
+func TestMessage_FireError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	err := NewMessage(srv.URL, nil, "s", "b", nil).Fire()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "403")
+}
@@ -0,0 +1,187 @@
+package reconcile
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/ffmpeg"
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/Xiol/tvhtc2/internal/pkg/watcher"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultTmpfileMinAge is how long a temporary transcode file must have been
+// left untouched before it is treated as orphaned, so that the file of a
+// transcode that is still running is never removed.
+const DefaultTmpfileMinAge = time.Hour
+
+// Config controls the reconciliation of the recordings directories with the
+// queue.
+type Config struct {
+	// OnStartup reconciles before any jobs are run.
+	OnStartup bool
+	// Directories are searched recursively for recordings.
+	Directories []string
+	// Include and Exclude are globs that recordings must match, as for the
+	// watcher.
+	Include []string
+	Exclude []string
+	// Enqueue queues unprocessed recordings, rather than only reporting them.
+	Enqueue bool
+	// TmpfileMinAge is how long a temporary transcode file must not have
+	// been modified before it is removed. Zero uses DefaultTmpfileMinAge.
+	TmpfileMinAge time.Duration
+}
+
+// Validate checks that the directories exist when reconciling on startup.
+func (c Config) Validate() error {
+	if !c.OnStartup {
+		return nil
+	}
+	if len(c.Directories) == 0 {
+		return fmt.Errorf("reconcile: no directories to reconcile")
+	}
+	for _, dir := range c.Directories {
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			return fmt.Errorf("reconcile: directory %s does not exist", dir)
+		}
+	}
+	return nil
+}
+
+// Result is what reconciliation found.
+type Result struct {
+	// Removed are the orphaned temporary files that were removed.
+	Removed []string `json:"removed"`
+	// Unprocessed are recordings that are neither queued nor processed.
+	Unprocessed []media.Details `json:"unprocessed"`
+	// Queued is how many of the unprocessed recordings have been queued.
+	Queued int `json:"queued"`
+}
+
+// Reconciler finds the debris of transcodes that never finished and
+// recordings that were never processed.
+type Reconciler struct {
+	cfg            Config
+	idle           bool
+	known          func(path string) bool
+	needsTranscode func(path string) (bool, error)
+}
+
+// New returns a Reconciler for the directories in cfg.
+func New(cfg Config, options ...func(*Reconciler)) *Reconciler {
+	r := &Reconciler{
+		cfg:            cfg,
+		known:          func(string) bool { return false },
+		needsTranscode: media.NeedsTranscode,
+	}
+	for _, opt := range options {
+		opt(r)
+	}
+	return r
+}
+
+// Known skips recordings for which fn returns true, which are those that
+// are queued or have already been processed.
+func Known(fn func(path string) bool) func(*Reconciler) {
+	return func(r *Reconciler) {
+		r.known = fn
+	}
+}
+
+// Idle tells the Reconciler that no transcodes are running, as on startup,
+// so every temporary file is orphaned however recently it was modified.
+func Idle() func(*Reconciler) {
+	return func(r *Reconciler) {
+		r.idle = true
+	}
+}
+
+// Run removes orphaned temporary files and pass logs, and returns the recordings that look
+// like they were never processed. Recordings count as unprocessed if they
+// still need transcoding, so unprocessed H.264 recordings can't be told
+// apart from finished ones and aren't found.
+func (r *Reconciler) Run(now time.Time) (Result, error) {
+	var result Result
+	var errs []string
+
+	minAge := r.cfg.TmpfileMinAge
+	if minAge <= 0 {
+		minAge = DefaultTmpfileMinAge
+	}
+	if r.idle {
+		minAge = 0
+	}
+
+	for _, root := range r.cfg.Directories {
+		root = filepath.Clean(root)
+		err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				errs = append(errs, err.Error())
+				if entry != nil && entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if entry.IsDir() {
+				return nil
+			}
+
+			fields := log.Fields{"path": path}
+			if media.IsTempFile(entry.Name()) {
+				info, err := entry.Info()
+				if err != nil || now.Sub(info.ModTime()) < minAge {
+					return nil
+				}
+				if err := os.Remove(path); err != nil {
+					errs = append(errs, fmt.Sprintf("error removing %s: %s", path, err))
+					return nil
+				}
+				log.WithFields(fields).Info("reconcile: removed orphaned temporary file")
+				result.Removed = append(result.Removed, path)
+				return nil
+			}
+
+			if !watcher.Match(r.cfg.Include, r.cfg.Exclude, entry.Name()) || r.known(path) {
+				return nil
+			}
+			needed, err := r.needsTranscode(path)
+			if err != nil {
+				log.WithError(err).WithFields(fields).Debug("reconcile: unable to probe file, ignoring")
+				return nil
+			}
+			if needed {
+				log.WithFields(fields).Info("reconcile: found unprocessed recording")
+				result.Unprocessed = append(result.Unprocessed, media.DetailsFromPath(root, path))
+			}
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	// Two-pass encodes that never finished leave their pass logs behind
+	passlogs, _ := filepath.Glob(ffmpeg.PassLog("*"))
+	for _, path := range passlogs {
+		info, err := os.Stat(path)
+		if err != nil || now.Sub(info.ModTime()) < minAge {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			errs = append(errs, fmt.Sprintf("error removing %s: %s", path, err))
+			continue
+		}
+		log.WithField("path", path).Info("reconcile: removed orphaned pass log")
+		result.Removed = append(result.Removed, path)
+	}
+
+	if len(errs) > 0 {
+		return result, fmt.Errorf("reconcile: errors encountered: %s", strings.Join(errs, "; "))
+	}
+	return result, nil
+}
@@ -0,0 +1,86 @@
+package reconcile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func touch(t *testing.T, path string, modTime time.Time) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, ioutil.WriteFile(path, []byte("data"), 0644))
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestReconciler_Run(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	orphan := filepath.Join(dir, "Vera", "0b8c0c1e-3c39-4a4e-9f05-4a3e9a1e2f6d.ts")
+	running := filepath.Join(dir, "Vera", "6f1c2a9e-1f0b-4c1e-8a43-0d5b7f3c2e11.ts")
+	unprocessed := filepath.Join(dir, "Vera", "Vera2020-01-0121-00.ts")
+	transcoded := filepath.Join(dir, "Casualty", "Casualty - 2020-01-01T2100.ts")
+	queued := filepath.Join(dir, "Doctor Who2020-01-0121-00.ts")
+	other := filepath.Join(dir, "Vera", "Vera.nfo")
+
+	touch(t, orphan, now.Add(-2*time.Hour))
+	touch(t, running, now.Add(-time.Minute))
+	for _, path := range []string{unprocessed, transcoded, queued, other} {
+		touch(t, path, now.Add(-24*time.Hour))
+	}
+
+	r := New(Config{Directories: []string{dir}, Include: []string{"*.ts"}}, Known(func(path string) bool {
+		return path == queued
+	}))
+	r.needsTranscode = func(path string) (bool, error) {
+		return path != transcoded, nil
+	}
+
+	result, err := r.Run(now)
+	require.NoError(t, err)
+	assert.Equal(t, []string{orphan}, result.Removed)
+	assert.Equal(t, []media.Details{{Path: unprocessed, Title: "Vera"}}, result.Unprocessed)
+	assert.NoFileExists(t, orphan)
+	assert.FileExists(t, running, "recently modified files may belong to a running transcode")
+
+	r = New(Config{Directories: []string{dir}, Include: []string{"*.ts"}}, Idle())
+	r.needsTranscode = func(string) (bool, error) { return false, nil }
+	result, err = r.Run(now)
+	require.NoError(t, err)
+	assert.Equal(t, []string{running}, result.Removed)
+	assert.Empty(t, result.Unprocessed)
+}
+
+func TestReconciler_Run_missingDirectory(t *testing.T) {
+	_, err := New(Config{Directories: []string{filepath.Join(t.TempDir(), "missing")}}).Run(time.Now())
+	assert.Error(t, err)
+}
+
+func TestReconciler_Run_passlogs(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	now := time.Now()
+
+	orphan := filepath.Join(tmp, "tvhtc2-passlog-0b8c0c1e-0.log")
+	running := filepath.Join(tmp, "tvhtc2-passlog-6f1c2a9e-0.log")
+	touch(t, orphan, now.Add(-2*time.Hour))
+	touch(t, running, now.Add(-time.Minute))
+
+	result, err := New(Config{Directories: []string{t.TempDir()}}).Run(now)
+	require.NoError(t, err)
+	assert.Equal(t, []string{orphan}, result.Removed)
+	assert.FileExists(t, running)
+}
+
+func TestConfig_Validate(t *testing.T) {
+	assert.NoError(t, Config{Directories: []string{"/nonexistent"}}.Validate(), "only checked when reconciling on startup")
+	assert.NoError(t, Config{OnStartup: true, Directories: []string{t.TempDir()}}.Validate())
+	assert.Error(t, Config{OnStartup: true}.Validate())
+	assert.Error(t, Config{OnStartup: true, Directories: []string{"/nonexistent"}}.Validate())
+}
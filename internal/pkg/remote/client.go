@@ -0,0 +1,78 @@
+package remote
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/api"
+	"github.com/Xiol/tvhtc2/internal/pkg/httpclient"
+)
+
+// Client sends requests to a remote daemon.
+type Client struct {
+	cfg    ClientConfig
+	client *http.Client
+}
+
+// NewClient returns a Client for the daemon described by cfg.
+func NewClient(cfg ClientConfig) (*Client, error) {
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	c, err := httpclient.New(httpclient.Options{Timeout: cfg.Timeout})
+	if err != nil {
+		return nil, fmt.Errorf("remote: %s", err)
+	}
+	c.Transport.(*http.Transport).TLSClientConfig = tlsConfig
+	return &Client{cfg: cfg, client: c}, nil
+}
+
+// Send sends req to the daemon and returns its response. Errors reaching
+// the daemon satisfy api.IsUnavailable, as with api.Send.
+func (c *Client) Send(req api.Request) (api.Response, error) {
+	var resp api.Response
+	_, err := c.Post(RequestPath, req, &resp)
+	return resp, err
+}
+
+// Post sends in as JSON to the endpoint at path and decodes the response
+// into out, returning the status code. Errors reaching the daemon satisfy
+// api.IsUnavailable.
+func (c *Client) Post(path string, in, out interface{}) (int, error) {
+	payload, err := json.Marshal(in)
+	if err != nil {
+		return 0, fmt.Errorf("remote: failed to marshal request: %s", err)
+	}
+
+	hreq, err := http.NewRequest(http.MethodPost, strings.TrimRight(c.cfg.URL, "/")+path, bytes.NewReader(payload))
+	if err != nil {
+		return 0, fmt.Errorf("remote: error building request: %s", err)
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	if c.cfg.Token != "" {
+		hreq.Header.Set("Authorization", "Bearer "+c.cfg.Token)
+	}
+
+	hresp, err := c.client.Do(hreq)
+	if err != nil {
+		return 0, api.Unavailable(fmt.Errorf("remote: error sending request: %s", err))
+	}
+	defer hresp.Body.Close()
+
+	data, err := ioutil.ReadAll(hresp.Body)
+	if err != nil {
+		return hresp.StatusCode, fmt.Errorf("remote: error reading response: %s", err)
+	}
+	if len(data) == 0 {
+		return hresp.StatusCode, fmt.Errorf("remote: empty response with status code %d", hresp.StatusCode)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return hresp.StatusCode, fmt.Errorf("remote: bad response with status code %d: %s", hresp.StatusCode, err)
+	}
+	return hresp.StatusCode, nil
+}
@@ -0,0 +1,198 @@
+package remote
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/api"
+)
+
+// RequestPath is where the daemon accepts the same requests as on its unix
+// socket.
+const RequestPath = "/api/v1/request"
+
+// ServerConfig controls the daemon's TCP listener.
+type ServerConfig struct {
+	Enabled bool
+	// Address is the host:port to listen on.
+	Address string
+	// CertFile and KeyFile are the server's TLS certificate and key.
+	CertFile string
+	KeyFile  string
+	// ClientCAFile, if set, requires clients to present a certificate
+	// signed by one of the CAs in it.
+	ClientCAFile string
+	// Token, if set, must be sent by clients as a bearer token.
+	Token string
+	// PathMap translates the paths of submitted recordings.
+	PathMap []PathMapping
+}
+
+// Validate checks that the listener is secured.
+func (c ServerConfig) Validate() error {
+	for _, m := range c.PathMap {
+		if !filepath.IsAbs(m.From) || !filepath.IsAbs(m.To) {
+			return fmt.Errorf("remote: path mappings must be absolute, not '%s' to '%s'", m.From, m.To)
+		}
+	}
+	if !c.Enabled {
+		return nil
+	}
+	if c.Address == "" {
+		return fmt.Errorf("remote: listen address must be set")
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return fmt.Errorf("remote: cert_file and key_file must be set, the listener always uses TLS")
+	}
+	if c.Token == "" && c.ClientCAFile == "" {
+		return fmt.Errorf("remote: one of token or client_ca_file must be set to authenticate clients")
+	}
+	if _, err := c.tlsConfig(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// tlsConfig loads the server's certificate and the client CAs.
+func (c ServerConfig) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("remote: error loading certificate: %s", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientCAFile != "" {
+		if cfg.ClientCAs, err = loadCAs(c.ClientCAFile); err != nil {
+			return nil, err
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// ClientConfig controls how tvhtc2-client reaches a remote daemon.
+type ClientConfig struct {
+	// URL is the daemon's listener, such as https://transcoder:9982. If it
+	// is empty the client uses the unix socket.
+	URL   string
+	Token string
+	// CAFile verifies the daemon's certificate, the system CAs are used if
+	// it is empty.
+	CAFile string
+	// CertFile and KeyFile are the client's certificate for mutual TLS.
+	CertFile string
+	KeyFile  string
+	Timeout  time.Duration
+}
+
+// tlsConfig loads the CA and the client's certificate.
+func (c ClientConfig) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	var err error
+	if c.CAFile != "" {
+		if cfg.RootCAs, err = loadCAs(c.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("remote: error loading client certificate: %s", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func loadCAs(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("remote: error reading CA file: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("remote: no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// A PathMapping translates paths below From to the same path below To, as
+// when the recorder and the transcoder mount the same share in different
+// places.
+type PathMapping struct {
+	From string `mapstructure:"from"`
+	To   string `mapstructure:"to"`
+}
+
+// ErrUnmapped is returned by MapPath for paths below none of the mappings.
+var ErrUnmapped = errors.New("remote: path is not below any mapped directory")
+
+// MapPath translates path with the mapping with the longest matching From.
+// Paths that no mapping matches are returned cleaned with ErrUnmapped, for
+// callers that trust them as they are. Paths that aren't absolute, or that
+// would end up outside the mapping's To, are errors.
+func MapPath(mappings []PathMapping, path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("remote: path '%s' is not absolute", path)
+	}
+	path = filepath.Clean(path)
+
+	var best *PathMapping
+	for i, m := range mappings {
+		if !below(path, filepath.Clean(m.From)) {
+			continue
+		}
+		if best == nil || len(filepath.Clean(m.From)) > len(filepath.Clean(best.From)) {
+			best = &mappings[i]
+		}
+	}
+	if best == nil {
+		return path, ErrUnmapped
+	}
+
+	to := filepath.Clean(best.To)
+	mapped := filepath.Join(to, strings.TrimPrefix(path, filepath.Clean(best.From)))
+	if !below(mapped, to) {
+		return "", fmt.Errorf("remote: path '%s' is outside %s once mapped", path, to)
+	}
+	return mapped, nil
+}
+
+// below reports whether the clean path is dir or inside it.
+func below(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// Reverse returns mappings that translate paths back again.
+func Reverse(mappings []PathMapping) []PathMapping {
+	reversed := make([]PathMapping, len(mappings))
+	for i, m := range mappings {
+		reversed[i] = PathMapping{From: m.To, To: m.From}
+	}
+	return reversed
+}
+
+// mapRequest translates the path of the recording in req, if any. Only
+// recordings below one of the mappings are accepted, so that a client can't
+// have the daemon transcode, and then remove, any other file.
+func mapRequest(mappings []PathMapping, req api.Request) (api.Request, error) {
+	if req.Details == nil {
+		return req, nil
+	}
+
+	details := *req.Details
+	var err error
+	if details.Path, err = MapPath(mappings, details.Path); err != nil {
+		return req, err
+	}
+	req.Details = &details
+	return req, nil
+}
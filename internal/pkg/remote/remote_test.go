@@ -0,0 +1,211 @@
+package remote
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/api"
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMapPath(t *testing.T) {
+	mappings := []PathMapping{
+		{From: "/recordings", To: "/mnt/tv"},
+		{From: "/recordings/films/", To: "/mnt/films"},
+	}
+	mapPath := func(path string) string {
+		mapped, err := MapPath(mappings, path)
+		require.NoError(t, err)
+		return mapped
+	}
+	assert.Equal(t, "/mnt/tv/Vera/Vera.ts", mapPath("/recordings/Vera/Vera.ts"))
+	assert.Equal(t, "/mnt/films/Heat.ts", mapPath("/recordings/films/Heat.ts"), "longest match wins")
+	assert.Equal(t, "/mnt/tv/Vera.ts", mapPath("/recordings/films/../Vera.ts"))
+
+	path, err := MapPath(mappings, "/recordingsold/Vera.ts")
+	assert.Equal(t, ErrUnmapped, err, "only whole directories match")
+	assert.Equal(t, "/recordingsold/Vera.ts", path)
+	_, err = MapPath(mappings, "/elsewhere/Vera.ts")
+	assert.Equal(t, ErrUnmapped, err)
+	path, err = MapPath(mappings, "/recordings/../etc/x")
+	assert.Equal(t, ErrUnmapped, err, "paths can't climb out of a mapping")
+	assert.Equal(t, "/etc/x", path)
+	_, err = MapPath(mappings, "recordings/Vera.ts")
+	assert.Error(t, err)
+}
+
+func TestServer_rejects(t *testing.T) {
+	var got []api.Request
+	srv := NewServer(ServerConfig{
+		Token:   "secret",
+		PathMap: []PathMapping{{From: "/recordings", To: "/mnt/tv"}},
+	}, func(req api.Request) api.Response {
+		got = append(got, req)
+		return api.Ok(nil)
+	})
+
+	post := func(auth, path string) int {
+		body, err := json.Marshal(api.Request{Command: api.CommandSubmit, Details: &media.Details{Path: path}})
+		require.NoError(t, err)
+		r := httptest.NewRequest(http.MethodPost, RequestPath, bytes.NewReader(body))
+		r.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, post("Bearer secret", "/recordings/Vera.ts"))
+	assert.Equal(t, http.StatusUnauthorized, post("secret", "/recordings/Vera.ts"), "the scheme is required")
+	assert.Equal(t, http.StatusUnauthorized, post("Bearer guess", "/recordings/Vera.ts"))
+	assert.Equal(t, http.StatusForbidden, post("Bearer secret", "/recordings/../etc/x"))
+	assert.Equal(t, http.StatusForbidden, post("Bearer secret", "/etc/x"))
+	assert.Equal(t, http.StatusForbidden, post("Bearer secret", "Vera.ts"))
+	require.Len(t, got, 1)
+	assert.Equal(t, "/mnt/tv/Vera.ts", got[0].Details.Path)
+}
+
+// writeCert writes a certificate and key for name signed by ca, or a self
+// signed CA if ca is nil, and returns their paths.
+func writeCert(t *testing.T, dir, name string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (string, string, *x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		ca, caKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPath, keyPath := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certPath, keyPath, cert, key
+}
+
+// freeAddress returns a local address that nothing is listening on.
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+	caPath, _, ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	serverCert, serverKey, _, _ := writeCert(t, dir, "server", ca, caKey)
+	clientCert, clientKey, _, _ := writeCert(t, dir, "client", ca, caKey)
+
+	tests := []struct {
+		name   string
+		server ServerConfig
+		client ClientConfig
+		ok     bool
+	}{
+		{
+			name:   "token",
+			server: ServerConfig{Token: "secret"},
+			client: ClientConfig{Token: "secret"},
+			ok:     true,
+		},
+		{
+			name:   "wrong token",
+			server: ServerConfig{Token: "secret"},
+			client: ClientConfig{Token: "guess"},
+		},
+		{
+			name:   "client certificate",
+			server: ServerConfig{ClientCAFile: caPath},
+			client: ClientConfig{CertFile: clientCert, KeyFile: clientKey},
+			ok:     true,
+		},
+		{
+			name:   "no client certificate",
+			server: ServerConfig{ClientCAFile: caPath},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *api.Request
+			cfg := tt.server
+			cfg.Enabled = true
+			cfg.Address = freeAddress(t)
+			cfg.CertFile, cfg.KeyFile = serverCert, serverKey
+			cfg.PathMap = []PathMapping{{From: "/recordings", To: "/mnt/tv"}}
+			require.NoError(t, cfg.Validate())
+
+			srv := NewServer(cfg, func(req api.Request) api.Response {
+				got = &req
+				return api.Ok(map[string]string{"id": "1"})
+			})
+			require.NoError(t, srv.Start())
+			defer srv.Close()
+
+			ccfg := tt.client
+			ccfg.URL = "https://" + cfg.Address
+			ccfg.CAFile = caPath
+			c, err := NewClient(ccfg)
+			require.NoError(t, err)
+
+			resp, err := c.Send(api.Request{
+				Command: api.CommandSubmit,
+				Details: &media.Details{Path: "/recordings/Vera/Vera.ts"},
+			})
+			if !tt.ok {
+				assert.True(t, err != nil || !resp.OK)
+				assert.Nil(t, got)
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, resp.OK)
+			require.NotNil(t, got)
+			assert.Equal(t, "/mnt/tv/Vera/Vera.ts", got.Details.Path)
+		})
+	}
+}
+
+func TestClient_unavailable(t *testing.T) {
+	c, err := NewClient(ClientConfig{URL: "https://" + freeAddress(t), Timeout: time.Second})
+	require.NoError(t, err)
+
+	_, err = c.Send(api.Request{Command: api.CommandList})
+	assert.True(t, api.IsUnavailable(err))
+}
+
+func TestServerConfig_Validate(t *testing.T) {
+	assert.NoError(t, ServerConfig{}.Validate())
+	assert.Error(t, ServerConfig{PathMap: []PathMapping{{From: "recordings", To: "/mnt"}}}.Validate())
+	assert.Error(t, ServerConfig{Enabled: true, Address: ":9982", Token: "secret"}.Validate(), "TLS is required")
+}
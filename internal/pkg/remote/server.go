@@ -0,0 +1,161 @@
+package remote
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxRequestSize limits the size of request bodies.
+const maxRequestSize = 1 << 20
+
+// A HandlerFunc handles a request, as the daemon does those from its socket.
+type HandlerFunc func(req api.Request) api.Response
+
+// Server accepts requests over HTTPS.
+type Server struct {
+	cfg     ServerConfig
+	handler HandlerFunc
+	mux     *http.ServeMux
+	srv     *http.Server
+}
+
+// NewServer returns a Server that passes authenticated requests to handler
+// once their paths have been mapped.
+func NewServer(cfg ServerConfig, handler HandlerFunc) *Server {
+	s := &Server{
+		cfg:     cfg,
+		handler: handler,
+		mux:     http.NewServeMux(),
+	}
+	s.mux.HandleFunc(RequestPath, s.handleRequest)
+	return s
+}
+
+// Handle adds an endpoint, which is authenticated like every other.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Handler returns the Server's authenticated handler.
+func (s *Server) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorised(r) {
+			log.WithField("remote", r.RemoteAddr).Warning("remote: rejected unauthorised request")
+			WriteJSON(w, http.StatusUnauthorized, api.Fail(fmt.Errorf("remote: unauthorised")))
+			return
+		}
+		s.mux.ServeHTTP(w, r)
+	})
+}
+
+// authorised checks the bearer token, if one is configured. Client
+// certificates have already been verified during the handshake.
+func (s *Server) authorised(r *http.Request) bool {
+	if s.cfg.Token == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.Token)) == 1
+}
+
+// Start listens in the background until Close is called.
+func (s *Server) Start() error {
+	tlsConfig, err := s.cfg.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", s.cfg.Address)
+	if err != nil {
+		return fmt.Errorf("remote: error listening at %s: %s", s.cfg.Address, err)
+	}
+
+	s.srv = &http.Server{
+		Handler:           s.Handler(),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := s.srv.ServeTLS(l, "", ""); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("remote: listener failed")
+		}
+	}()
+
+	log.WithField("address", l.Addr().String()).Info("remote: listening for requests")
+	return nil
+}
+
+// Close stops listening.
+func (s *Server) Close() {
+	if s.srv == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.srv.Shutdown(ctx)
+}
+
+func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		WriteJSON(w, http.StatusMethodNotAllowed, api.Fail(fmt.Errorf("remote: method %s not allowed", r.Method)))
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		WriteJSON(w, http.StatusBadRequest, api.Fail(fmt.Errorf("remote: error reading request: %s", err)))
+		return
+	}
+
+	req, err := api.Decode(data)
+	if err != nil {
+		WriteJSON(w, http.StatusBadRequest, api.Fail(err))
+		return
+	}
+
+	if req, err = mapRequest(s.cfg.PathMap, req); err != nil {
+		log.WithError(err).WithField("remote", r.RemoteAddr).Warning("remote: rejected recording outside the mapped directories")
+		WriteJSON(w, http.StatusForbidden, api.Fail(err))
+		return
+	}
+	if req.Details != nil {
+		log.WithFields(log.Fields{
+			"remote": r.RemoteAddr,
+			"path":   req.Details.Path,
+		}).Debug("remote: received request")
+	}
+	WriteJSON(w, http.StatusOK, s.handler(req))
+}
+
+// WriteJSON writes v as the response with the given status code.
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Error("remote: failed to write response")
+	}
+}
+
+// ReadJSON decodes the body of a POST request into v. If it can't, an error
+// response has already been written and it returns false.
+func ReadJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		WriteJSON(w, http.StatusMethodNotAllowed, api.Fail(fmt.Errorf("remote: method %s not allowed", r.Method)))
+		return false
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(v); err != nil {
+		WriteJSON(w, http.StatusBadRequest, api.Fail(fmt.Errorf("remote: error decoding request: %s", err)))
+		return false
+	}
+	return true
+}
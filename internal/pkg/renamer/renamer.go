@@ -5,9 +5,6 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
-
-	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 )
 
 var timestampMatcher *regexp.Regexp
@@ -22,23 +19,32 @@ func init() {
 	whitespaceCleaner = regexp.MustCompile(`\s+`)
 }
 
+// Config controls how a Renamer neatens paths.
+type Config struct {
+	FixTimestamps bool
+	FixSpacing    bool
+	RemoveNew     bool
+	// Rules are applied after the above, in order.
+	Rules []Rule
+}
+
 // A Renamer is used to alter a given path to neaten programme names and timestamps
 type Renamer struct {
 	FixTimestamps bool
 	FixSpacing    bool
 	RemoveNew     bool
+	Rules         []Rule
 }
 
-// NewRenamer returns a Renamer that will fix timestamp formatting, remove 'New' from titles
-// and fix spacing.
-func NewRenamer() Renamer {
-	// We initailise the renamer from the config at this point to avoid configuration
-	// file changes altering the control flow mid-rename. A new instance of Renamer should
-	// be used for every entity.
+// NewRenamer returns a Renamer configured by cfg. Each entity should get a
+// new Renamer created from the configuration snapshot for its job, so that
+// configuration changes can't alter the control flow mid-rename.
+func NewRenamer(cfg Config) Renamer {
 	return Renamer{
-		FixTimestamps: viper.GetBool("rename.fix_timestamps"),
-		RemoveNew:     viper.GetBool("rename.remove_new"),
-		FixSpacing:    viper.GetBool("rename.fix_spacing"),
+		FixTimestamps: cfg.FixTimestamps,
+		RemoveNew:     cfg.RemoveNew,
+		FixSpacing:    cfg.FixSpacing,
+		Rules:         append([]Rule(nil), cfg.Rules...),
 	}
 }
 
@@ -122,15 +128,8 @@ func (r *Renamer) getTimestamp(path string) string {
 }
 
 func (r *Renamer) applyRules(path string) string {
-	rules, err := LoadRules()
-	if err != nil {
-		log.WithError(err).Error("renamer: error loading rename rules")
-		return path
+	for i := range r.Rules {
+		path = r.Rules[i].Apply(path)
 	}
-
-	for i := range rules {
-		path = rules[i].Apply(path)
-	}
-
 	return path
 }
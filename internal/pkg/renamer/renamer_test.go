@@ -6,7 +6,7 @@ import (
 )
 
 func TestRenamer_fixTimestamps(t *testing.T) {
-	r := NewRenamer()
+	r := NewRenamer(Config{})
 	r.FixTimestamps = true
 
 	orig := "/srv/storage/dvr/Dracula/Dracula2020-01-0121-00.mkv"
@@ -16,7 +16,7 @@ func TestRenamer_fixTimestamps(t *testing.T) {
 }
 
 func TestRenamer_removeNew(t *testing.T) {
-	r := NewRenamer()
+	r := NewRenamer(Config{})
 	r.RemoveNew = true
 
 	orig := "/srv/storage/dvr/New_-Bancroft/New_-Bancroft2020-01-0121-00.mkv"
@@ -26,7 +26,7 @@ func TestRenamer_removeNew(t *testing.T) {
 }
 
 func TestRenamer_fixSpacing(t *testing.T) {
-	r := NewRenamer()
+	r := NewRenamer(Config{})
 	r.FixTimestamps = false
 	r.RemoveNew = true
 	r.FixSpacing = true
@@ -58,3 +58,15 @@ func TestRenamer_fixSpacing(t *testing.T) {
 		assert.Equal(t, test[1], r.fixSpacing(test[0]))
 	}
 }
+
+func TestRenamer_Rename(t *testing.T) {
+	r := NewRenamer(Config{
+		FixTimestamps: true,
+		RemoveNew:     true,
+		FixSpacing:    true,
+		Rules:         []Rule{{Old: "Cats Does ", New: "Cats Does Countdown "}},
+	})
+
+	assert.Equal(t, "/srv/storage/dvr/8 Out of 10 Cats Does/8 Out of 10 Cats Does Countdown - 2020-01-01T2100.mkv",
+		r.Rename("/srv/storage/dvr/New_-8-Out-of-10-Cats-Does.../New_-8-Out-of-10-Cats-Does...2020-01-0121-00.mkv"))
+}
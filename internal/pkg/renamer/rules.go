@@ -1,12 +1,12 @@
 package renamer
 
 import (
+	"fmt"
 	"path/filepath"
 	"regexp"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 )
 
 type Rule struct {
@@ -48,6 +48,17 @@ func (r *Rule) Apply(path string) string {
 	return string(filepath.Separator) + filepath.Join(prefix, target)
 }
 
+// Validate checks that the rule has a regexp and that it compiles.
+func (r *Rule) Validate() error {
+	if r.Old == "" {
+		return fmt.Errorf("renamer: rule has no regexp to match")
+	}
+	if _, err := regexp.Compile("(?i)" + r.Old); err != nil {
+		return fmt.Errorf("renamer: rule regex '%s' did not compile: %s", r.Old, err)
+	}
+	return nil
+}
+
 func (r *Rule) compileMatcher() error {
 	var err error
 	if r.oldMatcher != nil {
@@ -60,14 +71,3 @@ func (r *Rule) compileMatcher() error {
 	}
 	return nil
 }
-
-func LoadRules() ([]Rule, error) {
-	var rules []Rule
-
-	err := viper.UnmarshalKey("rename.rules", &rules)
-	if err != nil {
-		return rules, err
-	}
-
-	return rules, nil
-}
@@ -32,3 +32,9 @@ func TestRuleApply(t *testing.T) {
 	assert.Equal(t, "/srv/storage/media/DVR/The Last Leg/The Last Leg - 2020-02-21T2200.mkv",
 		r.Apply("/srv/storage/media/DVR/Live - The Last Leg/Live - The Last Leg - 2020-02-21T2200.mkv"))
 }
+
+func TestRuleValidate(t *testing.T) {
+	assert.NoError(t, (&Rule{Old: "^8 Out of 10 Cats Does.*", New: "x"}).Validate())
+	assert.Error(t, (&Rule{Old: "(", New: "x"}).Validate())
+	assert.Error(t, (&Rule{New: "x"}).Validate())
+}
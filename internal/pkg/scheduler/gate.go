@@ -0,0 +1,164 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/state"
+	"github.com/Xiol/tvhtc2/internal/pkg/timewindow"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultRecordingPollInterval = time.Minute
+
+// A Gate decides whether transcoding is currently allowed. Jobs are held in
+// the queue while the gate is closed, unless they have been forced to run.
+type Gate struct {
+	client *http.Client
+	config func() Config
+
+	sync.Mutex
+	recording bool
+	open      bool
+	reason    string
+}
+
+// NewGate returns a Gate that is initially considered open. The
+// configuration is taken from config every time the gate is checked.
+func NewGate(config func() Config) *Gate {
+	return &Gate{
+		client: &http.Client{Timeout: 10 * time.Second},
+		config: config,
+		open:   true,
+	}
+}
+
+// Allows reports whether job may be started now. It is suitable for passing
+// to state.Next.
+func (g *Gate) Allows(job *state.Job) bool {
+	if job.Force {
+		return true
+	}
+	open, _ := g.Open(time.Now())
+	return open
+}
+
+// Open reports whether transcoding is allowed at now, and if not, why.
+func (g *Gate) Open(now time.Time) (bool, string) {
+	g.Lock()
+	defer g.Unlock()
+
+	open, reason := g.check(now)
+	if open != g.open || reason != g.reason {
+		if open {
+			log.Info("scheduler: transcoding allowed, releasing held jobs")
+		} else {
+			log.WithField("reason", reason).Info("scheduler: transcoding paused, holding jobs")
+		}
+		g.open, g.reason = open, reason
+	}
+	return open, reason
+}
+
+func (g *Gate) check(now time.Time) (bool, string) {
+	cfg := g.config()
+	windows, err := timewindow.ParseAll(cfg.Windows)
+	if err != nil {
+		log.WithError(err).Error("scheduler: invalid transcode windows, ignoring")
+		windows = nil
+	}
+
+	if !timewindow.AnyContains(windows, now) {
+		return false, "outside transcode windows"
+	}
+
+	if cfg.PauseWhileRecording.Enabled && g.recording {
+		return false, "TVHeadend is recording"
+	}
+
+	return true, ""
+}
+
+// Watch polls TVHeadend for active recordings every interval while
+// pause_while_recording is enabled, until closeCh is closed. The gate only
+// ever uses the last answer, as it is checked while the queue is locked.
+func (g *Gate) Watch(closeCh <-chan struct{}) {
+	for {
+		cfg := g.config().PauseWhileRecording
+		if cfg.Enabled {
+			g.poll(cfg)
+		}
+
+		interval := cfg.Interval
+		if interval <= 0 {
+			interval = defaultRecordingPollInterval
+		}
+		select {
+		case <-closeCh:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// poll asks TVHeadend whether it is recording. If it can't be reached the
+// previous answer is kept.
+func (g *Gate) poll(cfg RecordingConfig) {
+	recording, err := g.pollRecording(cfg)
+	if err != nil {
+		log.WithError(err).Warning("scheduler: unable to check TVHeadend for active recordings")
+		return
+	}
+
+	g.Lock()
+	g.recording = recording
+	g.Unlock()
+}
+
+type upcomingResponse struct {
+	Entries []struct {
+		Title       string `json:"disp_title"`
+		SchedStatus string `json:"sched_status"`
+	} `json:"entries"`
+}
+
+func (g *Gate) pollRecording(cfg RecordingConfig) (bool, error) {
+	url := cfg.URL
+	if url == "" {
+		return false, fmt.Errorf("scheduler: pause_while_recording.url is not set")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return false, fmt.Errorf("scheduler: error building request: %s", err)
+	}
+	if cfg.Username != "" {
+		req.SetBasicAuth(cfg.Username, cfg.Password)
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("scheduler: error polling %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("scheduler: bad status code %d polling %s", resp.StatusCode, url)
+	}
+
+	var upcoming upcomingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&upcoming); err != nil {
+		return false, fmt.Errorf("scheduler: error decoding response from %s: %s", url, err)
+	}
+
+	for _, e := range upcoming.Entries {
+		if e.SchedStatus == "recording" {
+			log.WithField("title", e.Title).Debug("scheduler: TVHeadend is recording")
+			return true, nil
+		}
+	}
+	return false, nil
+}
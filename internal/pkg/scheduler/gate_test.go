@@ -0,0 +1,56 @@
+package scheduler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGate_windows(t *testing.T) {
+	g := NewGate(func() Config { return Config{Windows: []string{"01:00-07:00"}} })
+	open, _ := g.Open(time.Date(2020, 1, 1, 3, 0, 0, 0, time.Local))
+	assert.True(t, open)
+
+	open, reason := g.Open(time.Date(2020, 1, 1, 19, 0, 0, 0, time.Local))
+	assert.False(t, open)
+	assert.NotEmpty(t, reason)
+}
+
+func TestGate_forcedJobs(t *testing.T) {
+	g := NewGate(func() Config { return Config{Windows: []string{"00:00-00:01"}} })
+	assert.True(t, g.Allows(&state.Job{Force: true}))
+}
+
+func TestGate_pauseWhileRecording(t *testing.T) {
+	status := "scheduled"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"entries":[{"disp_title":"News","sched_status":"%s"}]}`, status)
+	}))
+	defer srv.Close()
+
+	cfg := RecordingConfig{Enabled: true, URL: srv.URL, Interval: time.Minute}
+
+	now := time.Now()
+	g := NewGate(func() Config { return Config{PauseWhileRecording: cfg} })
+	g.poll(cfg)
+	open, _ := g.Open(now)
+	assert.True(t, open)
+
+	status = "recording"
+	open, _ = g.Open(now.Add(time.Second))
+	assert.True(t, open, "the last poll is used until the next")
+
+	g.poll(cfg)
+	open, _ = g.Open(now.Add(2 * time.Minute))
+	assert.False(t, open)
+
+	srv.Close()
+	g.poll(cfg)
+	open, _ = g.Open(now.Add(4 * time.Minute))
+	assert.False(t, open, "the last answer is kept when TVHeadend can't be reached")
+}
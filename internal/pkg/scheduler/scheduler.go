@@ -0,0 +1,135 @@
+package scheduler
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/Xiol/tvhtc2/internal/pkg/state"
+	log "github.com/sirupsen/logrus"
+)
+
+// Config decides the order jobs run in and when they may run.
+type Config struct {
+	// Policy is one of the policies below, empty meaning PolicyPriority.
+	Policy Policy
+	Rules  []Rule
+	// Windows are the daily periods transcoding is allowed in, such as
+	// "01:00-07:00". None means any time.
+	Windows             []string
+	PauseWhileRecording RecordingConfig
+}
+
+// RecordingConfig describes how to ask TVHeadend whether it is recording.
+type RecordingConfig struct {
+	Enabled bool
+	// URL is TVHeadend's /api/dvr/entry/grid_upcoming endpoint.
+	URL      string
+	Interval time.Duration
+	Username string
+	Password string
+}
+
+// A Policy decides the order in which queued jobs are run.
+type Policy string
+
+const (
+	// PolicyFIFO runs jobs in the order they were queued, ignoring priority.
+	PolicyFIFO Policy = "fifo"
+	// PolicyPriority runs higher priority jobs first, then in queue order.
+	PolicyPriority Policy = "priority"
+	// PolicyShortest runs higher priority jobs first, then the job with the
+	// shortest probed duration. Jobs with an unknown duration go last.
+	PolicyShortest Policy = "shortest"
+)
+
+// ParsePolicy returns the named policy, or PolicyPriority if name is empty.
+func ParsePolicy(name string) (Policy, error) {
+	p := Policy(strings.ToLower(name))
+	switch p {
+	case PolicyFIFO, PolicyPriority, PolicyShortest:
+		return p, nil
+	case "":
+		return PolicyPriority, nil
+	default:
+		return PolicyPriority, fmt.Errorf("scheduler: unknown scheduling policy '%s'", name)
+	}
+}
+
+// Less reports whether job a should run before job b.
+func (p Policy) Less(a, b *state.Job) bool {
+	if p != PolicyFIFO && a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+
+	if p == PolicyShortest && a.SourceDuration != b.SourceDuration {
+		if a.SourceDuration == 0 {
+			return false
+		}
+		if b.SourceDuration == 0 {
+			return true
+		}
+		return a.SourceDuration < b.SourceDuration
+	}
+
+	return a.Seq < b.Seq
+}
+
+// A Rule assigns a priority to jobs whose details match all of its regexps.
+// Empty fields match anything.
+type Rule struct {
+	Title    string
+	Channel  string
+	Priority int
+}
+
+// Validate checks that the rule's regexps compile.
+func (r Rule) Validate() error {
+	for _, rgx := range []string{r.Title, r.Channel} {
+		if _, err := regexp.Compile("(?i)" + rgx); err != nil {
+			return fmt.Errorf("scheduler: priority regex '%s' did not compile: %s", rgx, err)
+		}
+	}
+	return nil
+}
+
+// Match reports whether the rule applies to d. Matching is case-insensitive.
+func (r Rule) Match(d media.Details) (bool, error) {
+	for _, m := range []struct{ rgx, value string }{
+		{r.Title, d.Title},
+		{r.Channel, d.Channel},
+	} {
+		if m.rgx == "" {
+			continue
+		}
+		rgx, err := regexp.Compile("(?i)" + m.rgx)
+		if err != nil {
+			return false, fmt.Errorf("scheduler: error compiling priority regex '%s': %s", m.rgx, err)
+		}
+		if !rgx.MatchString(m.value) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// PriorityFor returns the priority of the first rule matching d, or zero.
+func (c Config) PriorityFor(d media.Details) int {
+	for _, rule := range c.Rules {
+		ok, err := rule.Match(d)
+		if err != nil {
+			log.WithError(err).Error("scheduler: skipping priority rule")
+			continue
+		}
+		if ok {
+			log.WithFields(log.Fields{
+				"title":    d.Title,
+				"priority": rule.Priority,
+			}).Debug("scheduler: priority rule matched")
+			return rule.Priority
+		}
+	}
+	return 0
+}
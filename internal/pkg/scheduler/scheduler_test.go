@@ -0,0 +1,66 @@
+package scheduler
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/Xiol/tvhtc2/internal/pkg/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func ids(p Policy, jobs []*state.Job) []string {
+	sort.Slice(jobs, func(i, j int) bool { return p.Less(jobs[i], jobs[j]) })
+	out := make([]string, len(jobs))
+	for i := range jobs {
+		out[i] = jobs[i].ID
+	}
+	return out
+}
+
+func TestPolicy_Less(t *testing.T) {
+	jobs := func() []*state.Job {
+		return []*state.Job{
+			{ID: "film", Seq: 1, SourceDuration: 2 * time.Hour},
+			{ID: "unknown", Seq: 2},
+			{ID: "news", Seq: 3, SourceDuration: 5 * time.Minute},
+			{ID: "urgent", Seq: 4, SourceDuration: 3 * time.Hour, Priority: 10},
+		}
+	}
+
+	assert.Equal(t, []string{"film", "unknown", "news", "urgent"}, ids(PolicyFIFO, jobs()))
+	assert.Equal(t, []string{"urgent", "film", "unknown", "news"}, ids(PolicyPriority, jobs()))
+	assert.Equal(t, []string{"urgent", "news", "film", "unknown"}, ids(PolicyShortest, jobs()))
+}
+
+func TestRule_Match(t *testing.T) {
+	d := media.Details{Title: "BBC News at Six", Channel: "BBC One HD"}
+
+	ok, err := Rule{Title: "news"}.Match(d)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = Rule{Title: "news", Channel: "^itv"}.Match(d)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = Rule{Channel: "bbc.one"}.Match(d)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	_, err = Rule{Title: "("}.Match(d)
+	assert.Error(t, err)
+}
+
+func TestConfig_PriorityFor(t *testing.T) {
+	cfg := Config{Rules: []Rule{
+		{Channel: "^itv", Priority: 5},
+		{Title: "news", Priority: 10},
+		{Title: "(", Priority: 20},
+	}}
+
+	assert.Equal(t, 10, cfg.PriorityFor(media.Details{Title: "BBC News", Channel: "BBC One"}))
+	assert.Equal(t, 5, cfg.PriorityFor(media.Details{Title: "ITV News", Channel: "ITV"}), "the first matching rule wins")
+	assert.Equal(t, 0, cfg.PriorityFor(media.Details{Title: "Vera", Channel: "BBC One"}))
+}
@@ -0,0 +1,121 @@
+package spool
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/api"
+	"github.com/Xiol/tvhtc2/internal/pkg/fsutil"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultInterval is how often the daemon checks the spool.
+	DefaultInterval = time.Minute
+	// DefaultPath is used when neither the spool nor the state path is
+	// configured, such as when the client can't read the configuration.
+	DefaultPath = "/var/lib/tvhtc2/spool"
+
+	ext = ".json"
+	// invalidExt is given to spooled files that couldn't be read, so they
+	// are kept for inspection but not tried again.
+	invalidExt = ".invalid"
+)
+
+// Config controls where requests are spooled while the daemon is down.
+type Config struct {
+	Path     string
+	Interval time.Duration
+}
+
+// Write saves req in the spool directory at dir for the daemon to pick up.
+// The file is synced to disk before Write returns, so the request survives
+// a crash. Files are named so that they sort in the order they were written.
+func Write(dir string, req api.Request) (string, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return "", fmt.Errorf("spool: failed to marshal request: %s", err)
+	}
+
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return "", fmt.Errorf("spool: error creating spool directory: %s", err)
+	}
+
+	name := fmt.Sprintf("%020d-%s%s", time.Now().UnixNano(), uuid.New().String(), ext)
+	path := filepath.Join(dir, name)
+	if err := fsutil.WriteFileAtomic(path, data, 0660); err != nil {
+		return "", fmt.Errorf("spool: %s", err)
+	}
+	return path, nil
+}
+
+// Ingest passes each request spooled in dir to fn, oldest first, and
+// removes it once fn succeeds. Requests that fn fails are left for the next
+// time. It returns how many requests were ingested.
+func Ingest(dir string, fn func(api.Request) error) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("spool: error reading spool directory: %s", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		// Temporary files are being written and are skipped by the suffix
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ext) && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var errs []string
+	ingested := 0
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		fields := log.Fields{"path": path}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("error reading %s: %s", path, err))
+			continue
+		}
+
+		req, err := api.Decode(data)
+		if err == nil && req.Command != api.CommandSubmit {
+			err = fmt.Errorf("only submit requests can be spooled, not %s", req.Command)
+		}
+		if err != nil {
+			log.WithError(err).WithFields(fields).Error("spool: invalid spooled request, setting it aside")
+			if rerr := os.Rename(path, path+invalidExt); rerr != nil {
+				errs = append(errs, fmt.Sprintf("error setting aside %s: %s", path, rerr))
+			}
+			continue
+		}
+
+		if err := fn(req); err != nil {
+			errs = append(errs, fmt.Sprintf("error queueing %s: %s", path, err))
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			// Queueing it again is harmless as the daemon ignores known paths
+			errs = append(errs, fmt.Sprintf("error removing %s: %s", path, err))
+			continue
+		}
+		log.WithFields(fields).WithField("title", req.Details.Title).Info("spool: queued spooled recording")
+		ingested++
+	}
+
+	if len(errs) > 0 {
+		return ingested, fmt.Errorf("spool: errors encountered: %s", strings.Join(errs, "; "))
+	}
+	return ingested, nil
+}
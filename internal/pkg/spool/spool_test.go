@@ -0,0 +1,74 @@
+package spool
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/api"
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func submitRequest(path string) api.Request {
+	return api.Request{
+		Command: api.CommandSubmit,
+		Details: &media.Details{Path: path, Title: filepath.Base(path), Status: "OK"},
+	}
+}
+
+func TestWriteIngest(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "spool")
+
+	priority := 5
+	first := submitRequest("/recordings/first.ts")
+	first.Priority = &priority
+	_, err := Write(dir, first)
+	require.NoError(t, err)
+	_, err = Write(dir, submitRequest("/recordings/second.ts"))
+	require.NoError(t, err)
+
+	var got []api.Request
+	n, err := Ingest(dir, func(req api.Request) error {
+		got = append(got, req)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	require.Len(t, got, 2)
+	assert.Equal(t, "/recordings/first.ts", got[0].Details.Path, "oldest first")
+	assert.Equal(t, 5, *got[0].Priority)
+	assert.Equal(t, "/recordings/second.ts", got[1].Details.Path)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "ingested requests are removed")
+}
+
+func TestIngest_failures(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := Write(dir, submitRequest("/recordings/retry.ts"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "garbage.json"), []byte("{"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".partial.json.tmp-123"), []byte("{"), 0600))
+
+	n, err := Ingest(dir, func(api.Request) error { return fmt.Errorf("state is read-only") })
+	assert.Error(t, err)
+	assert.Equal(t, 0, n)
+
+	// Invalid requests are set aside, failed ones are tried again
+	assert.FileExists(t, filepath.Join(dir, "garbage.json.invalid"))
+	n, err = Ingest(dir, func(api.Request) error { return nil })
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.FileExists(t, filepath.Join(dir, ".partial.json.tmp-123"))
+}
+
+func TestIngest_missingDirectory(t *testing.T) {
+	n, err := Ingest(filepath.Join(t.TempDir(), "missing"), func(api.Request) error { return nil })
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
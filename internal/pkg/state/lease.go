@@ -0,0 +1,124 @@
+package state
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// A Lease hands a job to a remote worker until it expires. Leases are only
+// kept in memory, a restarted daemon forgets them and the jobs are queued
+// again, while their workers find their leases gone on the next heartbeat.
+type Lease struct {
+	ID       string    `json:"id"`
+	JobID    string    `json:"job_id"`
+	Worker   string    `json:"worker"`
+	Expires  time.Time `json:"expires"`
+	Progress float64   `json:"progress"`
+}
+
+// Lease claims the next eligible job, as Next does but without waiting, and
+// leases it to worker for ttl. It returns nil if no job is available.
+func (s *State) Lease(worker string, ttl time.Duration, less LessFunc, eligible EligibleFunc) (*Job, *Lease) {
+	job := s.claim(less, eligible)
+	if job == nil {
+		return nil, nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	l := &Lease{
+		ID:      uuid.New().String(),
+		JobID:   job.ID,
+		Worker:  worker,
+		Expires: time.Now().Add(ttl),
+	}
+	s.leases[l.ID] = l
+
+	log.WithFields(log.Fields{
+		"id":     job.ID,
+		"title":  job.Details.Title,
+		"worker": worker,
+	}).Info("state: leased job to worker")
+
+	lease := *l
+	return job, &lease
+}
+
+// Renew extends the lease with the given ID by ttl and records the worker's
+// progress. It fails if the lease has expired or is unknown, in which case
+// the worker should give up on the job.
+func (s *State) Renew(id string, ttl time.Duration, progress float64) (Lease, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	l, ok := s.leases[id]
+	if !ok {
+		return Lease{}, fmt.Errorf("state: no lease with ID %s", id)
+	}
+	l.Expires = time.Now().Add(ttl)
+	l.Progress = progress
+	return *l, nil
+}
+
+// Release ends the lease with the given ID and returns the leased job, so
+// the caller can mark it as done or failed.
+func (s *State) Release(id string) (*Job, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	l, ok := s.leases[id]
+	if !ok {
+		return nil, fmt.Errorf("state: no lease with ID %s", id)
+	}
+	delete(s.leases, id)
+
+	job, ok := s.Jobs[l.JobID]
+	if !ok {
+		delete(s.running, l.JobID)
+		return nil, fmt.Errorf("state: leased job %s is no longer queued", l.JobID)
+	}
+	j := *job
+	return &j, nil
+}
+
+// ExpireLeases returns the jobs of leases that expired before now to the
+// queue, and returns the expired leases.
+func (s *State) ExpireLeases(now time.Time) []Lease {
+	s.Lock()
+	defer s.Unlock()
+
+	var expired []Lease
+	for id, l := range s.leases {
+		if now.Before(l.Expires) {
+			continue
+		}
+		delete(s.leases, id)
+		delete(s.running, l.JobID)
+		expired = append(expired, *l)
+
+		log.WithFields(log.Fields{
+			"id":     l.JobID,
+			"title":  s.title(l.JobID),
+			"worker": l.Worker,
+		}).Warning("state: lease expired, returning job to the queue")
+	}
+
+	if len(expired) > 0 {
+		s.wake()
+	}
+	return expired
+}
+
+// leaseFor returns the lease of the job with the given ID, if it has one.
+func (s *State) leaseFor(jobID string) *Lease {
+	for _, l := range s.leases {
+		if l.JobID == jobID {
+			return l
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package state
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestState_leases(t *testing.T) {
+	s, err := NewState(filepath.Join(t.TempDir(), "state.json"))
+	require.NoError(t, err)
+	id, err := s.Add(media.Details{Path: "/srv/dvr/a.ts", Title: "A"})
+	require.NoError(t, err)
+
+	job, lease := s.Lease("worker1", time.Minute, BySeq, Always)
+	require.NotNil(t, job)
+	assert.Equal(t, id, job.ID)
+	assert.Equal(t, "worker1", lease.Worker)
+
+	job2, _ := s.Lease("worker2", time.Minute, BySeq, Always)
+	assert.Nil(t, job2, "a leased job isn't handed out again")
+
+	_, err = s.Renew(lease.ID, time.Minute, 0.5)
+	require.NoError(t, err)
+	list := s.List()
+	require.Len(t, list, 1)
+	assert.True(t, list[0].Running)
+	assert.Equal(t, "worker1", list[0].Worker)
+	assert.Equal(t, 0.5, list[0].Progress)
+
+	// Nothing has expired yet
+	assert.Empty(t, s.ExpireLeases(time.Now()))
+
+	expired := s.ExpireLeases(time.Now().Add(2 * time.Minute))
+	require.Len(t, expired, 1)
+	assert.Equal(t, id, expired[0].JobID)
+	_, err = s.Renew(lease.ID, time.Minute, 0.6)
+	assert.Error(t, err, "expired leases can't be renewed")
+	_, err = s.Release(lease.ID)
+	assert.Error(t, err)
+
+	job, lease = s.Lease("worker2", time.Minute, BySeq, Always)
+	require.NotNil(t, job, "the job of an expired lease is queued again")
+
+	released, err := s.Release(lease.ID)
+	require.NoError(t, err)
+	require.NoError(t, s.Done(released.ID))
+	assert.Equal(t, 0, s.Len())
+}
@@ -1,37 +1,114 @@
 package state
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/Xiol/tvhtc2/internal/pkg/fsutil"
 	"github.com/Xiol/tvhtc2/internal/pkg/media"
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 )
 
-const defaultJobChannelSize int = 64
-
+// A Job is a queued request to process a recording. Jobs stay in the state
+// until they are marked as done, so they survive restarts.
 type Job struct {
-	ID      string
-	Details *media.Details
+	ID             string         `json:"id"`
+	Seq            uint64         `json:"seq"`
+	Details        *media.Details `json:"details"`
+	Added          time.Time      `json:"added"`
+	Priority       int            `json:"priority"`
+	SourceDuration time.Duration  `json:"source_duration"`
+	Attempts       int            `json:"attempts"`
+	LastError      string         `json:"last_error,omitempty"`
+
+	// Force is set when a job has been asked to run immediately, bypassing
+	// any scheduling restrictions.
+	Force bool `json:"force,omitempty"`
+	// Quarantined jobs have failed too many times and are never retried
+	// unless forced to run.
+	Quarantined bool `json:"quarantined,omitempty"`
+}
+
+// JobStatus is a job along with its current runtime status.
+type JobStatus struct {
+	Job
+	Running bool `json:"running"`
+	Held    bool `json:"held"`
+	// Worker is the remote worker running the job, if any.
+	Worker   string  `json:"worker,omitempty"`
+	Progress float64 `json:"progress,omitempty"`
+}
+
+// A JobOption sets optional fields on a job as it is added.
+type JobOption func(*Job)
+
+// WithPriority sets the priority of a job, higher priorities run first.
+func WithPriority(priority int) JobOption {
+	return func(j *Job) {
+		j.Priority = priority
+	}
 }
 
+// LessFunc reports whether job a should be run before job b.
+type LessFunc func(a, b *Job) bool
+
+// BySeq orders jobs by the order in which they were added.
+func BySeq(a, b *Job) bool {
+	return a.Seq < b.Seq
+}
+
+// EligibleFunc reports whether a job may be started now.
+type EligibleFunc func(j *Job) bool
+
+// Always allows any job to be started.
+func Always(j *Job) bool {
+	return true
+}
+
+// recheckInterval is how often Next re-evaluates eligibility while waiting,
+// as whether a job may run can change with the time of day.
+const recheckInterval = 30 * time.Second
+
+// State is the persistent job queue. The file on disk is the source of truth;
+// workers pull jobs from it with Next rather than being pushed them.
 type State struct {
 	sync.Mutex
-	Pending map[string]media.Details `json:"pending"`
-	JobCh   chan *Job                `json:"-"`
+	Seq  uint64          `json:"seq"`
+	Jobs map[string]*Job `json:"jobs"`
 
-	path string
+	// Pending is only read when loading state files written by older versions.
+	Pending map[string]media.Details `json:"pending,omitempty"`
+
+	path    string
+	running map[string]bool
+	held    map[string]bool
+	leases  map[string]*Lease
+	wakeCh  chan struct{}
+}
+
+// snapshot is the on-disk format of the state file. The checksum covers the
+// raw bytes of State so that corruption that still parses as JSON is caught.
+type snapshot struct {
+	Checksum string          `json:"checksum"`
+	State    json.RawMessage `json:"state"`
 }
 
 func NewState(path string) (*State, error) {
 	s := State{
-		Pending: make(map[string]media.Details),
-		JobCh:   make(chan *Job, defaultJobChannelSize),
+		Jobs:    make(map[string]*Job),
 		path:    path,
+		running: make(map[string]bool),
+		held:    make(map[string]bool),
+		leases:  make(map[string]*Lease),
+		wakeCh:  make(chan struct{}, 1),
 	}
 
 	if err := s.load(); err != nil {
@@ -43,84 +120,406 @@ func NewState(path string) (*State, error) {
 	return &s, nil
 }
 
+func (s *State) backupPath() string {
+	return s.path + ".bak"
+}
+
 func (s *State) load() error {
 	s.Lock()
 	defer s.Unlock()
 
-	rb, err := ioutil.ReadFile(s.path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return s.save()
+	err := s.readFile(s.path)
+	switch {
+	case err == nil:
+	case os.IsNotExist(err):
+		// Saving always leaves a state file, so it was removed by something
+		// else, but the backup is still better than starting afresh.
+		if berr := s.readFile(s.backupPath()); berr != nil {
+			if os.IsNotExist(berr) {
+				return s.save()
+			}
+			return fmt.Errorf("state: no state file and backup unusable: %s", berr)
+		}
+		log.WithField("path", s.backupPath()).Warning("state: state file missing, recovered from backup")
+		if err := s.save(); err != nil {
+			return err
+		}
+	default:
+		log.WithError(err).WithField("path", s.path).Error("state: state file is corrupt, trying backup")
+		s.quarantineCorrupt()
+		if berr := s.readFile(s.backupPath()); berr != nil {
+			return fmt.Errorf("state: state file corrupt (%s) and backup unusable: %s", err, berr)
+		}
+		log.WithField("path", s.backupPath()).Warning("state: recovered state from backup")
+		if err := s.save(); err != nil {
+			return err
 		}
-		return fmt.Errorf("state: %s", err)
 	}
 
-	if err := json.Unmarshal(rb, s); err != nil {
-		return fmt.Errorf("state: error unmarshalling: %s", err)
+	if len(s.Pending) > 0 {
+		s.migrateLegacy()
+		if err := s.save(); err != nil {
+			return err
+		}
 	}
 
-	l := len(s.Pending)
-	if l > defaultJobChannelSize {
-		if l > 4096 {
-			log.Fatalf("state: pending jobs >4096 (%d)?", l)
-		}
-		log.Debug("state: resizing job channel")
-		s.JobCh = make(chan *Job, l*2)
+	for _, job := range s.Jobs {
+		log.WithFields(log.Fields{
+			"id":    job.ID,
+			"title": job.Details.Title,
+		}).Info("state: found pending job")
 	}
 
+	log.WithField("pending_count", len(s.Jobs)).Info("state: loaded state from disk")
+
+	return nil
+}
+
+// migrateLegacy converts the pending map used by older versions into jobs.
+func (s *State) migrateLegacy() {
+	log.WithField("count", len(s.Pending)).Info("state: migrating legacy pending jobs")
+	now := time.Now()
 	for id, details := range s.Pending {
-		log.WithFields(log.Fields{
-			"id":    id,
-			"title": details.Title,
-		}).Info("state: adding pending job")
-		s.JobCh <- &Job{id, &details}
+		d := details
+		s.Seq++
+		s.Jobs[id] = &Job{
+			ID:      id,
+			Seq:     s.Seq,
+			Details: &d,
+			Added:   now,
+		}
+	}
+	s.Pending = nil
+}
+
+// readFile decodes the state file at path into s. Errors satisfying
+// os.IsNotExist are returned untouched, anything else means the file is unusable.
+func (s *State) readFile(path string) error {
+	rb, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
 	}
 
-	log.WithField("pending_count", len(s.Pending)).Info("state: loaded state from disk")
+	raw, err := verify(rb)
+	if err != nil {
+		return err
+	}
+
+	var loaded State
+	if err := json.Unmarshal(raw, &loaded); err != nil {
+		return fmt.Errorf("state: error unmarshalling: %s", err)
+	}
 
+	s.Seq = loaded.Seq
+	s.Jobs = make(map[string]*Job, len(loaded.Jobs))
+	for id, job := range loaded.Jobs {
+		if job == nil || job.Details == nil {
+			log.WithField("id", id).Warning("state: dropping job with no details")
+			continue
+		}
+		job.ID = id
+		s.Jobs[id] = job
+	}
+	s.Pending = loaded.Pending
 	return nil
 }
 
+// verify checks the checksum of a snapshot and returns the raw state within it.
+// Files written before checksums were introduced are returned as-is.
+func verify(rb []byte) ([]byte, error) {
+	if len(rb) == 0 {
+		return nil, fmt.Errorf("state: file is empty")
+	}
+
+	var snap snapshot
+	if err := json.Unmarshal(rb, &snap); err != nil {
+		return nil, fmt.Errorf("state: error unmarshalling: %s", err)
+	}
+
+	if snap.State == nil {
+		log.Debug("state: state file has no checksum, assuming legacy format")
+		return rb, nil
+	}
+
+	if sum := checksum(snap.State); sum != snap.Checksum {
+		return nil, fmt.Errorf("state: checksum mismatch, expected %s got %s", snap.Checksum, sum)
+	}
+
+	return snap.State, nil
+}
+
+func checksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// quarantineCorrupt moves a corrupt state file out of the way so it can be
+// inspected later and isn't rotated over the good backup by the next save.
+func (s *State) quarantineCorrupt() {
+	dest := fmt.Sprintf("%s.corrupt-%d", s.path, time.Now().Unix())
+	if err := os.Rename(s.path, dest); err != nil {
+		log.WithError(err).Error("state: failed to move corrupt state file aside")
+		return
+	}
+	log.WithField("path", dest).Warning("state: moved corrupt state file aside")
+}
+
 func (s *State) save() error {
 	log.Debug("state: saving state to disk")
 
-	jout, err := json.Marshal(s)
+	raw, err := json.Marshal(s)
 	if err != nil {
 		return fmt.Errorf("state: error marshalling: %s", err)
 	}
 
-	err = ioutil.WriteFile(s.path, jout, 0640)
+	jout, err := json.Marshal(snapshot{
+		Checksum: checksum(raw),
+		State:    raw,
+	})
 	if err != nil {
+		return fmt.Errorf("state: error marshalling: %s", err)
+	}
+
+	if err := fsutil.ReplaceFileAtomic(s.path, s.backupPath(), jout, 0640); err != nil {
 		return fmt.Errorf("state: error writing state: %s", err)
 	}
 
 	return nil
 }
 
-func (s *State) Add(d media.Details) error {
+// Add persists a new job built from d and wakes any worker waiting in Next.
+// It returns the ID of the new job.
+func (s *State) Add(d media.Details, options ...JobOption) (string, error) {
 	s.Lock()
 	defer s.Unlock()
+
 	id := uuid.Must(uuid.NewUUID()).String()
-	s.Pending[id] = d
-	s.JobCh <- &Job{id, &d}
+	s.Seq++
+	job := &Job{
+		ID:      id,
+		Seq:     s.Seq,
+		Details: &d,
+		Added:   time.Now(),
+	}
+
+	for _, opt := range options {
+		opt(job)
+	}
+	s.Jobs[id] = job
 
 	log.WithFields(log.Fields{
-		"title": d.Title,
-		"id":    id,
+		"title":    d.Title,
+		"id":       id,
+		"priority": job.Priority,
 	}).Debug("state: appending new entity to state")
 
+	if err := s.save(); err != nil {
+		delete(s.Jobs, id)
+		return "", err
+	}
+
+	s.wake()
+	return id, nil
+}
+
+// Next blocks until an eligible job is available and returns the first
+// according to less, marking it as running so that no other worker is handed
+// the same job. The returned bool is false if closeCh fired before a job
+// became available.
+func (s *State) Next(closeCh <-chan struct{}, less LessFunc, eligible EligibleFunc) (*Job, bool) {
+	ticker := time.NewTicker(recheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if job := s.claim(less, eligible); job != nil {
+			return job, true
+		}
+
+		select {
+		case <-closeCh:
+			return nil, false
+		case <-s.wakeCh:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *State) claim(less LessFunc, eligible EligibleFunc) *Job {
+	s.Lock()
+	defer s.Unlock()
+
+	var next *Job
+	for id, job := range s.Jobs {
+		if s.running[id] || s.held[id] || (job.Quarantined && !job.Force) || !eligible(job) {
+			continue
+		}
+		if next == nil || less(job, next) {
+			next = job
+		}
+	}
+
+	if next == nil {
+		return nil
+	}
+
+	s.running[next.ID] = true
+	j := *next
+	return &j
+}
+
+// wake signals a worker blocked in Next without ever blocking the caller.
+func (s *State) wake() {
+	select {
+	case s.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// RunNow forces the job with the given ID to run regardless of scheduling
+// restrictions, releasing it if it was held after a failure. If id is empty
+// every queued job is forced. It returns the number of jobs affected.
+func (s *State) RunNow(id string) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	count := 0
+	for jid, job := range s.Jobs {
+		if id != "" && jid != id {
+			continue
+		}
+		job.Force = true
+		delete(s.held, jid)
+		count++
+	}
+
+	if id != "" && count == 0 {
+		return 0, fmt.Errorf("state: no job with ID %s", id)
+	}
+
+	log.WithFields(log.Fields{
+		"id":    id,
+		"count": count,
+	}).Info("state: forcing jobs to run now")
+
+	if err := s.save(); err != nil {
+		return count, err
+	}
+
+	s.wake()
+	return count, nil
+}
+
+// List returns the status of every job in the state, in the order they were added.
+func (s *State) List() []JobStatus {
+	s.Lock()
+	defer s.Unlock()
+
+	list := make([]JobStatus, 0, len(s.Jobs))
+	for id, job := range s.Jobs {
+		status := JobStatus{
+			Job:     *job,
+			Running: s.running[id],
+			Held:    s.held[id],
+		}
+		if l := s.leaseFor(id); l != nil {
+			status.Worker, status.Progress = l.Worker, l.Progress
+		}
+		list = append(list, status)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Seq < list[j].Seq
+	})
+	return list
+}
+
+// Len returns the number of jobs in the state, including running jobs.
+func (s *State) Len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.Jobs)
+}
+
+// HasPath reports whether a job for the recording at path is in the state.
+func (s *State) HasPath(path string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, job := range s.Jobs {
+		if job.Details.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// SetSourceDuration records the probed duration of the source recording of
+// the job with id, if it is still queued.
+func (s *State) SetSourceDuration(id string, d time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+
+	job, ok := s.Jobs[id]
+	if !ok {
+		return nil
+	}
+	job.SourceDuration = d
 	return s.save()
 }
 
+// Done removes a finished job from the state.
 func (s *State) Done(id string) error {
 	s.Lock()
 	defer s.Unlock()
 
 	log.WithFields(log.Fields{
-		"title": s.Pending[id].Title,
+		"title": s.title(id),
 		"id":    id,
 	}).Debug("state: removing entity from state")
 
-	delete(s.Pending, id)
+	delete(s.Jobs, id)
+	delete(s.running, id)
+	delete(s.held, id)
 	return s.save()
 }
+
+// Fail records a failed attempt at a job. The job is kept in the state but
+// will not be handed out again until the daemon is restarted. Once a job has
+// failed maxAttempts times it is quarantined and won't be retried at all,
+// which is reported by the returned bool. A maxAttempts of zero or less
+// retries forever.
+func (s *State) Fail(id string, jobErr error, maxAttempts int) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.running, id)
+	job, ok := s.Jobs[id]
+	if !ok {
+		return false, nil
+	}
+
+	job.Attempts++
+	job.LastError = jobErr.Error()
+	job.Force = false
+	s.held[id] = true
+
+	if maxAttempts > 0 && job.Attempts >= maxAttempts {
+		job.Quarantined = true
+	}
+
+	log.WithFields(log.Fields{
+		"title":       job.Details.Title,
+		"id":          id,
+		"attempts":    job.Attempts,
+		"quarantined": job.Quarantined,
+	}).Info("state: job failed, holding until restart")
+
+	return job.Quarantined, s.save()
+}
+
+func (s *State) title(id string) string {
+	if job, ok := s.Jobs[id]; ok {
+		return job.Details.Title
+	}
+	return ""
+}
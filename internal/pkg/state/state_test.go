@@ -0,0 +1,201 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestState_roundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	s, err := NewState(path)
+	require.NoError(t, err)
+	_, err = s.Add(media.Details{Path: "/srv/dvr/a.mkv", Title: "A"})
+	require.NoError(t, err)
+	_, err = s.Add(media.Details{Path: "/srv/dvr/b.mkv", Title: "B"})
+	require.NoError(t, err)
+
+	s2, err := NewState(path)
+	require.NoError(t, err)
+	assert.Len(t, s2.Jobs, 2)
+}
+
+func TestState_recoversFromBackup(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+
+	s, err := NewState(path)
+	require.NoError(t, err)
+	_, err = s.Add(media.Details{Path: "/srv/dvr/a.mkv", Title: "A"})
+	require.NoError(t, err)
+	_, err = s.Add(media.Details{Path: "/srv/dvr/b.mkv", Title: "B"})
+	require.NoError(t, err)
+
+	// Simulate a torn write of the primary state file
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"checksum":"abc","state":{"pend`), 0640))
+
+	s2, err := NewState(path)
+	require.NoError(t, err)
+	assert.Len(t, s2.Jobs, 1, "backup holds the state prior to the last save")
+
+	matches, _ := filepath.Glob(path + ".corrupt-*")
+	assert.Len(t, matches, 1)
+}
+
+func TestState_checksumMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	s, err := NewState(path)
+	require.NoError(t, err)
+	_, err = s.Add(media.Details{Path: "/srv/dvr/a.mkv", Title: "A"})
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"checksum":"abc","state":{"pending":{}}}`), 0640))
+	require.NoError(t, os.Remove(path+".bak"))
+
+	_, err = NewState(path)
+	assert.Error(t, err)
+}
+
+func TestState_missingPrimary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	s, err := NewState(path)
+	require.NoError(t, err)
+	_, err = s.Add(media.Details{Path: "/srv/dvr/a.mkv", Title: "A"})
+	require.NoError(t, err)
+	_, err = s.Add(media.Details{Path: "/srv/dvr/b.mkv", Title: "B"})
+	require.NoError(t, err)
+
+	// Saving never leaves only the backup, but it may be removed by hand
+	s2, err := NewState(path)
+	require.NoError(t, err)
+	assert.Len(t, s2.Jobs, 2, "the last acknowledged job is in the state file")
+	require.NoError(t, os.Remove(path))
+
+	s3, err := NewState(path)
+	require.NoError(t, err)
+	assert.Len(t, s3.Jobs, 1, "the backup is one save behind")
+}
+
+func TestState_legacyFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	require.NoError(t, ioutil.WriteFile(path,
+		[]byte(`{"pending":{"x":{"path":"/srv/dvr/a.mkv","title":"A"}}}`), 0640))
+
+	s, err := NewState(path)
+	require.NoError(t, err)
+	assert.Equal(t, "A", s.Jobs["x"].Details.Title)
+}
+
+func TestState_nextOrdering(t *testing.T) {
+	s, err := NewState(filepath.Join(t.TempDir(), "state.json"))
+	require.NoError(t, err)
+
+	first, err := s.Add(media.Details{Path: "/srv/dvr/a.mkv", Title: "A"})
+	require.NoError(t, err)
+	second, err := s.Add(media.Details{Path: "/srv/dvr/b.mkv", Title: "B"})
+	require.NoError(t, err)
+
+	closeCh := make(chan struct{})
+	job, ok := s.Next(closeCh, BySeq, Always)
+	require.True(t, ok)
+	assert.Equal(t, first, job.ID)
+
+	// The running job must not be handed out twice
+	job, ok = s.Next(closeCh, BySeq, Always)
+	require.True(t, ok)
+	assert.Equal(t, second, job.ID)
+
+	_, err = s.Fail(second, fmt.Errorf("boom"), 0)
+	require.NoError(t, err)
+	require.NoError(t, s.Done(first))
+	assert.Equal(t, 1, s.Len())
+
+	close(closeCh)
+	_, ok = s.Next(closeCh, BySeq, Always)
+	assert.False(t, ok, "failed jobs are held until restart")
+}
+
+func TestState_nextWakes(t *testing.T) {
+	s, err := NewState(filepath.Join(t.TempDir(), "state.json"))
+	require.NoError(t, err)
+
+	got := make(chan *Job)
+	go func() {
+		job, _ := s.Next(make(chan struct{}), BySeq, Always)
+		got <- job
+	}()
+
+	id, err := s.Add(media.Details{Path: "/srv/dvr/a.mkv", Title: "A"})
+	require.NoError(t, err)
+
+	select {
+	case job := <-got:
+		assert.Equal(t, id, job.ID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker was not woken by Add")
+	}
+}
+
+func TestState_noPendingLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	var sb strings.Builder
+	sb.WriteString(`{"pending":{`)
+	for i := 0; i < 5000; i++ {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		fmt.Fprintf(&sb, `"job-%d":{"path":"/srv/dvr/%d.mkv","title":"T"}`, i, i)
+	}
+	sb.WriteString(`}}`)
+	require.NoError(t, ioutil.WriteFile(path, []byte(sb.String()), 0640))
+
+	s, err := NewState(path)
+	require.NoError(t, err)
+	assert.Equal(t, 5000, s.Len())
+}
+
+func TestState_quarantine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := NewState(path)
+	require.NoError(t, err)
+
+	id, err := s.Add(media.Details{Path: "/srv/dvr/a.mkv", Title: "A"})
+	require.NoError(t, err)
+
+	closed := make(chan struct{})
+	close(closed)
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		// Reloading the state simulates a restart, which releases held jobs
+		s, err = NewState(path)
+		require.NoError(t, err)
+		job, ok := s.Next(closed, BySeq, Always)
+		require.True(t, ok)
+		quarantined, err := s.Fail(job.ID, fmt.Errorf("boom"), 2)
+		require.NoError(t, err)
+		assert.Equal(t, attempt == 2, quarantined)
+	}
+
+	s, err = NewState(path)
+	require.NoError(t, err)
+	_, ok := s.Next(closed, BySeq, Always)
+	assert.False(t, ok, "quarantined jobs are not retried after a restart")
+
+	_, err = s.RunNow(id)
+	require.NoError(t, err)
+	job, ok := s.Next(closed, BySeq, Always)
+	require.True(t, ok, "forcing a quarantined job runs it")
+	assert.Equal(t, "boom", job.LastError)
+}
@@ -0,0 +1,108 @@
+package timewindow
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const day = 24 * time.Hour
+
+// A Window is a daily period of local time such as "01:00-07:00". Windows
+// whose end is before their start wrap past midnight, e.g. "22:00-06:30".
+type Window struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// Parse parses a window in the form "HH:MM-HH:MM".
+func Parse(s string) (Window, error) {
+	var w Window
+
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) != 2 {
+		return w, fmt.Errorf("timewindow: '%s' is not in the form HH:MM-HH:MM", s)
+	}
+
+	var err error
+	if w.Start, err = parseClock(parts[0]); err != nil {
+		return w, fmt.Errorf("timewindow: bad start time in '%s': %s", s, err)
+	}
+	if w.End, err = parseClock(parts[1]); err != nil {
+		return w, fmt.Errorf("timewindow: bad end time in '%s': %s", s, err)
+	}
+	if w.Start == w.End {
+		return w, fmt.Errorf("timewindow: '%s' has the same start and end", s)
+	}
+	return w, nil
+}
+
+// ParseAll parses a list of windows.
+func ParseAll(ss []string) ([]Window, error) {
+	windows := make([]Window, 0, len(ss))
+	for _, s := range ss {
+		w, err := Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func sinceMidnight(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+}
+
+// Contains reports whether t falls within the window.
+func (w Window) Contains(t time.Time) bool {
+	now := sinceMidnight(t)
+	if w.Start < w.End {
+		return now >= w.Start && now < w.End
+	}
+	return now >= w.Start || now < w.End
+}
+
+// NextEnd returns the next time at or after t that the window closes.
+func (w Window) NextEnd(t time.Time) time.Time {
+	return next(t, w.End)
+}
+
+func next(t time.Time, at time.Duration) time.Time {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	n := midnight.Add(at)
+	if n.Before(t) {
+		n = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()).Add(at)
+	}
+	return n
+}
+
+func (w Window) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d",
+		int(w.Start/time.Hour), int(w.Start%time.Hour/time.Minute),
+		int(w.End/time.Hour), int(w.End%time.Hour/time.Minute))
+}
+
+// AnyContains reports whether t falls within any of windows. An empty list
+// of windows is treated as always open.
+func AnyContains(windows []Window, t time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	for _, w := range windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package timewindow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func at(hour, min int) time.Time {
+	return time.Date(2020, 1, 1, hour, min, 0, 0, time.Local)
+}
+
+func TestWindow_Contains(t *testing.T) {
+	w, err := Parse("01:00-07:00")
+	require.NoError(t, err)
+	assert.True(t, w.Contains(at(1, 0)))
+	assert.True(t, w.Contains(at(6, 59)))
+	assert.False(t, w.Contains(at(7, 0)))
+	assert.False(t, w.Contains(at(23, 0)))
+
+	w, err = Parse("22:00-06:30")
+	require.NoError(t, err)
+	assert.True(t, w.Contains(at(23, 0)))
+	assert.True(t, w.Contains(at(3, 0)))
+	assert.False(t, w.Contains(at(6, 30)))
+	assert.False(t, w.Contains(at(12, 0)))
+	assert.Equal(t, "22:00-06:30", w.String())
+}
+
+func TestWindow_NextEnd(t *testing.T) {
+	w, err := Parse("22:00-06:30")
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2020, 1, 2, 6, 30, 0, 0, time.Local), w.NextEnd(at(23, 0)))
+	assert.Equal(t, at(6, 30), w.NextEnd(at(3, 0)))
+}
+
+func TestParse_errors(t *testing.T) {
+	for _, s := range []string{"", "01:00", "25:00-02:00", "01:00-01:00", "1am-2am"} {
+		_, err := Parse(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestAnyContains(t *testing.T) {
+	assert.True(t, AnyContains(nil, at(12, 0)))
+
+	ws, err := ParseAll([]string{"01:00-02:00", "04:00-05:00"})
+	require.NoError(t, err)
+	assert.True(t, AnyContains(ws, at(4, 30)))
+	assert.False(t, AnyContains(ws, at(3, 0)))
+}
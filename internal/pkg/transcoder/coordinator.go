@@ -0,0 +1,110 @@
+package transcoder
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/api"
+	"github.com/Xiol/tvhtc2/internal/pkg/cluster"
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/Xiol/tvhtc2/internal/pkg/remote"
+	log "github.com/sirupsen/logrus"
+)
+
+// Coordinate lets remote workers lease jobs from the queue through srv.
+func (t *Transcoder) Coordinate(srv *remote.Server) {
+	srv.Handle(cluster.LeasePath, http.HandlerFunc(t.handleLease))
+	srv.Handle(cluster.HeartbeatPath, http.HandlerFunc(t.handleHeartbeat))
+	srv.Handle(cluster.ResultPath, http.HandlerFunc(t.handleResult))
+	go t.leaseHandler()
+}
+
+// leaseHandler returns the jobs of workers that have stopped sending
+// heartbeats to the queue.
+func (t *Transcoder) leaseHandler() {
+	ticker := time.NewTicker(t.config().Cluster.TTL() / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.bgCloseCh:
+			return
+		case now := <-ticker.C:
+			t.state.ExpireLeases(now)
+		}
+	}
+}
+
+func (t *Transcoder) handleLease(w http.ResponseWriter, r *http.Request) {
+	var req cluster.LeaseRequest
+	if !remote.ReadJSON(w, r, &req) {
+		return
+	}
+
+	cfg := t.config()
+	job, lease := t.state.Lease(req.Worker, cfg.Cluster.TTL(), cfg.Scheduling.Policy.Less, t.gate.Allows)
+	if job == nil {
+		remote.WriteJSON(w, http.StatusOK, api.Ok(nil))
+		return
+	}
+
+	// Workers may not be able to reach TVHeadend, so look it up for them
+	details := t.enrich(*job.Details, cfg.TVHeadend)
+	job.Details = &details
+	remote.WriteJSON(w, http.StatusOK, api.Ok(cluster.LeaseResponse{Lease: *lease, Job: *job, TTL: cfg.Cluster.TTL()}))
+}
+
+func (t *Transcoder) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	var req cluster.HeartbeatRequest
+	if !remote.ReadJSON(w, r, &req) {
+		return
+	}
+
+	if _, err := t.state.Renew(req.Lease, t.config().Cluster.TTL(), req.Progress); err != nil {
+		remote.WriteJSON(w, http.StatusGone, api.Fail(err))
+		return
+	}
+	remote.WriteJSON(w, http.StatusOK, api.Ok(nil))
+}
+
+func (t *Transcoder) handleResult(w http.ResponseWriter, r *http.Request) {
+	var req cluster.ResultRequest
+	if !remote.ReadJSON(w, r, &req) {
+		return
+	}
+
+	job, err := t.state.Release(req.Lease)
+	if err != nil {
+		remote.WriteJSON(w, http.StatusGone, api.Fail(err))
+		return
+	}
+
+	cfg := t.config()
+	e := media.FromResult(*job.Details, req.Result)
+	fields := log.Fields{
+		"id":    job.ID,
+		"path":  job.Details.Path,
+		"title": job.Details.Title,
+	}
+
+	if req.Result.Error != "" {
+		log.WithFields(fields).WithField("error", req.Result.Error).Error("transcoder: worker failed to transcode job")
+		e.Quarantined = t.fail(job, errors.New(req.Result.Error), cfg.MaxAttempts)
+		// As when transcoding locally, recordings that couldn't even be
+		// probed aren't notified
+		if req.Result.Media != 0 {
+			t.notify(e)
+		}
+		remote.WriteJSON(w, http.StatusOK, api.Ok(nil))
+		return
+	}
+
+	if err := t.state.Done(job.ID); err != nil {
+		log.WithError(err).WithFields(fields).Error("transcoder: failed to mark job as done")
+		e.SetError(err)
+	}
+	log.WithFields(fields).Info("transcoder: worker finished job")
+	t.notify(e)
+	remote.WriteJSON(w, http.StatusOK, api.Ok(nil))
+}
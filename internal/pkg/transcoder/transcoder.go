@@ -6,35 +6,62 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"time"
 
+	"github.com/Xiol/tvhtc2/internal/pkg/api"
+	"github.com/Xiol/tvhtc2/internal/pkg/config"
+	"github.com/Xiol/tvhtc2/internal/pkg/history"
 	"github.com/Xiol/tvhtc2/internal/pkg/media"
 	"github.com/Xiol/tvhtc2/internal/pkg/notify"
+	"github.com/Xiol/tvhtc2/internal/pkg/reconcile"
+	"github.com/Xiol/tvhtc2/internal/pkg/remote"
+	"github.com/Xiol/tvhtc2/internal/pkg/scheduler"
+	"github.com/Xiol/tvhtc2/internal/pkg/spool"
 	"github.com/Xiol/tvhtc2/internal/pkg/state"
+	"github.com/Xiol/tvhtc2/internal/pkg/tvheadend"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 )
 
+// maxProbes limits how many sources are probed at once, as when reconciling
+// queues many recordings.
+const maxProbes = 2
+
 type Transcoder struct {
 	binaryPath          string
+	config              func() *config.Config
 	notificationHandler notify.Handler
 	state               *state.State
+	history             *history.History
+	gate                *scheduler.Gate
+	probes              chan struct{}
+	probeDuration       func(path string) (time.Duration, error)
 	incCloseCh          chan struct{}
 	trnCloseCh          chan struct{}
+	bgCloseCh           chan struct{}
 }
 
 func New(notificationHandler notify.Handler, options ...func(*Transcoder)) (Transcoder, error) {
 	t := Transcoder{
 		notificationHandler: notificationHandler,
+		config:              config.Current,
+		probes:              make(chan struct{}, maxProbes),
+		probeDuration:       media.ProbeDuration,
 		incCloseCh:          make(chan struct{}),
 		trnCloseCh:          make(chan struct{}),
+		bgCloseCh:           make(chan struct{}),
 	}
 
 	for _, opt := range options {
 		opt(&t)
 	}
 
+	current := t.config
+	t.gate = scheduler.NewGate(func() scheduler.Config {
+		return current().Scheduling
+	})
+
 	var err error
-	if t.state, err = state.NewState(viper.GetString("state_path")); err != nil {
+	if t.state, err = state.NewState(t.config().StatePath); err != nil {
 		return t, err
 	}
 
@@ -47,23 +74,64 @@ func BinaryPath(path string) func(*Transcoder) {
 	}
 }
 
+// Config sets where the configuration snapshot for each job is taken from,
+// config.Current by default.
+func Config(fn func() *config.Config) func(*Transcoder) {
+	return func(t *Transcoder) {
+		t.config = fn
+	}
+}
+
+// History records every finished recording in h.
+func History(h *history.History) func(*Transcoder) {
+	return func(t *Transcoder) {
+		t.history = h
+	}
+}
+
+// Close stops accepting requests and starting jobs. A job already running
+// is left to finish.
 func (t *Transcoder) Close() {
-	t.incCloseCh <- struct{}{}
-	t.trnCloseCh <- struct{}{}
+	close(t.incCloseCh)
+	close(t.trnCloseCh)
+	close(t.bgCloseCh)
 }
 
 // Do will start handling jobs. This function blocks.
 func (t *Transcoder) Do() error {
+	if cfg := t.config(); cfg.Reconcile.OnStartup {
+		// Nothing is running here yet, so any temporary file is orphaned,
+		// unless remote workers are writing theirs beside the sources
+		var options []func(*reconcile.Reconciler)
+		if !cfg.Cluster.Enabled {
+			options = append(options, reconcile.Idle())
+		}
+		if _, err := t.reconcile(cfg.Reconcile.Enqueue, options...); err != nil {
+			log.WithError(err).Error("transcoder: error reconciling recordings")
+		}
+	}
+
+	go t.gate.Watch(t.bgCloseCh)
+
+	// Recordings spooled by clients while we were down
+	t.ingestSpool()
+	go t.spoolHandler()
+
 	if err := t.listen(); err != nil {
 		return err
 	}
 	log.Info("transcoder: ready for jobs")
+	if t.config().Cluster.RemoteOnly {
+		// Jobs are only run by remote workers
+		<-t.trnCloseCh
+		return nil
+	}
 	t.transcodeHandler()
 	return nil
 }
 
 func (t *Transcoder) listen() error {
-	sockPath := viper.GetString("socket_path")
+	sockPath := t.config().SocketPath
 	if err := os.RemoveAll(sockPath); err != nil {
 		return fmt.Errorf("transcoder: error removing old socket: %s", err)
 	}
@@ -73,80 +141,296 @@ func (t *Transcoder) listen() error {
 		return fmt.Errorf("transcoder: error listening at unix:%s: %s", sockPath, err)
 	}
 
+	// Accept only returns once the listener is closed
+	go func(l net.Listener, closeCh chan struct{}) {
+		<-closeCh
+		l.Close()
+	}(listener, t.incCloseCh)
+
 	go func(l net.Listener, closeCh chan struct{}) {
-		defer l.Close()
 		for {
-			select {
-			case <-closeCh:
-				return
-			default:
-				conn, err := l.Accept()
-				if err != nil {
-					log.WithError(err).Error("transcoder: accept error")
+			conn, err := l.Accept()
+			if err != nil {
+				select {
+				case <-closeCh:
+					return
+				default:
 				}
-				go t.incomingHandler(conn)
+				log.WithError(err).Error("transcoder: accept error")
+				continue
 			}
+			go t.incomingHandler(conn)
 		}
 	}(listener, t.incCloseCh)
 	return nil
 }
 
 func (t *Transcoder) incomingHandler(conn net.Conn) {
+	defer conn.Close()
+
 	data, err := ioutil.ReadAll(conn)
 	if err != nil {
 		log.WithError(err).Error("transcoder: socket read error")
 		return
 	}
 
-	var details media.Details
-	err = json.Unmarshal(data, &details)
+	resp := t.handleRequest(data)
+	out, err := json.Marshal(resp)
 	if err != nil {
-		log.WithError(err).Error("transcoder: failed to unmarshal media details")
+		log.WithError(err).Error("transcoder: failed to marshal response")
 		return
 	}
 
-	if err := t.state.Add(details); err != nil {
+	// Older clients hang up without waiting for a response
+	if _, err := conn.Write(out); err != nil {
+		log.WithError(err).Debug("transcoder: failed to write response")
+	}
+}
+
+func (t *Transcoder) handleRequest(data []byte) api.Response {
+	req, err := api.Decode(data)
+	if err != nil {
+		log.WithError(err).Error("transcoder: failed to decode request")
+		return api.Fail(err)
+	}
+	return t.Handle(req)
+}
+
+// Handle carries out a request, from the socket or a remote client.
+func (t *Transcoder) Handle(req api.Request) api.Response {
+	switch req.Command {
+	case api.CommandSubmit:
+		return t.submit(req)
+	case api.CommandList:
+		return api.Ok(t.state.List())
+	case api.CommandReconcile:
+		result, err := t.reconcile(req.Enqueue)
+		if err != nil {
+			return api.Fail(err)
+		}
+		return api.Ok(result)
+	case api.CommandRunNow:
+		count, err := t.state.RunNow(req.JobID)
+		if err != nil {
+			return api.Fail(err)
+		}
+		return api.Ok(map[string]int{"count": count})
+	default:
+		log.WithField("command", req.Command).Error("transcoder: unknown command")
+		return api.Fail(fmt.Errorf("transcoder: unknown command '%s'", req.Command))
+	}
+}
+
+func (t *Transcoder) submit(req api.Request) api.Response {
+	id, err := t.add(*req.Details, req.Priority)
+	if err != nil {
+		return api.Fail(err)
+	}
+	return api.Ok(map[string]string{"id": id})
+}
+
+// add queues a job for details, with the priority from the scheduling rules
+// unless priority is set. The source is probed for its duration once the
+// job is queued, so a slow mount never holds up whoever submitted it.
+func (t *Transcoder) add(details media.Details, priority *int) (string, error) {
+	p := t.config().Scheduling.PriorityFor(details)
+	if priority != nil {
+		p = *priority
+	}
+
+	id, err := t.state.Add(details, state.WithPriority(p))
+	if err != nil {
 		log.WithError(err).Error("transcoder: failed to add media entity to state")
+		return "", err
+	}
+
+	go t.probe(id, details.Path)
+	return id, nil
+}
+
+// probe records the duration of the job's source, for the shortest first
+// policy. Until it is known the job is ordered as if it were unknown.
+func (t *Transcoder) probe(id, path string) {
+	t.probes <- struct{}{}
+	defer func() { <-t.probes }()
+
+	d, err := t.probeDuration(path)
+	if err != nil {
+		log.WithError(err).WithField("path", path).Debug("transcoder: could not probe source duration")
 		return
 	}
-	return
+	if err := t.state.SetSourceDuration(id, d); err != nil {
+		log.WithError(err).Error("transcoder: failed to record source duration")
+	}
 }
 
-func (t *Transcoder) transcodeHandler() {
+// Submit queues a job for details, as if it had been sent by the client.
+func (t *Transcoder) Submit(details media.Details) error {
+	_, err := t.add(details, nil)
+	return err
+}
+
+// reconcile cleans up after transcodes that never finished and finds
+// recordings that were never processed, queueing them if enqueue is set.
+func (t *Transcoder) reconcile(enqueue bool, options ...func(*reconcile.Reconciler)) (reconcile.Result, error) {
+	options = append(options, reconcile.Known(t.Known))
+	result, err := reconcile.New(t.config().Reconcile, options...).Run(time.Now())
+
+	if enqueue {
+		for _, details := range result.Unprocessed {
+			if qerr := t.Submit(details); qerr != nil {
+				log.WithError(qerr).WithField("path", details.Path).Error("transcoder: failed to queue unprocessed recording")
+				continue
+			}
+			result.Queued++
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"removed":     len(result.Removed),
+		"unprocessed": len(result.Unprocessed),
+		"queued":      result.Queued,
+	}).Info("transcoder: reconciled recordings")
+	return result, err
+}
+
+// spoolHandler ingests the spool periodically, in case a client couldn't
+// reach us while we were running, such as during a restart.
+func (t *Transcoder) spoolHandler() {
+	interval := t.config().Spool.Interval
+	if interval <= 0 {
+		interval = spool.DefaultInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
 	for {
 		select {
-		case <-t.trnCloseCh:
+		case <-t.bgCloseCh:
 			return
-		case job := <-t.state.JobCh:
-			e, err := media.NewEntity(*job.Details)
-			if err != nil {
-				log.WithFields(log.Fields{
-					"error": err,
-					"path":  job.Details.Path,
-				}).Error("transcoder: error creating entity")
-				continue
-			}
+		case <-ticker.C:
+			t.ingestSpool()
+		}
+	}
+}
 
-			if err := e.Transcode(); err != nil {
-				log.WithError(err).Error("transcoder: error during transcode")
-				e.SetError(fmt.Errorf("transcoder: error during transcode: %s", err))
-				t.notify(e)
-				continue
-			}
+// ingestSpool queues the recordings that clients spooled because they
+// couldn't reach the daemon.
+func (t *Transcoder) ingestSpool() {
+	cfg := t.config()
+	n, err := spool.Ingest(cfg.Spool.Path, func(req api.Request) error {
+		// A remote client may have spooled it to shared storage. Anything
+		// else was spooled by a local client, which is trusted as the
+		// socket is.
+		path, err := remote.MapPath(cfg.Remote.PathMap, req.Details.Path)
+		if err != nil && err != remote.ErrUnmapped {
+			log.WithError(err).Error("transcoder: ignoring spooled recording")
+			return nil
+		}
+		req.Details.Path = path
+		if t.Known(req.Details.Path) {
+			log.WithField("path", req.Details.Path).Debug("transcoder: spooled recording is already known, ignoring")
+			return nil
+		}
+		_, err = t.add(*req.Details, req.Priority)
+		return err
+	})
+	if err != nil {
+		log.WithError(err).Error("transcoder: error ingesting spool")
+	}
+	if n > 0 {
+		log.WithField("count", n).Info("transcoder: queued spooled recordings")
+	}
+}
 
-			if err := t.state.Done(job.ID); err != nil {
-				log.WithError(err).Error("transcoder: failed to mark job as done")
-				e.SetError(fmt.Errorf("transcoder: failed to mark job as done: %s", err))
-				t.notify(e)
-				continue
-			}
+// Known reports whether the recording at path is queued, or has already
+// been processed according to the history.
+func (t *Transcoder) Known(path string) bool {
+	if t.state.HasPath(path) {
+		return true
+	}
+	return t.history != nil && t.history.Contains(path)
+}
 
+func (t *Transcoder) transcodeHandler() {
+	for {
+		job, ok := t.state.Next(t.trnCloseCh, t.config().Scheduling.Policy.Less, t.gate.Allows)
+		if !ok {
+			return
+		}
+
+		// The job sees the configuration as it was when it started
+		cfg := t.config()
+
+		e, err := media.NewEntity(t.enrich(*job.Details, cfg.TVHeadend), cfg.Media)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"path":  job.Details.Path,
+			}).Error("transcoder: error creating entity")
+			t.fail(job, err, cfg.MaxAttempts)
+			continue
+		}
+
+		if err := e.Transcode(); err != nil {
+			log.WithError(err).Error("transcoder: error during transcode")
+			e.SetError(fmt.Errorf("transcoder: error during transcode: %s", err))
+			e.Quarantined = t.fail(job, err, cfg.MaxAttempts)
+			t.notify(e)
+			continue
+		}
+
+		if err := t.state.Done(job.ID); err != nil {
+			log.WithError(err).Error("transcoder: failed to mark job as done")
+			e.SetError(fmt.Errorf("transcoder: failed to mark job as done: %s", err))
 			t.notify(e)
+			continue
 		}
+
+		t.notify(e)
+	}
+}
+
+// enrich adds what TVHeadend knows about the recording to details, when
+// looking it up is enabled.
+func (t *Transcoder) enrich(details media.Details, cfg tvheadend.Config) media.Details {
+	if !cfg.Enabled {
+		return details
+	}
+	client, err := tvheadend.New(cfg)
+	if err != nil {
+		log.WithError(err).Error("transcoder: unable to create TVHeadend client")
+		return details
 	}
+	return client.Enrich(details)
 }
 
+// fail records a failed job and reports whether it has been quarantined
+// after maxAttempts.
+func (t *Transcoder) fail(job *state.Job, jobErr error, maxAttempts int) bool {
+	quarantined, err := t.state.Fail(job.ID, jobErr, maxAttempts)
+	if err != nil {
+		log.WithError(err).Error("transcoder: failed to record job failure")
+	}
+
+	if quarantined {
+		log.WithFields(log.Fields{
+			"id":    job.ID,
+			"path":  job.Details.Path,
+			"title": job.Details.Title,
+		}).Warning("transcoder: job has failed too many times, quarantined")
+	}
+	return quarantined
+}
+
+// notify records a finished recording in the history and sends notifications.
 func (t *Transcoder) notify(e *media.Entity) {
+	if t.history != nil {
+		if err := t.history.Add(e, string(notify.OutcomeOf(e))); err != nil {
+			log.WithError(err).Error("transcoder: failed to record history")
+		}
+	}
+
 	if err := t.notificationHandler.DoNotifications(e); err != nil {
 		log.WithError(err).Error("transcoder: error when doing notifications")
 	}
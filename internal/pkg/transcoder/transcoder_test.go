@@ -0,0 +1,105 @@
+package transcoder
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/api"
+	"github.com/Xiol/tvhtc2/internal/pkg/config"
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/Xiol/tvhtc2/internal/pkg/notify"
+	"github.com/Xiol/tvhtc2/internal/pkg/scheduler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testTranscoder(t *testing.T, scheduling scheduler.Config) Transcoder {
+	dir := t.TempDir()
+	cfg := &config.Config{
+		StatePath:  filepath.Join(dir, "state.json"),
+		SocketPath: filepath.Join(dir, "tvhtc2.socket"),
+		Scheduling: scheduling,
+	}
+	cfg.Spool.Path = filepath.Join(dir, "spool")
+
+	tr, err := New(notify.Handler{}, Config(func() *config.Config { return cfg }))
+	require.NoError(t, err)
+	return tr
+}
+
+func TestTranscoder_closeWhileIdle(t *testing.T) {
+	tr := testTranscoder(t, scheduler.Config{})
+	sockPath := tr.config().SocketPath
+
+	done := make(chan error)
+	go func() { done <- tr.Do() }()
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(sockPath)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	tr.Close()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Do didn't return after Close")
+	}
+
+	assert.Eventually(t, func() bool {
+		conn, err := net.Dial("unix", sockPath)
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond, "the socket is no longer served")
+}
+
+func TestTranscoder_ordersByPriority(t *testing.T) {
+	tr := testTranscoder(t, scheduler.Config{
+		Policy: scheduler.PolicyPriority,
+		Rules:  []scheduler.Rule{{Title: "news", Priority: 10}},
+	})
+
+	urgent := 20
+	for _, req := range []api.Request{
+		{Command: api.CommandSubmit, Details: &media.Details{Path: "/recordings/Vera.ts", Title: "Vera"}},
+		{Command: api.CommandSubmit, Details: &media.Details{Path: "/recordings/News.ts", Title: "BBC News"}},
+		{Command: api.CommandSubmit, Details: &media.Details{Path: "/recordings/Film.ts", Title: "Film"}, Priority: &urgent},
+		{Command: api.CommandSubmit, Details: &media.Details{Path: "/recordings/Taskmaster.ts", Title: "Taskmaster"}},
+	} {
+		resp := tr.Handle(req)
+		require.True(t, resp.OK, resp.Error)
+	}
+
+	closeCh := make(chan struct{})
+	defer close(closeCh)
+	var titles []string
+	for i := 0; i < 4; i++ {
+		job, ok := tr.state.Next(closeCh, tr.config().Scheduling.Policy.Less, tr.gate.Allows)
+		require.True(t, ok)
+		titles = append(titles, job.Details.Title)
+	}
+	assert.Equal(t, []string{"Film", "BBC News", "Vera", "Taskmaster"}, titles)
+}
+
+func TestTranscoder_probesAfterQueueing(t *testing.T) {
+	tr := testTranscoder(t, scheduler.Config{})
+	release := make(chan struct{})
+	tr.probeDuration = func(path string) (time.Duration, error) {
+		<-release
+		return time.Hour, nil
+	}
+
+	resp := tr.Handle(api.Request{Command: api.CommandSubmit, Details: &media.Details{Path: "/recordings/Vera.ts"}})
+	require.True(t, resp.OK, "a hung probe doesn't hold up the response")
+	assert.Zero(t, tr.state.List()[0].SourceDuration)
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		return tr.state.List()[0].SourceDuration == time.Hour
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,235 @@
+package tvheadend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/httpclient"
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	log "github.com/sirupsen/logrus"
+)
+
+// Config describes how to reach TVHeadend's HTTP API.
+type Config struct {
+	Enabled bool
+	// URL is TVHeadend's web interface, such as http://tvheadend:9981.
+	URL      string
+	Username string
+	Password string
+	Timeout  time.Duration
+}
+
+// Validate checks that the configuration is usable.
+func (c Config) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.URL == "" {
+		return fmt.Errorf("tvheadend: url must be set when it is enabled")
+	}
+	if _, err := url.Parse(c.URL); err != nil {
+		return fmt.Errorf("tvheadend: invalid url '%s': %s", c.URL, err)
+	}
+	return nil
+}
+
+// An Entry is a DVR entry, as returned by /api/dvr/entry/grid.
+type Entry struct {
+	UUID        string `json:"uuid"`
+	Title       string `json:"disp_title"`
+	Subtitle    string `json:"disp_subtitle"`
+	Summary     string `json:"disp_summary"`
+	Description string `json:"disp_description"`
+	Episode     string `json:"episode_disp"`
+	Channel     string `json:"channelname"`
+	Filename    string `json:"filename"`
+	Status      string `json:"status"`
+	Image       string `json:"image"`
+	Genre       []int  `json:"genre"`
+	Start       int64  `json:"start"`
+	Stop        int64  `json:"stop"`
+}
+
+type gridResponse struct {
+	Entries []Entry `json:"entries"`
+	Total   int     `json:"total"`
+}
+
+// Client looks up recordings in TVHeadend.
+type Client struct {
+	cfg    Config
+	client *http.Client
+}
+
+// New returns a Client for the TVHeadend described by cfg.
+func New(cfg Config) (*Client, error) {
+	c, err := httpclient.New(httpclient.Options{Timeout: cfg.Timeout})
+	if err != nil {
+		return nil, fmt.Errorf("tvheadend: %s", err)
+	}
+	return &Client{cfg: cfg, client: c}, nil
+}
+
+// FindByFilename returns the DVR entry that recorded to path. Entries are
+// matched on the whole path, or failing that on the filename alone, as
+// TVHeadend may see its recordings directory at a different path.
+func (c *Client) FindByFilename(path string) (*Entry, error) {
+	filter, err := json.Marshal([]map[string]string{{
+		"type":  "string",
+		"field": "filename",
+		"value": filepath.Base(path),
+	}})
+	if err != nil {
+		return nil, fmt.Errorf("tvheadend: error building filter: %s", err)
+	}
+
+	q := url.Values{}
+	q.Set("limit", "100")
+	q.Set("filter", string(filter))
+	u := strings.TrimRight(c.cfg.URL, "/") + "/api/dvr/entry/grid?" + q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("tvheadend: error building request: %s", err)
+	}
+	if c.cfg.Username != "" {
+		req.SetBasicAuth(c.cfg.Username, c.cfg.Password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("tvheadend: error querying DVR entries: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tvheadend: bad status code %d querying DVR entries", resp.StatusCode)
+	}
+
+	var grid gridResponse
+	if err := json.NewDecoder(resp.Body).Decode(&grid); err != nil {
+		return nil, fmt.Errorf("tvheadend: error decoding DVR entries: %s", err)
+	}
+
+	var match *Entry
+	for i, e := range grid.Entries {
+		if e.Filename == path {
+			return &grid.Entries[i], nil
+		}
+		if match == nil && filepath.Base(e.Filename) == filepath.Base(path) {
+			match = &grid.Entries[i]
+		}
+	}
+	if match == nil {
+		return nil, fmt.Errorf("tvheadend: no DVR entry recorded to %s", path)
+	}
+	return match, nil
+}
+
+// Enrich fills in what TVHeadend knows about the recording at d.Path.
+// Anything already set in d is kept. Errors are logged and d is returned
+// as it was, as the extra metadata is only a nicety.
+func (c *Client) Enrich(d media.Details) media.Details {
+	e, err := c.FindByFilename(d.Path)
+	if err != nil {
+		log.WithError(err).WithField("path", d.Path).Warning("tvheadend: unable to look up recording")
+		return d
+	}
+
+	log.WithFields(log.Fields{
+		"path": d.Path,
+		"uuid": e.UUID,
+	}).Debug("tvheadend: found DVR entry for recording")
+	return e.Merge(d)
+}
+
+var (
+	seasonMatcher  = regexp.MustCompile(`(?i)(?:season\s*|\bs)(\d+)`)
+	episodeMatcher = regexp.MustCompile(`(?i)(?:episode\s*|\d\s*e|\bep?\.?\s*)(\d+)`)
+)
+
+// SeasonEpisode parses the season and episode numbers from TVHeadend's
+// episode display text, such as "Season 3.Episode 2" or "S03E02". Numbers
+// that aren't present are zero.
+func (e Entry) SeasonEpisode() (int, int) {
+	var season, episode int
+	if m := seasonMatcher.FindStringSubmatch(e.Episode); m != nil {
+		season, _ = strconv.Atoi(m[1])
+	}
+	if m := episodeMatcher.FindStringSubmatch(e.Episode); m != nil {
+		episode, _ = strconv.Atoi(m[1])
+	}
+	return season, episode
+}
+
+// Merge returns d with the empty fields filled in from the entry.
+func (e Entry) Merge(d media.Details) media.Details {
+	fill := func(field *string, value string) {
+		if *field == "" {
+			*field = strings.TrimSpace(value)
+		}
+	}
+
+	fill(&d.Title, e.Title)
+	fill(&d.Channel, e.Channel)
+	fill(&d.Description, e.Description)
+	fill(&d.Description, e.Summary)
+	fill(&d.Subtitle, e.Subtitle)
+	fill(&d.ImageURL, e.Image)
+
+	season, episode := e.SeasonEpisode()
+	if d.Season == 0 {
+		d.Season = season
+	}
+	if d.Episode == 0 {
+		d.Episode = episode
+	}
+	if len(d.Genre) == 0 {
+		d.Genre = Genres(e.Genre)
+	}
+	if d.Start.IsZero() && e.Start > 0 {
+		d.Start = time.Unix(e.Start, 0)
+	}
+	if d.Stop.IsZero() && e.Stop > 0 {
+		d.Stop = time.Unix(e.Stop, 0)
+	}
+	return d
+}
+
+// genres names the DVB content nibble levels that TVHeadend reports genres
+// as, by their most significant nibble.
+var genres = map[int]string{
+	0x1: "Movie / Drama",
+	0x2: "News / Current affairs",
+	0x3: "Show / Game show",
+	0x4: "Sports",
+	0x5: "Children's / Youth programmes",
+	0x6: "Music / Ballet / Dance",
+	0x7: "Arts / Culture",
+	0x8: "Social / Political issues / Economics",
+	0x9: "Education / Science / Factual topics",
+	0xa: "Leisure hobbies",
+	0xb: "Special characteristics",
+}
+
+// Genres returns the names of TVHeadend's genre codes, without duplicates.
+func Genres(codes []int) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		name, ok := genres[code>>4]
+		if !ok || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,113 @@
+package tvheadend
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fakeTVHeadend(t *testing.T, entries ...Entry) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/dvr/entry/grid" {
+			http.NotFound(w, r)
+			return
+		}
+		if user, pass, _ := r.BasicAuth(); user != "tvh" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var filter []map[string]string
+		require.NoError(t, json.Unmarshal([]byte(r.URL.Query().Get("filter")), &filter))
+		require.Len(t, filter, 1)
+		assert.Equal(t, "filename", filter[0]["field"])
+
+		json.NewEncoder(w).Encode(gridResponse{Entries: entries, Total: len(entries)})
+	}))
+}
+
+func TestClient_Enrich(t *testing.T) {
+	srv := fakeTVHeadend(t,
+		Entry{UUID: "other", Filename: "/elsewhere/Vera/Vera2020-01-0121-00.ts"},
+		Entry{
+			UUID:     "abc",
+			Title:    "Vera",
+			Subtitle: "Blood Will Tell",
+			Summary:  "DCI Vera Stanhope investigates.",
+			Episode:  "Season 10.Episode 2",
+			Channel:  "ITV HD",
+			Filename: "/recordings/Vera/Vera2020-01-0121-00.ts",
+			Image:    "http://example.com/vera.jpg",
+			Genre:    []int{0x10, 0x15, 0x20},
+			Start:    1577912400,
+			Stop:     1577919600,
+		},
+	)
+	defer srv.Close()
+
+	c, err := New(Config{Enabled: true, URL: srv.URL + "/", Username: "tvh", Password: "secret", Timeout: time.Second})
+	require.NoError(t, err)
+
+	d := c.Enrich(media.Details{
+		Path:  "/recordings/Vera/Vera2020-01-0121-00.ts",
+		Title: "Vera (New)",
+	})
+	assert.Equal(t, "Vera (New)", d.Title, "details from the command line are kept")
+	assert.Equal(t, "ITV HD", d.Channel)
+	assert.Equal(t, "DCI Vera Stanhope investigates.", d.Description)
+	assert.Equal(t, "Blood Will Tell", d.Subtitle)
+	assert.Equal(t, 10, d.Season)
+	assert.Equal(t, 2, d.Episode)
+	assert.Equal(t, []string{"Movie / Drama", "News / Current affairs"}, d.Genre)
+	assert.Equal(t, "http://example.com/vera.jpg", d.ImageURL)
+	assert.Equal(t, time.Unix(1577912400, 0), d.Start)
+	assert.Equal(t, time.Unix(1577919600, 0), d.Stop)
+}
+
+func TestClient_FindByFilename(t *testing.T) {
+	srv := fakeTVHeadend(t, Entry{UUID: "abc", Filename: "/var/lib/tvheadend/Vera/Vera.ts"})
+	defer srv.Close()
+
+	c, err := New(Config{URL: srv.URL, Username: "tvh", Password: "secret"})
+	require.NoError(t, err)
+
+	e, err := c.FindByFilename("/recordings/Vera/Vera.ts")
+	require.NoError(t, err)
+	assert.Equal(t, "abc", e.UUID, "entries match on the filename when the directories differ")
+
+	_, err = c.FindByFilename("/recordings/Vera/Other.ts")
+	assert.Error(t, err)
+
+	c.cfg.Password = "wrong"
+	_, err = c.FindByFilename("/recordings/Vera/Vera.ts")
+	assert.Error(t, err)
+
+	// Lookup failures leave the details alone
+	d := media.Details{Path: "/recordings/Vera/Vera.ts", Title: "Vera"}
+	assert.Equal(t, d, c.Enrich(d))
+}
+
+func TestEntry_SeasonEpisode(t *testing.T) {
+	tests := []struct {
+		in              string
+		season, episode int
+	}{
+		{"Season 3.Episode 2", 3, 2},
+		{"S03E02", 3, 2},
+		{"s1 e12", 1, 12},
+		{"Episode 7", 0, 7},
+		{"Ep. 4", 0, 4},
+		{"", 0, 0},
+	}
+	for _, tt := range tests {
+		season, episode := Entry{Episode: tt.in}.SeasonEpisode()
+		assert.Equal(t, tt.season, season, tt.in)
+		assert.Equal(t, tt.episode, episode, tt.in)
+	}
+}
@@ -0,0 +1,393 @@
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultStableFor = time.Minute
+	defaultInterval  = 10 * time.Second
+	// markInterval is how often the mark is updated while watching.
+	markInterval = time.Minute
+)
+
+// Config controls which directories are watched for new recordings.
+type Config struct {
+	Enabled     bool
+	Directories []string
+	// Recursive also watches every directory below Directories.
+	Recursive bool
+	// Include and Exclude are globs matched against the filename. Files must
+	// match one of Include, if there are any, and none of Exclude.
+	Include []string
+	Exclude []string
+	// StableFor is how long a file's size and modification time must stay
+	// the same before it is considered complete.
+	StableFor time.Duration
+	// Interval is how often files are checked for stability.
+	Interval time.Duration
+}
+
+// Validate checks that the configuration is usable.
+func (c Config) Validate() error {
+	for _, glob := range append(append([]string(nil), c.Include...), c.Exclude...) {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return fmt.Errorf("watcher: invalid glob '%s': %s", glob, err)
+		}
+	}
+	if !c.Enabled {
+		return nil
+	}
+
+	if len(c.Directories) == 0 {
+		return fmt.Errorf("watcher: no directories to watch")
+	}
+	for _, dir := range c.Directories {
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			return fmt.Errorf("watcher: directory %s does not exist", dir)
+		}
+	}
+	return nil
+}
+
+// A SubmitFunc queues a recording found by the watcher.
+type SubmitFunc func(details media.Details) error
+
+// candidate is a file waiting to become stable.
+type candidate struct {
+	root    string
+	size    int64
+	modTime time.Time
+	since   time.Time
+}
+
+// Watcher queues recordings that appear in the watched directories once
+// they have finished being written.
+type Watcher struct {
+	cfg    Config
+	submit SubmitFunc
+	known  func(path string) bool
+	probe  func(path string) (time.Duration, error)
+	// markPath is the file whose modification time records when the
+	// watcher last ran, and since is that time as of startup.
+	markPath string
+	since    time.Time
+
+	fsw     *fsnotify.Watcher
+	mu      sync.Mutex
+	pending map[string]*candidate
+	closeCh chan struct{}
+}
+
+// New returns a Watcher that passes recordings to submit.
+func New(cfg Config, submit SubmitFunc, options ...func(*Watcher)) *Watcher {
+	w := &Watcher{
+		cfg:     cfg,
+		submit:  submit,
+		known:   func(string) bool { return false },
+		probe:   media.ProbeDuration,
+		pending: make(map[string]*candidate),
+		closeCh: make(chan struct{}),
+	}
+	for _, opt := range options {
+		opt(w)
+	}
+	return w
+}
+
+// Known skips files for which fn returns true, such as recordings that are
+// already queued or were produced by a transcode.
+func Known(fn func(path string) bool) func(*Watcher) {
+	return func(w *Watcher) {
+		w.known = fn
+	}
+}
+
+// Mark remembers when the watcher last ran in the modification time of the
+// file at path. Only files modified since then are picked up on startup, so
+// that recordings made while the daemon was down are queued but the rest of
+// the library isn't, however long ago it was processed. Without a mark, or
+// the first time, only files that change after startup are picked up.
+func Mark(path string) func(*Watcher) {
+	return func(w *Watcher) {
+		w.markPath = path
+	}
+}
+
+// Start watches the configured directories in the background until Close
+// is called. Files already in the directories that were modified since the
+// watcher last ran are considered too, see Mark.
+func (w *Watcher) Start() error {
+	var err error
+	if w.fsw, err = fsnotify.NewWatcher(); err != nil {
+		return fmt.Errorf("watcher: error creating watcher: %s", err)
+	}
+
+	now := time.Now()
+	w.since = w.lastRun(now)
+	for _, dir := range w.cfg.Directories {
+		if err := w.add(dir, dir, w.since); err != nil {
+			w.fsw.Close()
+			return err
+		}
+	}
+	w.updateMark(now)
+
+	go w.loop()
+	log.WithField("directories", w.cfg.Directories).Info("watcher: watching for recordings")
+	return nil
+}
+
+// Close stops watching.
+func (w *Watcher) Close() {
+	close(w.closeCh)
+}
+
+// lastRun returns when the watcher last ran according to the mark, or now if
+// it never has.
+func (w *Watcher) lastRun(now time.Time) time.Time {
+	if w.markPath == "" {
+		return now
+	}
+	fi, err := os.Stat(w.markPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).Warning("watcher: unable to read mark, only picking up new recordings")
+		}
+		return now
+	}
+	return fi.ModTime()
+}
+
+// updateMark records that the watcher has seen everything up to now, apart
+// from the files still waiting to become stable, so they are picked up
+// again after a restart.
+func (w *Watcher) updateMark(now time.Time) {
+	if w.markPath == "" {
+		return
+	}
+
+	mark := now
+	w.mu.Lock()
+	for path := range w.pending {
+		if fi, err := os.Stat(path); err == nil && fi.ModTime().Before(mark) {
+			mark = fi.ModTime()
+		}
+	}
+	w.mu.Unlock()
+
+	f, err := os.OpenFile(w.markPath, os.O_CREATE|os.O_WRONLY, 0640)
+	if err == nil {
+		f.Close()
+		err = os.Chtimes(w.markPath, mark, mark)
+	}
+	if err != nil {
+		log.WithError(err).Warning("watcher: unable to update mark")
+	}
+}
+
+// add watches dir, which is below root, and notes the files already in it
+// that were modified at or after since.
+func (w *Watcher) add(root, dir string, since time.Time) error {
+	if err := w.fsw.Add(dir); err != nil {
+		return fmt.Errorf("watcher: error watching %s: %s", dir, err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("watcher: error reading %s: %s", dir, err)
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if entry.IsDir() {
+			if w.cfg.Recursive {
+				if err := w.add(root, path, since); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if fi, err := entry.Info(); err != nil || fi.ModTime().Before(since) {
+			continue
+		}
+		w.note(root, path, time.Now())
+	}
+	return nil
+}
+
+func (w *Watcher) loop() {
+	defer w.fsw.Close()
+
+	interval := w.cfg.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastMark := time.Now()
+
+	for {
+		select {
+		case <-w.closeCh:
+			w.updateMark(time.Now())
+			return
+		case ev, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+			w.handle(ev)
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+			log.WithError(err).Error("watcher: error watching directories")
+		case now := <-ticker.C:
+			w.check(now)
+			if now.Sub(lastMark) >= markInterval {
+				w.updateMark(now)
+				lastMark = now
+			}
+		}
+	}
+}
+
+func (w *Watcher) handle(ev fsnotify.Event) {
+	if ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename) {
+		w.mu.Lock()
+		delete(w.pending, ev.Name)
+		w.mu.Unlock()
+		return
+	}
+	if !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Write) {
+		return
+	}
+
+	root := w.root(ev.Name)
+	if fi, err := os.Stat(ev.Name); err == nil && fi.IsDir() {
+		// Everything in a new directory is new to us, however old it is
+		if ev.Has(fsnotify.Create) && w.cfg.Recursive {
+			if err := w.add(root, ev.Name, time.Time{}); err != nil {
+				log.WithError(err).Error("watcher: error watching new directory")
+			}
+		}
+		return
+	}
+	w.note(root, ev.Name, time.Now())
+}
+
+// root returns the watched directory that path is below.
+func (w *Watcher) root(path string) string {
+	for _, dir := range w.cfg.Directories {
+		dir = filepath.Clean(dir)
+		if strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return dir
+		}
+	}
+	return filepath.Dir(path)
+}
+
+// note starts waiting for the file at path to become stable, if it is one
+// we are interested in.
+func (w *Watcher) note(root, path string, now time.Time) {
+	if !w.match(filepath.Base(path)) {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.pending[path]; !ok {
+		w.pending[path] = &candidate{root: root, since: now}
+	}
+}
+
+// match reports whether a file named name should be considered.
+func (w *Watcher) match(name string) bool {
+	return Match(w.cfg.Include, w.cfg.Exclude, name)
+}
+
+// Match reports whether a file named name could be a recording. It must
+// match one of the include globs, if there are any, and none of the exclude
+// globs. Hidden files and transcodes in progress never match.
+func Match(include, exclude []string, name string) bool {
+	if strings.HasPrefix(name, ".") || media.IsTempFile(name) {
+		return false
+	}
+	for _, glob := range exclude {
+		if ok, _ := filepath.Match(glob, name); ok {
+			return false
+		}
+	}
+	if len(include) == 0 {
+		return true
+	}
+	for _, glob := range include {
+		if ok, _ := filepath.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// check queues the pending files that have been stable for long enough.
+func (w *Watcher) check(now time.Time) {
+	stableFor := w.cfg.StableFor
+	if stableFor <= 0 {
+		stableFor = defaultStableFor
+	}
+
+	var ready []string
+	roots := make(map[string]string)
+
+	w.mu.Lock()
+	for path, c := range w.pending {
+		fi, err := os.Stat(path)
+		if err != nil {
+			delete(w.pending, path)
+			continue
+		}
+		if fi.Size() != c.size || !fi.ModTime().Equal(c.modTime) {
+			c.size, c.modTime, c.since = fi.Size(), fi.ModTime(), now
+			continue
+		}
+		if now.Sub(c.since) >= stableFor {
+			ready = append(ready, path)
+			roots[path] = c.root
+			delete(w.pending, path)
+		}
+	}
+	w.mu.Unlock()
+
+	for _, path := range ready {
+		w.ingest(roots[path], path)
+	}
+}
+
+// ingest queues the stable file at path.
+func (w *Watcher) ingest(root, path string) {
+	fields := log.Fields{"path": path}
+
+	if w.known(path) {
+		log.WithFields(fields).Debug("watcher: file is already known, ignoring")
+		return
+	}
+	if _, err := w.probe(path); err != nil {
+		log.WithError(err).WithFields(fields).Warning("watcher: file could not be probed, ignoring")
+		return
+	}
+
+	details := media.DetailsFromPath(root, path)
+	if err := w.submit(details); err != nil {
+		log.WithError(err).WithFields(fields).Error("watcher: failed to queue recording")
+		return
+	}
+	log.WithFields(fields).WithField("title", details.Title).Info("watcher: queued recording")
+}
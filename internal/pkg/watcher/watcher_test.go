@@ -0,0 +1,138 @@
+package watcher
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Xiol/tvhtc2/internal/pkg/media"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatcher_match(t *testing.T) {
+	w := New(Config{Include: []string{"*.ts", "*.mkv"}, Exclude: []string{"*.part.*"}}, nil)
+
+	assert.True(t, w.match("Vera2020-01-0121-00.ts"))
+	assert.True(t, w.match("Vera.mkv"))
+	assert.False(t, w.match("Vera.nfo"))
+	assert.False(t, w.match("Vera.part.ts"))
+	assert.False(t, w.match(".Vera.ts"), "hidden files are ignored")
+	assert.False(t, w.match("0b8c0c1e-3c39-4a4e-9f05-4a3e9a1e2f6d.ts"), "transcodes in progress are ignored")
+
+	assert.True(t, New(Config{}, nil).match("anything"))
+}
+
+func TestConfig_Validate(t *testing.T) {
+	dir := t.TempDir()
+
+	assert.NoError(t, Config{}.Validate())
+	assert.NoError(t, Config{Enabled: true, Directories: []string{dir}, Include: []string{"*.ts"}}.Validate())
+	assert.Error(t, Config{Enabled: true}.Validate())
+	assert.Error(t, Config{Enabled: true, Directories: []string{filepath.Join(dir, "missing")}}.Validate())
+	assert.Error(t, Config{Exclude: []string{"[unclosed"}}.Validate())
+}
+
+type submissions struct {
+	sync.Mutex
+	details []media.Details
+}
+
+func (s *submissions) submit(d media.Details) error {
+	s.Lock()
+	defer s.Unlock()
+	s.details = append(s.details, d)
+	return nil
+}
+
+func TestWatcher_check(t *testing.T) {
+	dir := t.TempDir()
+	growing := filepath.Join(dir, "Growing.ts")
+	done := filepath.Join(dir, "Done.ts")
+	queued := filepath.Join(dir, "Queued.ts")
+	broken := filepath.Join(dir, "Broken.ts")
+	for _, path := range []string{growing, done, queued, broken} {
+		require.NoError(t, ioutil.WriteFile(path, []byte("data"), 0644))
+	}
+
+	var s submissions
+	w := New(Config{StableFor: time.Minute}, s.submit, Known(func(path string) bool { return path == queued }))
+	w.probe = func(path string) (time.Duration, error) {
+		if path == broken {
+			return 0, errors.New("invalid data found when processing input")
+		}
+		return time.Hour, nil
+	}
+
+	now := time.Now()
+	for _, path := range []string{growing, done, queued, broken} {
+		w.note(dir, path, now)
+	}
+
+	w.check(now)
+	assert.Empty(t, s.details)
+
+	f, err := os.OpenFile(growing, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString("more")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	w.check(now.Add(time.Minute))
+	require.Len(t, s.details, 1)
+	assert.Equal(t, media.Details{Path: done, Title: "Done"}, s.details[0])
+	assert.Len(t, w.pending, 1, "only the growing file is still waiting")
+
+	w.check(now.Add(2 * time.Minute))
+	require.Len(t, s.details, 2)
+	assert.Equal(t, growing, s.details[1].Path)
+	assert.Empty(t, w.pending)
+}
+
+func TestWatcher_Start(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	mark := filepath.Join(t.TempDir(), "watch.mark")
+	for path, modTime := range map[string]time.Time{
+		mark:                              now.Add(-30 * time.Minute),
+		filepath.Join(dir, "Existing.ts"): now.Add(-10 * time.Minute),
+		filepath.Join(dir, "Old.ts"):      now.Add(-2 * time.Hour),
+	} {
+		require.NoError(t, ioutil.WriteFile(path, []byte("data"), 0644))
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+
+	var s submissions
+	w := New(Config{Directories: []string{dir}, Recursive: true, StableFor: time.Millisecond, Interval: 10 * time.Millisecond}, s.submit, Mark(mark))
+	w.probe = func(string) (time.Duration, error) { return time.Hour, nil }
+	require.NoError(t, w.Start())
+
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "Vera"), 0755))
+	// Give the watcher a chance to watch the new directory
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "Vera", "Vera2020-01-0121-00.ts"), []byte("data"), 0644))
+
+	assert.Eventually(t, func() bool {
+		s.Lock()
+		defer s.Unlock()
+		return len(s.details) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	titles := map[string]bool{}
+	s.Lock()
+	for _, d := range s.details {
+		titles[d.Title] = true
+	}
+	s.Unlock()
+	assert.Equal(t, map[string]bool{"Existing": true, "Vera": true}, titles, "files older than the mark are left alone")
+
+	w.Close()
+	assert.Eventually(t, func() bool {
+		fi, err := os.Stat(mark)
+		return err == nil && !fi.ModTime().Before(now)
+	}, 5*time.Second, 10*time.Millisecond, "the mark is updated once nothing is pending")
+}